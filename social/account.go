@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	uuid "github.com/satori/go.uuid"
+	"net/http"
+	"time"
+)
+
+const (
+	exportPostsLimit    = 100000
+	exportMessagesLimit = 100000
+)
+
+// deleteHandler is mounted into /me, so only authed users get here
+func (app *App) deleteHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		app.renderDelete(w, &templates.DeleteInfo{})
+	})
+	router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		user := GetUser(r.Context())
+		ok, _, err := model.VerifyPassword(r.Form.Get("Password"), user.PasswordHash)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to verify password")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			app.renderDelete(w, &templates.DeleteInfo{Err: model.ErrWrongPassword.Error()})
+			return
+		}
+		// followers are gone with the friendships, so they are looked up beforehand
+		followers, err := app.storage.ListFollowerIDs(r.Context(), user.ID)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to list followers")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// messages are in another database, they go first, so that the deletion can be retried if it fails
+		if err := app.messages.DeleteUserDialogs(r.Context(), user.ID); err != nil {
+			app.log(r.Context()).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to delete dialogs")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := app.storage.DeleteUser(r.Context(), user.ID, time.Now().UTC().Add(model.UsernameQuarantine)); err != nil {
+			app.log(r.Context()).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to delete user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		app.log(r.Context()).Info().Str("userID", user.ID.String()).Msg("user deleted")
+		for _, id := range append(followers, user.ID) {
+			if err := app.feed.Invalidate(id); err != nil {
+				app.log(r.Context()).Error().Err(err).Str("userID", id.String()).Msg("failed to invalidate feed")
+			}
+		}
+		app.removeAuthCookie(w)
+		redirect(w, r, "/")
+	})
+	return router
+}
+
+func (app *App) renderDelete(w http.ResponseWriter, info *templates.DeleteInfo) {
+	if err := app.Templates.Delete.Execute(w, info); err != nil {
+		app.logger.Error().Err(err).Msg("failed to render delete page")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+type exportSession struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type exportPost struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportMessage struct {
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportDialog struct {
+	With     string          `json:"with"`
+	Messages []exportMessage `json:"messages"`
+}
+
+// userExport is everything stored about the user, except password hash and tokens themselves
+type userExport struct {
+	Profile        *apiUser        `json:"profile"`
+	Sessions       []exportSession `json:"sessions"`
+	Friends        []*apiUser      `json:"friends"`
+	FriendRequests []*apiUser      `json:"friendRequests"`
+	Posts          []exportPost    `json:"posts"`
+	Dialogs        []exportDialog  `json:"dialogs"`
+}
+
+// exportHandler is mounted into /me, it returns json, or zip with json file per section if format=zip
+func (app *App) exportHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r.Context())
+		export, err := app.exportUser(r.Context(), user)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to export user data")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		app.log(r.Context()).Info().Str("userID", user.ID.String()).Msg("user data exported")
+		if r.URL.Query().Get("format") != "zip" {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+user.Username+`.json"`)
+			app.writeJSON(w, http.StatusOK, export)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+user.Username+`.zip"`)
+		if err := writeExportZip(w, export); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to write export archive")
+		}
+	})
+	return router
+}
+
+func (app *App) exportUser(ctx context.Context, user *model.User) (*userExport, error) {
+	export := userExport{
+		Profile:        newAPIUser(user),
+		Sessions:       []exportSession{},
+		Friends:        []*apiUser{},
+		FriendRequests: []*apiUser{},
+		Posts:          []exportPost{},
+		Dialogs:        []exportDialog{},
+	}
+	sessions, err := app.storage.ListTokens(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		export.Sessions = append(export.Sessions, exportSession{
+			ID:         s.ID(),
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+		})
+	}
+	friends, err := app.storage.ListFriends(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range friends {
+		export.Friends = append(export.Friends, newAPIUser(f))
+	}
+	pending, err := app.storage.ListPendingRequests(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pending {
+		export.FriendRequests = append(export.FriendRequests, newAPIUser(p))
+	}
+	posts, err := app.storage.ListPostsByAuthor(ctx, user.ID, exportPostsLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range posts {
+		export.Posts = append(export.Posts, exportPost{ID: p.ID.String(), Text: p.Text, CreatedAt: p.CreatedAt})
+	}
+	dialogs, err := app.messages.ListDialogs(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dialogs {
+		messages, err := app.messages.ListMessages(ctx, d.ID, exportMessagesLimit)
+		if err != nil {
+			return nil, err
+		}
+		dialog := exportDialog{With: d.Other, Messages: make([]exportMessage, 0, len(messages))}
+		for _, m := range messages {
+			author := d.Other
+			if uuid.Equal(m.AuthorID, user.ID) {
+				author = user.Username
+			}
+			dialog.Messages = append(dialog.Messages, exportMessage{
+				Author:    author,
+				Text:      m.Text,
+				CreatedAt: m.CreatedAt,
+			})
+		}
+		export.Dialogs = append(export.Dialogs, dialog)
+	}
+	return &export, nil
+}
+
+func writeExportZip(w http.ResponseWriter, export *userExport) error {
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"sessions.json", export.Sessions},
+		{"friends.json", export.Friends},
+		{"friend_requests.json", export.FriendRequests},
+		{"posts.json", export.Posts},
+		{"dialogs.json", export.Dialogs},
+	}
+	for _, f := range files {
+		fw, err := archive.Create(f.name)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(fw)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(f.content); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
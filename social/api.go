@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiUser struct {
+	ID        string   `json:"id"`
+	Username  string   `json:"username"`
+	FirstName string   `json:"firstName"`
+	LastName  string   `json:"lastName"`
+	Age       int      `json:"age"`
+	Gender    string   `json:"gender"`
+	City      string   `json:"city"`
+	Interests []string `json:"interests"`
+}
+
+func newAPIUser(u *model.User) *apiUser {
+	interests := u.Interests
+	if interests == nil {
+		interests = []string{}
+	}
+	return &apiUser{
+		ID:        u.ID.String(),
+		Username:  u.Username,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Age:       u.Age,
+		Gender:    u.Gender,
+		City:      u.City,
+		Interests: interests,
+	}
+}
+
+type apiSignupRequest struct {
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	FirstName string   `json:"firstName"`
+	LastName  string   `json:"lastName"`
+	Age       int      `json:"age"`
+	Gender    string   `json:"gender"`
+	City      string   `json:"city"`
+	Interests []string `json:"interests"`
+}
+
+func (sr *apiSignupRequest) toSignupInfo() *templates.SignupInfo {
+	return &templates.SignupInfo{
+		Username:  sr.Username,
+		Password:  sr.Password,
+		FirstName: sr.FirstName,
+		LastName:  sr.LastName,
+		Age:       strconv.Itoa(sr.Age),
+		Gender:    sr.Gender,
+		Interests: strings.Join(sr.Interests, ","),
+		City:      sr.City,
+	}
+}
+
+type apiLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type apiLoginResponse struct {
+	Token string   `json:"token"`
+	User  *apiUser `json:"user"`
+}
+
+type apiUsernames struct {
+	Usernames []string `json:"usernames"`
+	// Next is the cursor of the next page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+func (app *App) apiHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Post("/signup", app.apiSignup)
+	router.Post("/login", app.apiLogin)
+	router.Get("/users/last", app.apiLastUsernames)
+	router.Get("/users/{username}", app.apiGetUser)
+	router.Group(func(authed chi.Router) {
+		authed.Use(app.apiRequireAuth)
+		authed.Get("/me", app.apiMe)
+		authed.Post("/logout", app.apiLogout)
+	})
+	return router
+}
+
+func (app *App) apiSignup(w http.ResponseWriter, r *http.Request) {
+	var req apiSignupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		app.writeAPIError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return
+	}
+	usr, invalid, err := app.signup(r.Context(), req.toSignupInfo())
+	if err != nil {
+		app.writeAPIError(w, http.StatusInternalServerError, "failed to sign up")
+		return
+	}
+	if invalid != nil {
+		app.writeAPIError(w, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	app.writeJSON(w, http.StatusCreated, newAPIUser(usr))
+}
+
+func (app *App) apiLogin(w http.ResponseWriter, r *http.Request) {
+	var req apiLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		app.writeAPIError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return
+	}
+	if req.Username == "" {
+		app.writeAPIError(w, http.StatusBadRequest, "username is empty")
+		return
+	}
+	usr, token, err := app.login(r, req.Username, req.Password)
+	if err != nil {
+		app.writeAPIError(w, http.StatusInternalServerError, "failed to log in")
+		return
+	}
+	if usr == nil {
+		app.writeAPIError(w, http.StatusUnauthorized, "user not found or password is wrong")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, &apiLoginResponse{
+		Token: token.String(),
+		User:  newAPIUser(usr),
+	})
+}
+
+func (app *App) apiGetUser(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	user, err := app.storage.FindUserByUsername(r.Context(), username)
+	if err != nil {
+		app.log(r.Context()).Error().Err(err).Msg("failed to get user by username")
+		app.writeAPIError(w, http.StatusInternalServerError, "failed to get user")
+		return
+	}
+	if user == nil {
+		app.writeAPIError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, newAPIUser(user))
+}
+
+func (app *App) apiLastUsernames(w http.ResponseWriter, r *http.Request) {
+	usernames, next, err := app.storage.LastUsernames(r.Context(), pageCursor(r), app.config.PageSize)
+	if err == storage.ErrInvalidCursor {
+		app.writeAPIError(w, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	if err != nil {
+		app.log(r.Context()).Error().Err(err).Msg("failed to get last usernames")
+		app.writeAPIError(w, http.StatusInternalServerError, "failed to get last usernames")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, &apiUsernames{Usernames: usernames, Next: string(next)})
+}
+
+func (app *App) apiMe(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, newAPIUser(GetUser(r.Context())))
+}
+
+func (app *App) apiLogout(w http.ResponseWriter, r *http.Request) {
+	if err := app.storage.DeleteToken(r.Context(), GetToken(r.Context())); err != nil {
+		app.log(r.Context()).Error().Err(err).Msg("failed to delete token")
+		app.writeAPIError(w, http.StatusInternalServerError, "failed to log out")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *App) apiRequireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetUser(r.Context()) == nil {
+			app.writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (app *App) writeAPIError(w http.ResponseWriter, status int, message string) {
+	app.writeJSON(w, status, &apiError{Error: message})
+}
+
+func (app *App) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		app.logger.Error().Err(err).Msg("failed to write json response")
+	}
+}
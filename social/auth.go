@@ -4,11 +4,20 @@ import (
 	"context"
 	"github.com/chocosin/otus-hl/social/model"
 	uuid "github.com/satori/go.uuid"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
-const CookieName = "auth_token"
+const bearerPrefix = "Bearer "
+
+// SessionTTL is how long a session lives without any activity
+const SessionTTL = time.Hour * 24 * 30
+
+// sessionTouchInterval limits how often session expiration is prolonged on activity
+const sessionTouchInterval = time.Minute
 
 type contextKeyAuth = int
 
@@ -30,48 +39,63 @@ func (app *App) checkAuthedAndRedirect(authed bool, redirectTo string) func(http
 	}
 }
 
-func SetAuthCookie(w http.ResponseWriter, token uuid.UUID) {
-	http.SetCookie(w, &http.Cookie{
-		Name:    CookieName,
-		Value:   token.String(),
-		Expires: time.Now().Add(time.Hour * 24 * 30),
-	})
+func (app *App) setAuthCookie(w http.ResponseWriter, token uuid.UUID) {
+	cookie := app.authCookie()
+	cookie.Value = token.String()
+	cookie.Expires = time.Now().Add(SessionTTL)
+	http.SetCookie(w, cookie)
+}
+
+func (app *App) removeAuthCookie(w http.ResponseWriter) {
+	cookie := app.authCookie()
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// authCookie returns the auth cookie with attributes from config
+func (app *App) authCookie() *http.Cookie {
+	cfg := app.config.Cookie
+	return &http.Cookie{
+		Name:     cfg.Name,
+		Domain:   cfg.Domain,
+		Path:     cfg.Path,
+		Secure:   cfg.Secure,
+		HttpOnly: cfg.HTTPOnly,
+		SameSite: sameSiteModes[cfg.SameSite],
+	}
 }
 
-func RemoveAuthCookie(w http.ResponseWriter) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   CookieName,
-		MaxAge: -1,
-	})
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
 }
 
 func (app *App) auth(h http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(CookieName)
-		if err != nil {
-			if err != http.ErrNoCookie {
-				app.logger.Err(err).Msg("failed to get auth cookie")
-			}
+		tokenStr, fromCookie := app.authTokenFromRequest(r)
+		if tokenStr == "" {
 			h.ServeHTTP(w, r)
 			return
 		}
-		token, err := uuid.FromString(cookie.Value)
+		token, err := uuid.FromString(tokenStr)
 		if err != nil {
-			app.logger.Err(err).
-				Str("cookie", cookie.Value).
-				Msg("failed to parse cookie")
+			app.log(r.Context()).Err(err).
+				Str("token", tokenStr).
+				Msg("failed to parse auth token")
 			h.ServeHTTP(w, r)
 			return
 		}
-		user, err := app.storage.GetUserByToken(token)
+		user, err := app.storage.GetUserByToken(r.Context(), token)
 		if err != nil {
-			app.logger.Err(err).
+			app.log(r.Context()).Err(err).
 				Str("token", token.String()).
 				Msg("failed to retrieve user by token")
 			h.ServeHTTP(w, r)
 			return
 		}
 		if user != nil {
+			app.touchSession(r.Context(), w, token, fromCookie)
 			ctx := r.Context()
 			ctx = context.WithValue(ctx, UserKey, user)
 			ctx = context.WithValue(ctx, TokenKey, token)
@@ -82,6 +106,103 @@ func (app *App) auth(h http.Handler) http.Handler {
 	return http.HandlerFunc(f)
 }
 
+// authTokenFromRequest returns token from the "Authorization: Bearer" header used by api clients,
+// falling back to the auth cookie used by browsers
+func (app *App) authTokenFromRequest(r *http.Request) (token string, fromCookie bool) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+		return strings.TrimSpace(header[len(bearerPrefix):]), false
+	}
+	cookie, err := r.Cookie(app.config.Cookie.Name)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// touchSession slides session expiration on activity, renewing the cookie as well.
+// Sessions touched by the instance within sessionTouchInterval aren't written to the storage.
+func (app *App) touchSession(ctx context.Context, w http.ResponseWriter, token uuid.UUID, renewCookie bool) {
+	now := time.Now().UTC().Truncate(time.Second)
+	if app.touches.recent(token, now) {
+		return
+	}
+	touched, err := app.storage.TouchToken(ctx, token, now, now.Add(SessionTTL), sessionTouchInterval)
+	if err != nil {
+		app.log(ctx).Err(err).
+			Str("token", token.String()).
+			Msg("failed to prolong session")
+		return
+	}
+	app.touches.add(token, now)
+	if touched && renewCookie {
+		app.setAuthCookie(w, token)
+	}
+}
+
+// sessionTouches remembers when sessions have been seen by the instance, so that every authenticated
+// request doesn't issue an update. Other instances touch sessions on their own, the storage checks the interval too.
+type sessionTouches struct {
+	mu       sync.Mutex
+	seen     map[uuid.UUID]time.Time
+	prunedAt time.Time
+}
+
+func newSessionTouches() *sessionTouches {
+	return &sessionTouches{seen: make(map[uuid.UUID]time.Time), prunedAt: time.Now()}
+}
+
+// recent returns whether the session has been touched within sessionTouchInterval
+func (s *sessionTouches) recent(token uuid.UUID, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seenAt, ok := s.seen[token]
+	return ok && now.Sub(seenAt) < sessionTouchInterval
+}
+
+// add records the touch, sessions not seen within the interval are dropped at most once per interval
+func (s *sessionTouches) add(token uuid.UUID, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[token] = now
+	if now.Sub(s.prunedAt) < sessionTouchInterval {
+		return
+	}
+	for t, seenAt := range s.seen {
+		if now.Sub(seenAt) >= sessionTouchInterval {
+			delete(s.seen, t)
+		}
+	}
+	s.prunedAt = now
+}
+
+// purgeExpiredTokens periodically deletes expired sessions until ctx is done
+func (app *App) purgeExpiredTokens(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := app.storage.DeleteExpiredTokens(ctx, time.Now().UTC())
+			if err != nil {
+				app.logger.Err(err).Msg("failed to purge expired tokens")
+				continue
+			}
+			app.logger.Info().Int64("deleted", deleted).Msg("purged expired tokens")
+		}
+	}
+}
+
+// clientIP returns address of the client without port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func GetUser(ctx context.Context) *model.User {
 	value := ctx.Value(UserKey)
 	if usr, ok := value.(*model.User); ok {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	"net/http"
+	"net/url"
+)
+
+const citiesLimit = 100
+
+func (app *App) citiesHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		cities, err := app.storage.Cities(r.Context(), citiesLimit)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to list cities")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := templates.CitiesInfo{
+			Cities: make([]templates.CityItem, 0, len(cities)),
+		}
+		for _, c := range cities {
+			info.Cities = append(info.Cities, templates.CityItem{Name: c.Name, Users: c.Users})
+		}
+		if err := app.Templates.Cities.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render cities page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	router.Get("/{city}", func(w http.ResponseWriter, r *http.Request) {
+		city, err := url.PathUnescape(chi.URLParam(r, "city"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cursor := pageCursor(r)
+		info := templates.CityInfo{
+			Name:   model.NormalizeCity(city),
+			Cursor: string(cursor),
+		}
+		users, next, err := app.storage.UsersByCity(r.Context(), info.Name, cursor, app.config.PageSize)
+		if err == storage.ErrInvalidCursor {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Str("city", info.Name).Msg("failed to list users by city")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info.HasNext = next != ""
+		info.NextCursor = string(next)
+		info.Results = toSearchResults(users)
+		if err := app.Templates.City.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render city page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	return router
+}
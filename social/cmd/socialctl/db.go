@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/pressly/goose"
+	"log"
+)
+
+// migrate makes a command running the migration step, goose reports progress to the command output
+func migrate(name string, step func(cfg *config.MySQL) error) func(e *env, args []string) error {
+	return func(e *env, args []string) error {
+		if err := parseFlags(newFlags(name), args, 0); err != nil {
+			return err
+		}
+		goose.SetLogger(log.New(e.out, "", 0))
+		return step(&e.config.MySQL)
+	}
+}
+
+func migrateCreate(e *env, args []string) error {
+	flags := newFlags("migrate create")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	goose.SetLogger(log.New(e.out, "", 0))
+	return storage.CreateMigration(e.config.MySQL.MigrationDir, flags.Arg(0))
+}
+
+func dbCreate(e *env, args []string) error {
+	if err := parseFlags(newFlags("db create"), args, 0); err != nil {
+		return err
+	}
+	if err := storage.CreateDatabase(&e.config.MySQL); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.out, "database %s is created\n", e.config.MySQL.Database)
+	return nil
+}
+
+func dbDrop(e *env, args []string) error {
+	flags := newFlags("db drop")
+	yes := flags.Bool("yes", false, "confirm dropping the database")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if !*yes {
+		return fmt.Errorf("dropping database %s deletes all the data, confirm with -yes", e.config.MySQL.Database)
+	}
+	if err := storage.DropDatabase(&e.config.MySQL); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.out, "database %s is dropped\n", e.config.MySQL.Database)
+	return nil
+}
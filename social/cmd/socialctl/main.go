@@ -0,0 +1,159 @@
+// Command socialctl manages the mysql storage of social without the web UI:
+// migrations, the database, users and sessions.
+// The config is loaded the same way as by the server, config flags go before the command:
+//
+//	socialctl [config flags] <command> <subcommand> [flags] [args]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/rs/zerolog"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// env is what commands run with
+type env struct {
+	ctx    context.Context
+	config *config.Config
+	out    io.Writer
+}
+
+type command struct {
+	args string
+	help string
+	run  func(e *env, args []string) error
+}
+
+var commands map[string]command
+
+// commands are set in init, as subcommands print their usage from commands
+func init() {
+	commands = map[string]command{
+		"migrate up":     {"", "apply all pending migrations", migrate("migrate up", storage.Migrate)},
+		"migrate down":   {"", "roll back the latest applied migration", migrate("migrate down", storage.MigrateDown)},
+		"migrate status": {"", "print applied and pending migrations", migrate("migrate status", storage.MigrationStatus)},
+		"migrate create": {"<name>", "write a blank sql migration to the migration dir", migrateCreate},
+
+		"db create": {"", "create the database unless it exists", dbCreate},
+		"db drop":   {"-yes", "drop the database with all the data", dbDrop},
+
+		"user create":         {"-username -password ...", "create a user, -h lists profile flags", userCreate},
+		"user show":           {"<username>", "print the user profile", userShow},
+		"user delete":         {"<username>", "delete the user, the username is quarantined as on self deletion", userDelete},
+		"user reset-password": {"[-password] <username>", "set a new password and end all sessions of the user", userResetPassword},
+
+		"tokens purge-expired": {"", "delete expired sessions", tokensPurgeExpired},
+
+		"seed users": {"-count -workers -batch", "insert generated users for load testing", seedUsers},
+	}
+}
+
+// errUsage is returned on a wrong command line, usage is printed
+var errUsage = errors.New("wrong usage")
+
+func main() {
+	err := run(context.Background(), os.Args[1:], os.Getenv, os.Stdout)
+	switch err {
+	case nil, flag.ErrHelp:
+	case errUsage:
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "socialctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, getenv func(string) string, out io.Writer) error {
+	flags := flag.NewFlagSet("socialctl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: socialctl [config flags] <command> <subcommand> [flags] [args]\n\nCommands:\n")
+		printCommands(flags.Output())
+		fmt.Fprintf(flags.Output(), "\nConfig flags:\n")
+		flags.PrintDefaults()
+	}
+	cfg, err := config.Load(flags, args, getenv)
+	if err != nil {
+		return err
+	}
+	if cfg.Storage != config.StorageMysql {
+		return fmt.Errorf("socialctl manages %s storage only, configured storage is %s", config.StorageMysql, cfg.Storage)
+	}
+
+	args = flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		return errUsage
+	}
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		fmt.Fprintf(flags.Output(), "unknown command %s %s\n", args[0], args[1])
+		flags.Usage()
+		return errUsage
+	}
+	return cmd.run(&env{ctx: ctx, config: cfg, out: out}, args[2:])
+}
+
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", name, commands[name].args, commands[name].help)
+	}
+	tw.Flush()
+}
+
+// newFlags makes the flag set of a subcommand
+func newFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("socialctl "+name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: socialctl [config flags] %s %s\n", name, commands[name].args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses flags of a subcommand, expecting the given number of positional args
+func parseFlags(flags *flag.FlagSet, args []string, positional int) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != positional {
+		fmt.Fprintf(flags.Output(), "expected %d arguments, got %d\n", positional, flags.NArg())
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// withStorage opens the storage for fn and closes it afterwards
+func (e *env) withStorage(fn func(s *storage.MysqlStorage) error) error {
+	// commands print their own output, replica health isn't logged
+	s, err := storage.NewMysqlStorage(&e.config.MySQL, zerolog.Nop())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// withMessageStorage opens the message storage for fn and closes it afterwards
+func (e *env) withMessageStorage(fn func(m *storage.MysqlMessageStorage) error) error {
+	m, err := storage.NewMysqlMessageStorage(&e.config.MySQL)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return fn(m)
+}
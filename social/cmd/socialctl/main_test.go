@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// socialctl uses its own database, as storage tests recreate the test one
+var testEnv = map[string]string{
+	"MYSQL_USER":     "root",
+	"MYSQL_PASS":     "pass",
+	"MYSQL_DATABASE": "socialctl_test",
+	"MIGRATION_DIR":  os.Getenv("MIGRATION_DIR"),
+}
+
+func socialctl(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	err := run(context.Background(), args, func(key string) string { return testEnv[key] }, out)
+	return out.String(), err
+}
+
+// requireMysql skips the test if MySQL isn't configured with MIGRATION_DIR
+func requireMysql(t *testing.T) {
+	if testEnv["MIGRATION_DIR"] == "" {
+		t.Skip("MIGRATION_DIR isn't set, skipping MySQL tests")
+	}
+}
+
+func mustRun(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := socialctl(t, args...)
+	if err != nil {
+		t.Fatalf("socialctl %s failed: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+func TestDatabaseAndMigrations(t *testing.T) {
+	requireMysql(t)
+	if _, err := socialctl(t, "db", "drop"); err == nil || !strings.Contains(err.Error(), "-yes") {
+		t.Fatalf("dropping should require confirmation, got %v", err)
+	}
+	mustRun(t, "db", "drop", "-yes")
+	mustRun(t, "db", "create")
+	mustRun(t, "migrate", "up")
+	status := mustRun(t, "migrate", "status")
+	if !strings.Contains(status, "20200104205521_users.sql") || strings.Contains(status, "Pending") {
+		t.Fatalf("all migrations should be applied:\n%s", status)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	requireMysql(t)
+	mustRun(t, "db", "create")
+	mustRun(t, "migrate", "up")
+
+	_, err := socialctl(t, "user", "create", "-username", "ctl", "-first-name", "Carl")
+	if err == nil || !strings.Contains(err.Error(), "last name") {
+		t.Fatalf("profile should be validated, got %v", err)
+	}
+	out := mustRun(t, "user", "create", "-username", "ctl", "-first-name", "Carl", "-last-name", "Tool",
+		"-age", "40", "-city", "Moscow", "-interests", "Ops, go")
+	if !strings.Contains(out, "user ctl is created") || !strings.Contains(out, "password: ") {
+		t.Fatalf("wrong create output:\n%s", out)
+	}
+	if _, err := socialctl(t, "user", "create", "-username", "ctl", "-first-name", "Carl", "-last-name", "Tool",
+		"-age", "40", "-city", "Moscow"); err == nil || !strings.Contains(err.Error(), "taken") {
+		t.Fatalf("username should be taken, got %v", err)
+	}
+
+	out = mustRun(t, "user", "show", "ctl")
+	for _, field := range []string{"Carl Tool", "Moscow", "ops, go", "other"} {
+		if !strings.Contains(out, field) {
+			t.Errorf("profile should contain %q:\n%s", field, out)
+		}
+	}
+	out = mustRun(t, "user", "reset-password", "-password", "new-password", "ctl")
+	if !strings.Contains(out, "password of ctl is reset") || strings.Contains(out, "new-password") {
+		t.Fatalf("wrong reset output:\n%s", out)
+	}
+	mustRun(t, "tokens", "purge-expired")
+
+	mustRun(t, "user", "delete", "ctl")
+	if _, err := socialctl(t, "user", "show", "ctl"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("user should be deleted, got %v", err)
+	}
+}
+
+func TestWrongUsage(t *testing.T) {
+	for _, args := range [][]string{{"user"}, {"user", "rename"}, {"user", "show"}, {"migrate", "up", "extra"}} {
+		if _, err := socialctl(t, args...); err != errUsage {
+			t.Errorf("%v: expected usage error, got %v", args, err)
+		}
+	}
+	if _, err := socialctl(t, "-storage", "memory", "migrate", "up"); err == nil {
+		t.Errorf("memory storage should be rejected")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/seed"
+	"github.com/chocosin/otus-hl/social/storage"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// seeder inserts generated users in batches by parallel workers
+type seeder struct {
+	storage  *storage.MysqlStorage
+	count    int64
+	batch    int
+	workers  int
+	progress time.Duration
+	seed     int64
+	tag      string
+	// passwordHash is shared by all users, hashing a million passwords would take longer than inserting
+	passwordHash string
+
+	inserted  int64
+	nextBatch int64
+}
+
+func seedUsers(e *env, args []string) error {
+	flags := newFlags("seed users")
+	s := &seeder{}
+	flags.Int64Var(&s.count, "count", 10000, "number of users")
+	flags.IntVar(&s.batch, "batch", 1000, fmt.Sprintf("users in a multi-row insert, at most %d", storage.MaxInsertBatch))
+	flags.IntVar(&s.workers, "workers", 4, "number of parallel inserting workers")
+	flags.DurationVar(&s.progress, "progress", time.Second*5, "how often progress is reported")
+	flags.Int64Var(&s.seed, "seed", 0, "random seed, the current time if 0")
+	password := flags.String("password", "password", "password of all users")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if s.count <= 0 || s.batch <= 0 || s.batch > storage.MaxInsertBatch || s.workers <= 0 || s.progress <= 0 {
+		return fmt.Errorf("-count, -workers and -progress should be positive, -batch in 1..%d", storage.MaxInsertBatch)
+	}
+	if s.seed == 0 {
+		s.seed = time.Now().UnixNano()
+	}
+	// usernames get the time of the run, so seeding again doesn't produce duplicates
+	s.tag = strconv.FormatInt(time.Now().Unix(), 36) + "_"
+	var err error
+	if s.passwordHash, err = model.HashPassword(*password); err != nil {
+		return err
+	}
+
+	return e.withStorage(func(st *storage.MysqlStorage) error {
+		s.storage = st
+		fmt.Fprintf(e.out, "seeding %d users by %d workers in batches of %d, random seed %d\n",
+			s.count, s.workers, s.batch, s.seed)
+		start := time.Now()
+		if err := s.run(e.ctx, e.out); err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		fmt.Fprintf(e.out, "seeded %d users in %v, %.0f users/s, the password is %q\n",
+			s.count, elapsed.Round(time.Millisecond), float64(s.count)/elapsed.Seconds(), *password)
+		return nil
+	})
+}
+
+// run starts workers and reports progress until all users are inserted or a worker fails
+func (s *seeder) run(ctx context.Context, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+	var failed sync.Once
+	var workers sync.WaitGroup
+	workers.Add(s.workers)
+	for idx := 0; idx < s.workers; idx++ {
+		go func(idx int) {
+			defer workers.Done()
+			if err := s.work(ctx, seed.NewGenerator(s.seed+int64(idx), s.tag, s.passwordHash)); err != nil {
+				failed.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(idx)
+	}
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(s.progress)
+	defer ticker.Stop()
+	last, lastAt := int64(0), time.Now()
+	for {
+		select {
+		case <-done:
+			return firstErr
+		case now := <-ticker.C:
+			inserted := atomic.LoadInt64(&s.inserted)
+			fmt.Fprintf(out, "%d/%d users (%.1f%%), %.0f users/s\n", inserted, s.count,
+				float64(inserted)*100/float64(s.count), float64(inserted-last)/now.Sub(lastAt).Seconds())
+			last, lastAt = inserted, now
+		}
+	}
+}
+
+// work takes the next batch until there are none left
+func (s *seeder) work(ctx context.Context, gen *seed.Generator) error {
+	users := make([]*model.User, 0, s.batch)
+	for {
+		first := (atomic.AddInt64(&s.nextBatch, 1) - 1) * int64(s.batch)
+		if first >= s.count {
+			return nil
+		}
+		users = users[:0]
+		for seq := first; seq < first+int64(s.batch) && seq < s.count; seq++ {
+			users = append(users, gen.User(seq))
+		}
+		if err := s.storage.InsertUsers(ctx, users); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.inserted, int64(len(users)))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	_ "github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSeedUsers(t *testing.T) {
+	requireMysql(t)
+	mustRun(t, "db", "drop", "-yes")
+	mustRun(t, "db", "create")
+	mustRun(t, "migrate", "up")
+
+	// a single worker, the test database doesn't isolate concurrent transactions
+	out := mustRun(t, "seed", "users", "-count", "120", "-batch", "25", "-workers", "1", "-progress", "1ms")
+	if !strings.Contains(out, "seeded 120 users") {
+		t.Fatalf("wrong seed output:\n%s", out)
+	}
+	if _, err := socialctl(t, "seed", "users", "-batch", strconv.Itoa(storage.MaxInsertBatch+1)); err == nil {
+		t.Fatalf("too large batch should be rejected")
+	}
+
+	db, err := sql.Open("mysql", "root:pass@tcp(localhost:3306)/"+testEnv["MYSQL_DATABASE"])
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	var count int
+	var passwordHash string
+	if err := db.QueryRow("select count(*), max(password) from users").Scan(&count, &passwordHash); err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+	if count != 120 {
+		t.Fatalf("expected 120 seeded users, got %d", count)
+	}
+	if ok, _, err := model.VerifyPassword("password", passwordHash); err != nil || !ok {
+		t.Fatalf("seeded users should have the default password: %v", err)
+	}
+}
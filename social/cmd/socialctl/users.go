@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	uuid "github.com/satori/go.uuid"
+	"text/tabwriter"
+	"time"
+)
+
+// generatePassword is used when the password is not given, it is printed once
+func generatePassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func findUser(e *env, s storage.Storage, username string) (*model.User, error) {
+	user, err := s.FindUserByUsername(e.ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s is not found", username)
+	}
+	return user, nil
+}
+
+// userCreate validates the profile the same way as signup does
+func userCreate(e *env, args []string) error {
+	flags := newFlags("user create")
+	info := &templates.SignupInfo{}
+	flags.StringVar(&info.Username, "username", "", "username")
+	flags.StringVar(&info.Password, "password", "", "password, generated and printed if empty")
+	flags.StringVar(&info.FirstName, "first-name", "", "first name")
+	flags.StringVar(&info.LastName, "last-name", "", "last name")
+	flags.StringVar(&info.Age, "age", "", "age")
+	flags.StringVar(&info.Gender, "gender", model.Other, "gender, male, female or other")
+	flags.StringVar(&info.City, "city", "", "city")
+	flags.StringVar(&info.Interests, "interests", "", "comma separated interests")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	generated := info.Password == ""
+	if generated {
+		var err error
+		if info.Password, err = generatePassword(); err != nil {
+			return err
+		}
+	}
+	user, err := model.NewUserFromSignup(info)
+	if err != nil {
+		return err
+	}
+
+	return e.withStorage(func(s *storage.MysqlStorage) error {
+		taken, err := s.IsUsernameTaken(e.ctx, user.Username)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return fmt.Errorf("username %s is taken", user.Username)
+		}
+		if err := s.InsertUser(e.ctx, user); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.out, "user %s is created with id %s\n", user.Username, user.ID)
+		if generated {
+			fmt.Fprintf(e.out, "password: %s\n", info.Password)
+		}
+		return nil
+	})
+}
+
+func userShow(e *env, args []string) error {
+	flags := newFlags("user show")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	return e.withStorage(func(s *storage.MysqlStorage) error {
+		user, err := findUser(e, s, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "id:\t%s\n", user.ID)
+		fmt.Fprintf(tw, "username:\t%s\n", user.Username)
+		fmt.Fprintf(tw, "name:\t%s %s\n", user.FirstName, user.LastName)
+		fmt.Fprintf(tw, "age:\t%d\n", user.Age)
+		fmt.Fprintf(tw, "gender:\t%s\n", user.Gender)
+		fmt.Fprintf(tw, "city:\t%s\n", user.City)
+		fmt.Fprintf(tw, "interests:\t%s\n", user.JoinInterests())
+		fmt.Fprintf(tw, "created at:\t%s\n", user.CreatedAt.Format(time.RFC3339))
+		return tw.Flush()
+	})
+}
+
+// userDelete deletes the user with their dialogs like deleting own account does. Feeds are cached in memory
+// of running servers, so followers may see posts of the deleted user until servers restart.
+func userDelete(e *env, args []string) error {
+	flags := newFlags("user delete")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	return e.withStorage(func(s *storage.MysqlStorage) error {
+		user, err := findUser(e, s, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if err := e.withMessageStorage(func(m *storage.MysqlMessageStorage) error {
+			return m.DeleteUserDialogs(e.ctx, user.ID)
+		}); err != nil {
+			return err
+		}
+		releaseAt := time.Now().UTC().Add(model.UsernameQuarantine)
+		if err := s.DeleteUser(e.ctx, user.ID, releaseAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.out, "user %s is deleted, the username is released at %s\n",
+			user.Username, releaseAt.Format(time.RFC3339))
+		return nil
+	})
+}
+
+// userResetPassword sets the new password and logs the user out everywhere
+func userResetPassword(e *env, args []string) error {
+	flags := newFlags("user reset-password")
+	password := flags.String("password", "", "new password, generated and printed if empty")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	generated := *password == ""
+	if generated {
+		var err error
+		if *password, err = generatePassword(); err != nil {
+			return err
+		}
+	}
+	return e.withStorage(func(s *storage.MysqlStorage) error {
+		user, err := findUser(e, s, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if err := user.ResetPassword(*password); err != nil {
+			return err
+		}
+		if err := s.UpdatePasswordHash(e.ctx, user.ID, user.PasswordHash); err != nil {
+			return err
+		}
+		if err := s.DeleteAllTokens(e.ctx, user.ID, uuid.Nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.out, "password of %s is reset, all sessions are ended\n", user.Username)
+		if generated {
+			fmt.Fprintf(e.out, "password: %s\n", *password)
+		}
+		return nil
+	})
+}
+
+func tokensPurgeExpired(e *env, args []string) error {
+	if err := parseFlags(newFlags("tokens purge-expired"), args, 0); err != nil {
+		return err
+	}
+	return e.withStorage(func(s *storage.MysqlStorage) error {
+		deleted, err := s.DeleteExpiredTokens(e.ctx, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.out, "%d expired tokens are deleted\n", deleted)
+		return nil
+	})
+}
@@ -0,0 +1,409 @@
+// Command socialload replays a mix of traffic against a running social instance
+// and reports latency percentiles, throughput and error rates:
+//
+//	socialload -target http://localhost:8080 -mode rps -rps 200 -duration 1m -mix user=60,feed=40
+//
+// Closed-loop mode keeps -concurrency requests in flight, each worker sends the next request
+// as soon as the previous one is answered. Fixed-RPS mode sends requests at the given rate
+// regardless of responses, with at most -concurrency of them in flight.
+// Users for login, user pages and feeds are taken from /api/v1/users/last, so the database
+// should be seeded first with `socialctl seed users`, sharing -password with the seeded users.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/chocosin/otus-hl/social/seed"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	modeClosed = "closed"
+	modeRPS    = "rps"
+
+	formatText = "text"
+	formatJSON = "json"
+)
+
+type options struct {
+	target      string
+	mode        string
+	rps         float64
+	concurrency int
+	duration    time.Duration
+	timeout     time.Duration
+	mix         string
+	password    string
+	users       int
+	sessions    int
+	format      string
+}
+
+// loader runs the load, requests of all workers share it
+type loader struct {
+	options
+	client    *http.Client
+	mix       *mix
+	state     state
+	recorders map[string]*recorder
+	dropped   int64
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// the report of the requests made so far is still printed
+		<-signals
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "socialload: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func run(ctx context.Context, args []string, out, progress io.Writer) error {
+	flags := flag.NewFlagSet("socialload", flag.ContinueOnError)
+	var opts options
+	flags.StringVar(&opts.target, "target", "http://localhost:8080", "base url of the social instance")
+	flags.StringVar(&opts.mode, "mode", modeClosed, "closed for closed-loop concurrency or rps for a fixed rate")
+	flags.Float64Var(&opts.rps, "rps", 100, "requests per second in rps mode")
+	flags.IntVar(&opts.concurrency, "concurrency", 10, "concurrent workers, in rps mode the max requests in flight")
+	flags.DurationVar(&opts.duration, "duration", time.Second*30, "how long the load lasts")
+	flags.DurationVar(&opts.timeout, "timeout", time.Second*5, "timeout of a request")
+	flags.StringVar(&opts.mix, "mix", defaultMix, "weights of scenarios: "+scenarioNames())
+	flags.StringVar(&opts.password, "password", "password", "password of existing users and of signups")
+	flags.IntVar(&opts.users, "users", 1000, "number of last registered users to pick from")
+	flags.IntVar(&opts.sessions, "sessions", 20, "number of users logged in for feed requests")
+	flags.StringVar(&opts.format, "format", formatText, "report format, text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	l, err := newLoader(opts)
+	if err != nil {
+		return err
+	}
+	if err := l.prepare(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "%d users, %d sessions, running %s load for %v\n",
+		len(l.state.usernames), len(l.state.sessions), l.mode, l.duration)
+	report := l.run(ctx)
+
+	if l.format == formatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return report.writeText(out)
+}
+
+func newLoader(opts options) (*loader, error) {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	target, err := url.Parse(opts.target)
+	check(err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "",
+		"-target should be http(s) url")
+	check(opts.mode == modeClosed || opts.mode == modeRPS, "-mode should be closed or rps")
+	check(opts.mode != modeRPS || opts.rps > 0, "-rps should be positive")
+	check(opts.concurrency > 0, "-concurrency should be positive")
+	check(opts.duration > 0, "-duration should be positive")
+	check(opts.timeout > 0, "-timeout should be positive")
+	check(opts.users > 0, "-users should be positive")
+	check(opts.sessions > 0, "-sessions should be positive")
+	check(opts.format == formatText || opts.format == formatJSON, "-format should be text or json")
+	m, err := parseMix(opts.mix)
+	if err != nil {
+		problems = append(problems, "-mix: "+err.Error())
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	opts.target = strings.TrimSuffix(opts.target, "/")
+
+	l := &loader{
+		options: opts,
+		client: &http.Client{
+			Timeout: opts.timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: opts.timeout, KeepAlive: time.Minute}).DialContext,
+				MaxIdleConnsPerHost: opts.concurrency,
+				IdleConnTimeout:     time.Minute,
+			},
+			// redirects after login or to the login page are the responses being measured
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		mix:       m,
+		recorders: make(map[string]*recorder),
+	}
+	seedValue := time.Now().UnixNano()
+	l.state.rnd = rand.New(rand.NewSource(seedValue))
+	l.state.generator = seed.NewGenerator(seedValue, runTag(), "")
+	for _, s := range m.scenarios {
+		l.recorders[s.name] = newRecorder()
+	}
+	return l, nil
+}
+
+// prepare discovers users and logs some of them in, as scenarios of the mix need
+func (l *loader) prepare(ctx context.Context) error {
+	needsUsers, needsSessions := l.mix.needs()
+	if !needsUsers && !needsSessions {
+		return nil
+	}
+	if err := l.discoverUsers(ctx); err != nil {
+		return err
+	}
+	if len(l.state.usernames) == 0 {
+		return errors.New("no users found, seed the database or use a mix without login, user and feed")
+	}
+	if !needsSessions {
+		return nil
+	}
+	for _, username := range l.state.usernames {
+		if len(l.state.sessions) == l.sessions {
+			break
+		}
+		token, err := l.login(ctx, username)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			l.state.sessions = append(l.state.sessions, token)
+		}
+	}
+	if len(l.state.sessions) == 0 {
+		return errors.New("no user could log in with -password for feed requests")
+	}
+	return nil
+}
+
+func (l *loader) discoverUsers(ctx context.Context) error {
+	cursor := ""
+	for len(l.state.usernames) < l.users {
+		req, err := l.get("/api/v1/users/last?" + url.Values{"after": {cursor}}.Encode())
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Usernames []string `json:"usernames"`
+			Next      string   `json:"next"`
+		}
+		if err := l.doJSON(ctx, req, http.StatusOK, &page); err != nil {
+			return fmt.Errorf("failed to list users: %v", err)
+		}
+		l.state.usernames = append(l.state.usernames, page.Usernames...)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if len(l.state.usernames) > l.users {
+		l.state.usernames = l.state.usernames[:l.users]
+	}
+	return nil
+}
+
+// login returns empty token if the password is wrong
+func (l *loader) login(ctx context.Context, username string) (string, error) {
+	req, err := l.postJSON("/api/v1/login", &loginRequestBody{Username: username, Password: l.password})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err = l.doJSON(ctx, req, http.StatusOK, &resp)
+	if err == errUnexpectedStatus {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to log in: %v", err)
+	}
+	return resp.Token, nil
+}
+
+var errUnexpectedStatus = errors.New("unexpected status")
+
+func (l *loader) doJSON(ctx context.Context, req *http.Request, status int, v interface{}) error {
+	resp, err := l.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return errUnexpectedStatus
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// run applies the load until the duration passes or ctx is done
+func (l *loader) run(ctx context.Context) *Report {
+	ctx, cancel := context.WithTimeout(ctx, l.duration)
+	defer cancel()
+	start := time.Now()
+	if l.mode == modeRPS {
+		l.runRPS(ctx)
+	} else {
+		l.runClosed(ctx)
+	}
+	elapsed := time.Since(start)
+
+	report := &Report{
+		Target:      l.target,
+		Mode:        l.mode,
+		Concurrency: l.concurrency,
+		Duration:    elapsed.Seconds(),
+		Dropped:     atomic.LoadInt64(&l.dropped),
+	}
+	if l.mode == modeRPS {
+		report.RPS = l.rps
+	}
+	all := make([]*recorder, 0, len(l.mix.scenarios))
+	for _, s := range l.mix.scenarios {
+		report.Scenarios = append(report.Scenarios, scenarioReport(s.name, elapsed, l.recorders[s.name]))
+		all = append(all, l.recorders[s.name])
+	}
+	report.Total = scenarioReport("total", elapsed, all...)
+	return report
+}
+
+// runClosed keeps every worker sending requests one after another
+func (l *loader) runClosed(ctx context.Context) {
+	var workers sync.WaitGroup
+	workers.Add(l.concurrency)
+	for idx := 0; idx < l.concurrency; idx++ {
+		go func() {
+			defer workers.Done()
+			for ctx.Err() == nil {
+				l.do(ctx, l.pick())
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+// runRPS starts requests on schedule, a request is dropped when -concurrency requests are in flight
+func (l *loader) runRPS(ctx context.Context) {
+	interval := time.Duration(float64(time.Second) / l.rps)
+	inFlight := make(chan struct{}, l.concurrency)
+	var requests sync.WaitGroup
+	defer requests.Wait()
+
+	start := time.Now()
+	for sent := int64(0); ; sent++ {
+		// scheduled from the start, so sleeping longer than the interval doesn't lower the rate
+		if wait := time.Until(start.Add(time.Duration(sent) * interval)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			atomic.AddInt64(&l.dropped, 1)
+			continue
+		}
+		requests.Add(1)
+		go func(s *scenario) {
+			defer requests.Done()
+			l.do(ctx, s)
+			<-inFlight
+		}(l.pick())
+	}
+}
+
+func (l *loader) pick() *scenario {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.mix.pick(l.state.rnd)
+}
+
+// do sends a request of the scenario and records the result,
+// requests interrupted by the end of the run are not recorded
+func (l *loader) do(ctx context.Context, s *scenario) {
+	req, err := s.request(l)
+	if err != nil {
+		l.recorders[s.name].record(0, "request: "+err.Error())
+		return
+	}
+	start := time.Now()
+	resp, err := l.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		l.recorders[s.name].record(time.Since(start), failureKind(err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		io.Copy(ioutil.Discard, resp.Body)
+		l.recorders[s.name].record(time.Since(start), fmt.Sprintf("status %d", resp.StatusCode))
+		return
+	}
+	if s.done != nil {
+		s.done(l, resp)
+	}
+	// the body is read, so the latency includes the whole response and the connection is reused
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		l.recorders[s.name].record(time.Since(start), failureKind(err))
+		return
+	}
+	l.recorders[s.name].record(time.Since(start), "")
+}
+
+func failureKind(err error) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		return opErr.Op + " error"
+	}
+	return err.Error()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSocial answers like social does, /search fails and /last breaks off the body to check error reporting
+func fakeSocial(t *testing.T, feedRequests *int64) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/users/last", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("after") == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"usernames": []string{"alice", "bob"}, "next": "2"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"usernames": []string{"carol"}})
+	})
+	mux.HandleFunc("/api/v1/login", func(w http.ResponseWriter, r *http.Request) {
+		var req loginRequestBody
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Username == "bob" || req.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "token-" + req.Username})
+	})
+	mux.HandleFunc("/api/v1/signup", func(w http.ResponseWriter, r *http.Request) {
+		var req signupRequestBody
+		json.NewDecoder(r.Body).Decode(&req)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"username": req.Username})
+	})
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+			t.Errorf("feed should be requested with a session, got %q", r.Header.Get("Authorization"))
+		}
+		atomic.AddInt64(feedRequests, 1)
+	})
+	mux.HandleFunc("/last", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("<html>"))
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestClosedLoopJSONReport(t *testing.T) {
+	var feedRequests int64
+	server := fakeSocial(t, &feedRequests)
+	defer server.Close()
+
+	out := &bytes.Buffer{}
+	err := run(context.Background(), []string{"-target", server.URL, "-duration", "300ms", "-concurrency", "4",
+		"-password", "secret", "-format", "json"}, out, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	var report Report
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("invalid json report: %v\n%s", err, out)
+	}
+	if report.Mode != modeClosed || len(report.Scenarios) != 6 || report.Total.Requests == 0 {
+		t.Fatalf("wrong report: %+v", report)
+	}
+	var requests int64
+	for _, s := range report.Scenarios {
+		requests += s.Requests
+		if s.Requests == 0 {
+			t.Errorf("scenario %s wasn't run", s.Name)
+		}
+		if s.Name == "search" && (s.ErrorRate != 1 || s.ErrorKinds["status 500"] != s.Requests) {
+			t.Errorf("search should fail: %+v", s)
+		}
+		if s.Name == "last" && (s.ErrorRate != 1 || s.ErrorKinds["unexpected EOF"] != s.Requests) {
+			t.Errorf("last should fail reading the body: %+v", s)
+		}
+		if s.Name == "user" && (s.Errors != 0 || s.Latency.P50 < 1 || s.Latency.P99 < s.Latency.P50) {
+			t.Errorf("wrong user latency: %+v", s)
+		}
+	}
+	if requests != report.Total.Requests || atomic.LoadInt64(&feedRequests) == 0 {
+		t.Fatalf("total doesn't match scenarios: %+v", report)
+	}
+}
+
+func TestFixedRPSTextReport(t *testing.T) {
+	var feedRequests int64
+	server := fakeSocial(t, &feedRequests)
+	defer server.Close()
+
+	out := &bytes.Buffer{}
+	err := run(context.Background(), []string{"-target", server.URL, "-mode", "rps", "-rps", "100",
+		"-duration", "500ms", "-mix", "last=1,search=1"}, out, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	total := 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "total" {
+			total, _ = strconv.Atoi(fields[1])
+		}
+	}
+	// the rate is kept: 50 requests are sent in 500ms, the last ones may be cut by the end of the run
+	if total < 45 || total > 51 {
+		t.Fatalf("expected about 50 requests in total:\n%s", out)
+	}
+	if !strings.Contains(out.String(), "search: ") || !strings.Contains(out.String(), "x status 500") {
+		t.Fatalf("errors should be listed:\n%s", out)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for ms := 1; ms <= 200; ms++ {
+		latencies = append(latencies, time.Duration(ms)*time.Millisecond)
+	}
+	for p, expected := range map[float64]time.Duration{50: 100, 95: 190, 99: 198, 100: 200} {
+		if actual := percentile(latencies, p); actual != expected*time.Millisecond {
+			t.Errorf("p%v: expected %v, got %v", p, expected*time.Millisecond, actual)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	err := run(context.Background(), []string{"-target", "localhost", "-mode", "open", "-mix", "user=1,posts=2"},
+		&bytes.Buffer{}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, problem := range []string{"-target", "-mode", "unknown scenario \"posts\""} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error should mention %s: %v", problem, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/chocosin/otus-hl/social/seed"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scenario is a kind of requests in the traffic mix, 2xx and 3xx responses are successes
+type scenario struct {
+	name string
+	// needsUsers scenarios pick a known user, needsSessions ones are made by a logged in user
+	needsUsers    bool
+	needsSessions bool
+	request       func(l *loader) (*http.Request, error)
+	// done is called on success, e.g. to remember the signed up user
+	done func(l *loader, resp *http.Response)
+}
+
+var scenarios = map[string]*scenario{
+	"signup": {name: "signup", request: signupRequest, done: signupDone},
+	"login":  {name: "login", needsUsers: true, request: loginRequest},
+	"user": {name: "user", needsUsers: true, request: func(l *loader) (*http.Request, error) {
+		return l.get("/user/" + url.PathEscape(l.randomUsername()))
+	}},
+	"last": {name: "last", request: func(l *loader) (*http.Request, error) {
+		return l.get("/last")
+	}},
+	"search": {name: "search", request: func(l *loader) (*http.Request, error) {
+		first, last := l.searchPrefixes()
+		return l.get("/search?" + url.Values{"first": {first}, "last": {last}}.Encode())
+	}},
+	"feed": {name: "feed", needsSessions: true, request: func(l *loader) (*http.Request, error) {
+		req, err := l.get("/feed")
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+l.randomSession())
+		return req, nil
+	}},
+}
+
+// defaultMix is mostly reads, as in a social network
+const defaultMix = "user=40,last=15,search=20,feed=15,login=5,signup=5"
+
+// mix picks scenarios by their weights
+type mix struct {
+	scenarios []*scenario
+	// cumulative weights
+	weights []int
+}
+
+// parseMix parses comma separated name=weight pairs
+func parseMix(value string) (*mix, error) {
+	m := &mix{}
+	seen := make(map[string]bool)
+	total := 0
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected name=weight, got %q", part)
+		}
+		s, ok := scenarios[kv[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown scenario %q, known are %s", kv[0], scenarioNames())
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight of %s: %q", kv[0], kv[1])
+		}
+		if seen[kv[0]] {
+			return nil, fmt.Errorf("scenario %s is listed twice", kv[0])
+		}
+		seen[kv[0]] = true
+		if weight == 0 {
+			continue
+		}
+		total += weight
+		m.scenarios = append(m.scenarios, s)
+		m.weights = append(m.weights, total)
+	}
+	if total == 0 {
+		return nil, errors.New("mix has no scenarios")
+	}
+	return m, nil
+}
+
+func scenarioNames() string {
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (m *mix) pick(rnd *rand.Rand) *scenario {
+	n := rnd.Intn(m.weights[len(m.weights)-1])
+	return m.scenarios[sort.SearchInts(m.weights, n+1)]
+}
+
+func (m *mix) needs() (users, sessions bool) {
+	for _, s := range m.scenarios {
+		users = users || s.needsUsers
+		sessions = sessions || s.needsSessions
+	}
+	return users, sessions
+}
+
+// state is shared by requests, it is safe for concurrent use
+type state struct {
+	mu        sync.Mutex
+	rnd       *rand.Rand
+	generator *seed.Generator
+	signups   int64
+	usernames []string
+	sessions  []string
+}
+
+func (l *loader) get(path string) (*http.Request, error) {
+	return http.NewRequest(http.MethodGet, l.target+path, nil)
+}
+
+func (l *loader) postJSON(path string, body interface{}) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, l.target+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (l *loader) randomUsername() string {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.state.usernames[l.state.rnd.Intn(len(l.state.usernames))]
+}
+
+func (l *loader) randomSession() string {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.state.sessions[l.state.rnd.Intn(len(l.state.sessions))]
+}
+
+// searchPrefixes are two first letters of names of a generated user, so popular names are searched more often
+func (l *loader) searchPrefixes() (first, last string) {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	user := l.state.generator.User(0)
+	return user.FirstName[:2], user.LastName[:2]
+}
+
+type signupRequestBody struct {
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	FirstName string   `json:"firstName"`
+	LastName  string   `json:"lastName"`
+	Age       int      `json:"age"`
+	Gender    string   `json:"gender"`
+	City      string   `json:"city"`
+	Interests []string `json:"interests"`
+}
+
+func signupRequest(l *loader) (*http.Request, error) {
+	l.state.mu.Lock()
+	l.state.signups++
+	user := l.state.generator.User(l.state.signups)
+	l.state.mu.Unlock()
+	return l.postJSON("/api/v1/signup", &signupRequestBody{
+		Username:  user.Username,
+		Password:  l.password,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Age:       user.Age,
+		Gender:    user.Gender,
+		City:      user.City,
+		Interests: user.Interests,
+	})
+}
+
+// signupDone makes signed up users available to other scenarios
+func signupDone(l *loader, resp *http.Response) {
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil || user.Username == "" {
+		return
+	}
+	l.state.mu.Lock()
+	l.state.usernames = append(l.state.usernames, user.Username)
+	l.state.mu.Unlock()
+}
+
+type loginRequestBody struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loginRequest(l *loader) (*http.Request, error) {
+	return l.postJSON("/api/v1/login", &loginRequestBody{Username: l.randomUsername(), Password: l.password})
+}
+
+// runTag makes usernames of signups differ between runs
+func runTag() string {
+	return "load" + strconv.FormatInt(time.Now().Unix(), 36) + "_"
+}
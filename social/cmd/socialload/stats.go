@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// recorder collects results of a scenario, it is safe for concurrent use
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    map[string]int64
+}
+
+func newRecorder() *recorder {
+	return &recorder{errors: make(map[string]int64)}
+}
+
+// record adds a request result, failure is empty for successful requests
+func (r *recorder) record(latency time.Duration, failure string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies = append(r.latencies, latency)
+	if failure != "" {
+		r.errors[failure]++
+	}
+}
+
+// Latency is in milliseconds
+type Latency struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+type ScenarioReport struct {
+	Name       string  `json:"name"`
+	Requests   int64   `json:"requests"`
+	Errors     int64   `json:"errors"`
+	ErrorRate  float64 `json:"errorRate"`
+	Throughput float64 `json:"throughput"`
+	Latency    Latency `json:"latencyMs"`
+	// ErrorKinds counts errors by status or transport failure, e.g. "status 500" or "timeout"
+	ErrorKinds map[string]int64 `json:"errorKinds,omitempty"`
+}
+
+type Report struct {
+	Target      string  `json:"target"`
+	Mode        string  `json:"mode"`
+	Concurrency int     `json:"concurrency"`
+	RPS         float64 `json:"rps,omitempty"`
+	Duration    float64 `json:"durationSeconds"`
+	// Dropped are requests which were not sent in rps mode, as all workers were busy
+	Dropped   int64            `json:"dropped,omitempty"`
+	Total     ScenarioReport   `json:"total"`
+	Scenarios []ScenarioReport `json:"scenarios"`
+}
+
+// scenarioReport summarizes recorded results, elapsed is the duration of the run
+func scenarioReport(name string, elapsed time.Duration, recorders ...*recorder) ScenarioReport {
+	report := ScenarioReport{Name: name, ErrorKinds: make(map[string]int64)}
+	var latencies []time.Duration
+	for _, r := range recorders {
+		r.mu.Lock()
+		latencies = append(latencies, r.latencies...)
+		for kind, count := range r.errors {
+			report.ErrorKinds[kind] += count
+			report.Errors += count
+		}
+		r.mu.Unlock()
+	}
+	report.Requests = int64(len(latencies))
+	if report.Requests == 0 {
+		return report
+	}
+	report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+	report.Throughput = float64(report.Requests) / elapsed.Seconds()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, latency := range latencies {
+		sum += latency
+	}
+	report.Latency = Latency{
+		Mean: millis(sum / time.Duration(len(latencies))),
+		P50:  millis(percentile(latencies, 50)),
+		P95:  millis(percentile(latencies, 95)),
+		P99:  millis(percentile(latencies, 99)),
+		Max:  millis(latencies[len(latencies)-1]),
+	}
+	return report
+}
+
+// percentile is the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *Report) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "target %s, mode %s, concurrency %d", r.Target, r.Mode, r.Concurrency)
+	if r.Mode == modeRPS {
+		fmt.Fprintf(w, ", %.0f rps", r.RPS)
+	}
+	fmt.Fprintf(w, ", %.1fs\n", r.Duration)
+	if r.Dropped > 0 {
+		fmt.Fprintf(w, "%d requests were dropped, all workers were busy\n", r.Dropped)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "scenario\trequests\treq/s\terrors\tmean ms\tp50 ms\tp95 ms\tp99 ms\tmax ms\t\n")
+	for _, s := range append(r.Scenarios, r.Total) {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.2f%%\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n", s.Name, s.Requests, s.Throughput,
+			s.ErrorRate*100, s.Latency.Mean, s.Latency.P50, s.Latency.P95, s.Latency.P99, s.Latency.Max)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if r.Total.Errors > 0 {
+		fmt.Fprintf(w, "\nerrors:\n")
+	}
+	for _, s := range r.Scenarios {
+		kinds := make([]string, 0, len(s.ErrorKinds))
+		for kind := range s.ErrorKinds {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "  %s: %d x %s\n", s.Name, s.ErrorKinds[kind], kind)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Package config is the configuration of the app. It is read from defaults,
+// a YAML or TOML file, environment variables and flags, each overriding the previous ones.
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StorageMysql  = "mysql"
+	StorageMemory = "memory"
+
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+
+	TracingNone   = "none"
+	TracingStdout = "stdout"
+	TracingOTLP   = "otlp"
+)
+
+const redacted = "******"
+
+type Config struct {
+	// Storage is either mysql or memory, the latter loses all data on restart
+	Storage string `yaml:"storage" toml:"storage"`
+	// Templates is the directory with html templates
+	Templates string `yaml:"templates" toml:"templates"`
+	// PageSize is the number of items on pages of paginated lists
+	PageSize int `yaml:"pageSize" toml:"pageSize"`
+
+	Server Server `yaml:"server" toml:"server"`
+	MySQL  MySQL  `yaml:"mysql" toml:"mysql"`
+	Cookie Cookie `yaml:"cookie" toml:"cookie"`
+	Log    Log    `yaml:"log" toml:"log"`
+
+	Tracing Tracing `yaml:"tracing" toml:"tracing"`
+	Cache   Cache   `yaml:"cache" toml:"cache"`
+}
+
+type Server struct {
+	Addr         string   `yaml:"addr" toml:"addr"`
+	ReadTimeout  Duration `yaml:"readTimeout" toml:"readTimeout"`
+	WriteTimeout Duration `yaml:"writeTimeout" toml:"writeTimeout"`
+	IdleTimeout  Duration `yaml:"idleTimeout" toml:"idleTimeout"`
+	// HandlerTimeout cancels the request, it is shorter than WriteTimeout so that handlers are able to respond
+	HandlerTimeout Duration `yaml:"handlerTimeout" toml:"handlerTimeout"`
+	// ShutdownTimeout is how long in-flight requests are waited for on shutdown
+	ShutdownTimeout Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+}
+
+type MySQL struct {
+	Host string `yaml:"host" toml:"host"`
+	Port int    `yaml:"port" toml:"port"`
+	// ReplicaHosts serve read-only queries, they are listened on the same port
+	ReplicaHosts []string `yaml:"replicaHosts" toml:"replicaHosts"`
+	User         string   `yaml:"user" toml:"user"`
+	Password     string   `yaml:"password" toml:"password"`
+	Database     string   `yaml:"database" toml:"database"`
+	// Params are additional DSN parameters, e.g. charset
+	Params         map[string]string `yaml:"params" toml:"params"`
+	ConnectTimeout Duration          `yaml:"connectTimeout" toml:"connectTimeout"`
+	// ReadTimeout and WriteTimeout are I/O timeouts, zero means no timeout
+	ReadTimeout  Duration `yaml:"readTimeout" toml:"readTimeout"`
+	WriteTimeout Duration `yaml:"writeTimeout" toml:"writeTimeout"`
+	// MaxOpenConns is per database, zero means unlimited
+	MaxOpenConns    int      `yaml:"maxOpenConns" toml:"maxOpenConns"`
+	MaxIdleConns    int      `yaml:"maxIdleConns" toml:"maxIdleConns"`
+	ConnMaxLifetime Duration `yaml:"connMaxLifetime" toml:"connMaxLifetime"`
+	MigrationDir    string   `yaml:"migrationDir" toml:"migrationDir"`
+}
+
+type Cookie struct {
+	Name     string `yaml:"name" toml:"name"`
+	Domain   string `yaml:"domain" toml:"domain"`
+	Path     string `yaml:"path" toml:"path"`
+	Secure   bool   `yaml:"secure" toml:"secure"`
+	HTTPOnly bool   `yaml:"httpOnly" toml:"httpOnly"`
+	// SameSite is lax, strict, none or empty to omit the attribute
+	SameSite string `yaml:"sameSite" toml:"sameSite"`
+}
+
+type Log struct {
+	// Format is console for humans or json
+	Format string `yaml:"format" toml:"format"`
+	Level  string `yaml:"level" toml:"level"`
+}
+
+type Tracing struct {
+	// Exporter is none to disable tracing, stdout to print spans as json lines, or otlp
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// OTLPEndpoint is the address of OpenTelemetry collector receiving OTLP over gRPC
+	OTLPEndpoint string `yaml:"otlpEndpoint" toml:"otlpEndpoint"`
+	// SampleRatio is the share of traces started by the app which are recorded,
+	// traces sampled by the caller are always recorded
+	SampleRatio float64 `yaml:"sampleRatio" toml:"sampleRatio"`
+}
+
+// Cache keeps users found by tokens and usernames in memory of the instance
+type Cache struct {
+	// Size is the max number of cached entries, zero disables the cache
+	Size int `yaml:"size" toml:"size"`
+	// TTL bounds how long changes not made through the instance, e.g. by other instances, may be unseen
+	TTL Duration `yaml:"ttl" toml:"ttl"`
+}
+
+// Default returns config used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		Storage:   StorageMysql,
+		Templates: "./social/templates",
+		PageSize:  20,
+		Server: Server{
+			Addr:            ":8080",
+			ReadTimeout:     Duration{time.Second * 5},
+			WriteTimeout:    Duration{time.Second * 10},
+			IdleTimeout:     Duration{time.Second * 60},
+			HandlerTimeout:  Duration{time.Second * 3},
+			ShutdownTimeout: Duration{time.Second * 15},
+		},
+		MySQL: MySQL{
+			Host:           "localhost",
+			Port:           3306,
+			Database:       "social",
+			Params:         map[string]string{},
+			ConnectTimeout: Duration{time.Second * 6},
+			// the same as database/sql default
+			MaxIdleConns: 2,
+			MigrationDir: "./social/migrations",
+		},
+		Cookie: Cookie{
+			Name:     "auth_token",
+			Path:     "/",
+			HTTPOnly: true,
+			SameSite: "lax",
+		},
+		Log: Log{
+			Format: LogFormatConsole,
+			Level:  "info",
+		},
+		Tracing: Tracing{
+			Exporter:     TracingNone,
+			OTLPEndpoint: "localhost:55680",
+			SampleRatio:  1,
+		},
+		Cache: Cache{
+			Size: 10000,
+			TTL:  Duration{time.Second * 30},
+		},
+	}
+}
+
+var (
+	databaseNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	logLevels      = []string{"debug", "info", "warn", "error"}
+	sameSiteModes  = []string{"", "lax", "strict", "none"}
+	exporters      = []string{TracingNone, TracingStdout, TracingOTLP}
+)
+
+// Validate returns all problems of the config at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Storage == StorageMysql || c.Storage == StorageMemory,
+		"storage should be %s or %s, got %q", StorageMysql, StorageMemory, c.Storage)
+	check(c.Templates != "", "templates dir is required")
+	check(c.PageSize > 0, "pageSize should be positive, got %d", c.PageSize)
+
+	_, port, err := net.SplitHostPort(c.Server.Addr)
+	check(err == nil && validPort(port), "server.addr should be host:port, got %q", c.Server.Addr)
+	for _, d := range []namedDuration{
+		{"server.readTimeout", c.Server.ReadTimeout},
+		{"server.writeTimeout", c.Server.WriteTimeout},
+		{"server.idleTimeout", c.Server.IdleTimeout},
+		{"server.handlerTimeout", c.Server.HandlerTimeout},
+		{"server.shutdownTimeout", c.Server.ShutdownTimeout},
+	} {
+		check(d.value.Duration > 0, "%s should be positive, got %v", d.name, d.value)
+	}
+	check(c.Server.HandlerTimeout.Duration < c.Server.WriteTimeout.Duration,
+		"server.handlerTimeout should be less than server.writeTimeout")
+
+	if c.Storage == StorageMysql {
+		check(c.MySQL.Host != "", "mysql.host is required")
+		check(c.MySQL.Port > 0 && c.MySQL.Port < 65536, "mysql.port should be in 1-65535, got %d", c.MySQL.Port)
+		check(databaseNameRe.MatchString(c.MySQL.Database),
+			"mysql.database should consist of letters, digits and underscores, got %q", c.MySQL.Database)
+		check(c.MySQL.ConnectTimeout.Duration > 0, "mysql.connectTimeout should be positive, got %v",
+			c.MySQL.ConnectTimeout)
+		for _, d := range []namedDuration{
+			{"mysql.readTimeout", c.MySQL.ReadTimeout},
+			{"mysql.writeTimeout", c.MySQL.WriteTimeout},
+			{"mysql.connMaxLifetime", c.MySQL.ConnMaxLifetime},
+		} {
+			check(d.value.Duration >= 0, "%s shouldn't be negative, got %v", d.name, d.value)
+		}
+		check(c.MySQL.MaxOpenConns >= 0, "mysql.maxOpenConns shouldn't be negative")
+		check(c.MySQL.MaxIdleConns >= 0, "mysql.maxIdleConns shouldn't be negative")
+		check(c.MySQL.MaxOpenConns == 0 || c.MySQL.MaxIdleConns <= c.MySQL.MaxOpenConns,
+			"mysql.maxIdleConns shouldn't exceed mysql.maxOpenConns")
+		check(c.MySQL.MigrationDir != "", "mysql.migrationDir is required")
+	}
+
+	check(c.Cookie.Name != "", "cookie.name is required")
+	check(oneOf(c.Cookie.SameSite, sameSiteModes), "cookie.sameSite should be one of %q, got %q",
+		sameSiteModes, c.Cookie.SameSite)
+	check(c.Cookie.SameSite != "none" || c.Cookie.Secure, "cookie.sameSite none requires cookie.secure")
+
+	check(c.Log.Format == LogFormatConsole || c.Log.Format == LogFormatJSON,
+		"log.format should be %s or %s, got %q", LogFormatConsole, LogFormatJSON, c.Log.Format)
+	check(oneOf(c.Log.Level, logLevels), "log.level should be one of %q, got %q", logLevels, c.Log.Level)
+
+	check(oneOf(c.Tracing.Exporter, exporters), "tracing.exporter should be one of %q, got %q",
+		exporters, c.Tracing.Exporter)
+	check(c.Tracing.Exporter != TracingOTLP || c.Tracing.OTLPEndpoint != "",
+		"tracing.otlpEndpoint is required for otlp exporter")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1,
+		"tracing.sampleRatio should be in 0-1, got %v", c.Tracing.SampleRatio)
+
+	check(c.Cache.Size >= 0, "cache.size shouldn't be negative, got %d", c.Cache.Size)
+	check(c.Cache.Size == 0 || c.Cache.TTL.Duration > 0, "cache.ttl should be positive, got %v", c.Cache.TTL)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+type namedDuration struct {
+	name  string
+	value Duration
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 0 && p < 65536
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a copy of the config with secrets hidden
+func (c Config) Redacted() Config {
+	if c.MySQL.Password != "" {
+		c.MySQL.Password = redacted
+	}
+	return c
+}
+
+// String returns the config as YAML with secrets redacted, so it is safe to log
+func (c Config) String() string {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("failed to print config: %v", err)
+	}
+	return string(out)
+}
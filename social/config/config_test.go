@@ -0,0 +1,169 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func load(t *testing.T, args []string, getenv func(string) string) (*Config, error) {
+	t.Helper()
+	return Load(flag.NewFlagSet("test", flag.ContinueOnError), args, getenv)
+}
+
+// writeFile writes config file to a temporary dir, remove deletes the dir
+func writeFile(t *testing.T, name, content string) (path string, remove func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestDefaultsAreValid(t *testing.T) {
+	config, err := load(t, nil, env(nil))
+	if err != nil {
+		t.Fatalf("defaults should be valid: %v", err)
+	}
+	if !reflect.DeepEqual(config, Default()) {
+		t.Fatalf("expected defaults, got %+v", config)
+	}
+}
+
+func TestFileEnvAndFlagsPrecedence(t *testing.T) {
+	path, remove := writeFile(t, "social.yaml", `
+pageSize: 50
+server:
+  addr: ":9000"
+  handlerTimeout: 2s
+mysql:
+  host: file-host
+  port: 3307
+  user: file-user
+  params:
+    charset: utf8mb4
+`)
+	defer remove()
+	config, err := load(t, []string{"-mysql.host", "flag-host", "-cookie.secure", "-config", path},
+		env(map[string]string{
+			"MYSQL_HOST":          "env-host",
+			"MYSQL_USER":          "env-user",
+			"MYSQL_REPLICA_HOSTS": "r1, r2,",
+			"SERVER_READ_TIMEOUT": "1m",
+		}))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	expected := Default()
+	expected.PageSize = 50
+	expected.Server.Addr = ":9000"
+	expected.Server.HandlerTimeout = Duration{time.Second * 2}
+	expected.Server.ReadTimeout = Duration{time.Minute}
+	expected.MySQL.Host = "flag-host"
+	expected.MySQL.Port = 3307
+	expected.MySQL.User = "env-user"
+	expected.MySQL.ReplicaHosts = []string{"r1", "r2"}
+	expected.MySQL.Params = map[string]string{"charset": "utf8mb4"}
+	expected.Cookie.Secure = true
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("wrong config, \nexpected:\t%+v\nactual:\t\t%+v", expected, config)
+	}
+}
+
+func TestTOMLFileFromEnv(t *testing.T) {
+	path, remove := writeFile(t, "social.toml", `
+storage = "memory"
+
+[server]
+shutdownTimeout = "30s"
+
+[log]
+format = "json"
+`)
+	defer remove()
+	config, err := load(t, nil, env(map[string]string{"CONFIG": path}))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if config.Storage != StorageMemory || config.Server.ShutdownTimeout.Duration != time.Second*30 ||
+		config.Log.Format != LogFormatJSON {
+		t.Fatalf("wrong config: %+v", config)
+	}
+}
+
+func TestUnknownFileKeysAreRejected(t *testing.T) {
+	for name, content := range map[string]string{
+		"social.yaml": "mysql:\n  hots: typo\n",
+		"social.toml": "[mysql]\nhots = \"typo\"\n",
+	} {
+		path, remove := writeFile(t, name, content)
+		if _, err := load(t, []string{"-config", path}, env(nil)); err == nil {
+			t.Errorf("%s: expected error for unknown key", name)
+		}
+		remove()
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	_, err := load(t, []string{"-pageSize", "ten"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "-pageSize") {
+		t.Errorf("expected invalid flag error, got %v", err)
+	}
+	_, err = load(t, nil, env(map[string]string{"MYSQL_READ_TIMEOUT": "soon"}))
+	if err == nil || !strings.Contains(err.Error(), "MYSQL_READ_TIMEOUT") {
+		t.Errorf("expected invalid env error, got %v", err)
+	}
+
+	_, err = load(t, []string{"-mysql.port", "0", "-log.format", "xml", "-cookie.sameSite", "none",
+		"-tracing.sampleRatio", "2", "-cache.ttl", "0s"}, env(nil))
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, problem := range []string{"mysql.port", "log.format", "cookie.sameSite none requires cookie.secure",
+		"tracing.sampleRatio", "cache.ttl"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("validation error should mention %s: %v", problem, err)
+		}
+	}
+}
+
+func TestMysqlIsNotValidatedForMemoryStorage(t *testing.T) {
+	if _, err := load(t, []string{"-storage", "memory", "-mysql.port", "0"}, env(nil)); err != nil {
+		t.Fatalf("mysql config shouldn't matter for memory storage: %v", err)
+	}
+}
+
+func TestStringRedactsSecrets(t *testing.T) {
+	config, err := load(t, nil, env(map[string]string{"MYSQL_PASS": "secret"}))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	printed := config.String()
+	if strings.Contains(printed, "secret") || !strings.Contains(printed, "password: '******'") {
+		t.Fatalf("password should be redacted: %s", printed)
+	}
+	if !strings.Contains(printed, "handlerTimeout: 3s") {
+		t.Fatalf("durations should be printed as strings: %s", printed)
+	}
+	if config.MySQL.Password != "secret" {
+		t.Fatalf("redaction shouldn't change the config")
+	}
+}
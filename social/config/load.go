@@ -0,0 +1,196 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// option is a config field which can be set by env and flag
+type option struct {
+	// name is the flag, it is the same as the path of the field in files
+	name  string
+	env   string
+	usage string
+	value func(c *Config) flag.Value
+}
+
+var options = []option{
+	{"storage", "STORAGE", "storage backend, mysql or memory",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Storage) }},
+	{"templates", "TEMPLATES", "directory with html templates",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Templates) }},
+	{"pageSize", "PAGE_SIZE", "number of items on pages of paginated lists",
+		func(c *Config) flag.Value { return (*intValue)(&c.PageSize) }},
+
+	{"server.addr", "LISTEN_ADDR", "address to listen on",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Server.Addr) }},
+	{"server.readTimeout", "SERVER_READ_TIMEOUT", "timeout of reading a request",
+		func(c *Config) flag.Value { return &c.Server.ReadTimeout }},
+	{"server.writeTimeout", "SERVER_WRITE_TIMEOUT", "timeout of writing a response",
+		func(c *Config) flag.Value { return &c.Server.WriteTimeout }},
+	{"server.idleTimeout", "SERVER_IDLE_TIMEOUT", "how long keep-alive connections are kept idle",
+		func(c *Config) flag.Value { return &c.Server.IdleTimeout }},
+	{"server.handlerTimeout", "HANDLER_TIMEOUT", "timeout of handling a request",
+		func(c *Config) flag.Value { return &c.Server.HandlerTimeout }},
+	{"server.shutdownTimeout", "SHUTDOWN_TIMEOUT", "how long in-flight requests are waited for on shutdown",
+		func(c *Config) flag.Value { return &c.Server.ShutdownTimeout }},
+
+	{"mysql.host", "MYSQL_HOST", "mysql primary host",
+		func(c *Config) flag.Value { return (*stringValue)(&c.MySQL.Host) }},
+	{"mysql.port", "MYSQL_PORT", "mysql port of the primary and replicas",
+		func(c *Config) flag.Value { return (*intValue)(&c.MySQL.Port) }},
+	{"mysql.replicaHosts", "MYSQL_REPLICA_HOSTS", "comma separated mysql replica hosts",
+		func(c *Config) flag.Value { return (*listValue)(&c.MySQL.ReplicaHosts) }},
+	{"mysql.user", "MYSQL_USER", "mysql user",
+		func(c *Config) flag.Value { return (*stringValue)(&c.MySQL.User) }},
+	{"mysql.password", "MYSQL_PASS", "mysql password, prefer env over the flag",
+		func(c *Config) flag.Value { return (*stringValue)(&c.MySQL.Password) }},
+	{"mysql.database", "MYSQL_DATABASE", "mysql database name",
+		func(c *Config) flag.Value { return (*stringValue)(&c.MySQL.Database) }},
+	{"mysql.params", "MYSQL_PARAMS", "additional dsn parameters as comma separated key=value",
+		func(c *Config) flag.Value { return (*mapValue)(&c.MySQL.Params) }},
+	{"mysql.connectTimeout", "MYSQL_CONNECT_TIMEOUT", "timeout of connecting to mysql",
+		func(c *Config) flag.Value { return &c.MySQL.ConnectTimeout }},
+	{"mysql.readTimeout", "MYSQL_READ_TIMEOUT", "mysql I/O read timeout, 0 for none",
+		func(c *Config) flag.Value { return &c.MySQL.ReadTimeout }},
+	{"mysql.writeTimeout", "MYSQL_WRITE_TIMEOUT", "mysql I/O write timeout, 0 for none",
+		func(c *Config) flag.Value { return &c.MySQL.WriteTimeout }},
+	{"mysql.maxOpenConns", "MYSQL_MAX_OPEN_CONNS", "max open connections per database, 0 for unlimited",
+		func(c *Config) flag.Value { return (*intValue)(&c.MySQL.MaxOpenConns) }},
+	{"mysql.maxIdleConns", "MYSQL_MAX_IDLE_CONNS", "max idle connections per database",
+		func(c *Config) flag.Value { return (*intValue)(&c.MySQL.MaxIdleConns) }},
+	{"mysql.connMaxLifetime", "MYSQL_CONN_MAX_LIFETIME", "max lifetime of a connection, 0 for unlimited",
+		func(c *Config) flag.Value { return &c.MySQL.ConnMaxLifetime }},
+	{"mysql.migrationDir", "MIGRATION_DIR", "directory with migrations",
+		func(c *Config) flag.Value { return (*stringValue)(&c.MySQL.MigrationDir) }},
+
+	{"cookie.name", "COOKIE_NAME", "name of the auth cookie",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Cookie.Name) }},
+	{"cookie.domain", "COOKIE_DOMAIN", "domain of the auth cookie",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Cookie.Domain) }},
+	{"cookie.path", "COOKIE_PATH", "path of the auth cookie",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Cookie.Path) }},
+	{"cookie.secure", "COOKIE_SECURE", "send the auth cookie over https only",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Cookie.Secure) }},
+	{"cookie.httpOnly", "COOKIE_HTTP_ONLY", "hide the auth cookie from scripts",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Cookie.HTTPOnly) }},
+	{"cookie.sameSite", "COOKIE_SAME_SITE", "same site mode of the auth cookie: lax, strict, none or empty",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Cookie.SameSite) }},
+
+	{"log.format", "LOG_FORMAT", "log format, console or json",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Format) }},
+	{"log.level", "LOG_LEVEL", "log level: debug, info, warn or error",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Level) }},
+
+	{"tracing.exporter", "TRACING_EXPORTER", "trace exporter: none, stdout or otlp",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tracing.Exporter) }},
+	{"tracing.otlpEndpoint", "TRACING_OTLP_ENDPOINT", "address of OpenTelemetry collector for otlp exporter",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tracing.OTLPEndpoint) }},
+	{"tracing.sampleRatio", "TRACING_SAMPLE_RATIO", "share of traces to record, from 0 to 1",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Tracing.SampleRatio) }},
+
+	{"cache.size", "CACHE_SIZE", "max number of cached users, tokens and usernames, 0 disables the cache",
+		func(c *Config) flag.Value { return (*intValue)(&c.Cache.Size) }},
+	{"cache.ttl", "CACHE_TTL", "how long cached users are served",
+		func(c *Config) flag.Value { return &c.Cache.TTL }},
+}
+
+// pendingFlag remembers flag values, they are applied after the file and env to take precedence
+type pendingFlag struct {
+	defValue string
+	isBool   bool
+	values   []string
+}
+
+func (f *pendingFlag) Set(value string) error {
+	f.values = append(f.values, value)
+	return nil
+}
+
+// String is the default value shown in usage
+func (f *pendingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.defValue
+}
+
+func (f *pendingFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Load registers config flags in the flag set and parses args.
+// Config file is taken from -config flag or CONFIG env, .yaml, .yml and .toml files are supported.
+// Values are taken from defaults, the file, env and flags, each overriding the previous ones.
+// The result is validated.
+func Load(flags *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	defaults := Default()
+	path := flags.String("config", "", "path to YAML or TOML config file, env CONFIG")
+	pending := make([]*pendingFlag, len(options))
+	for idx, opt := range options {
+		value := opt.value(defaults)
+		_, isBool := value.(*boolValue)
+		pending[idx] = &pendingFlag{defValue: value.String(), isBool: isBool}
+		flags.Var(pending[idx], opt.name, fmt.Sprintf("%s, env %s", opt.usage, opt.env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := Default()
+	if *path == "" {
+		*path = getenv("CONFIG")
+	}
+	if *path != "" {
+		if err := loadFile(config, *path); err != nil {
+			return nil, err
+		}
+	}
+	for _, opt := range options {
+		if value := getenv(opt.env); value != "" {
+			if err := opt.value(config).Set(value); err != nil {
+				return nil, fmt.Errorf("invalid env %s: %v", opt.env, err)
+			}
+		}
+	}
+	for idx, opt := range options {
+		for _, value := range pending[idx].values {
+			if err := opt.value(config).Set(value); err != nil {
+				return nil, fmt.Errorf("invalid flag -%s: %v", opt.name, err)
+			}
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadFile overrides the config with values present in the file, unknown keys are errors
+func loadFile(config *Config, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, config)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(content), config)
+		if undecoded := meta.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown keys %v", undecoded)
+		}
+	default:
+		return fmt.Errorf("unsupported config file %s, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
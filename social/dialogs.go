@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	uuid "github.com/satori/go.uuid"
+	"net/http"
+)
+
+const (
+	dialogMessagesLimit = 100
+	messageTimeFormat   = "2006-01-02 15:04"
+)
+
+func (app *App) dialogsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(app.checkAuthedAndRedirect(false, "/login"))
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r.Context())
+		dialogs, err := app.messages.ListDialogs(r.Context(), user.ID)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to list dialogs")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := templates.DialogsInfo{
+			Dialogs: make([]templates.DialogItem, 0, len(dialogs)),
+		}
+		for _, d := range dialogs {
+			info.Dialogs = append(info.Dialogs, templates.DialogItem{
+				Username:      d.Other,
+				LastMessageAt: d.LastMessageAt.Format(messageTimeFormat),
+			})
+		}
+		if err := app.Templates.Dialogs.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render dialogs page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	router.Get("/{username}", func(w http.ResponseWriter, r *http.Request) {
+		other := app.findDialogUser(w, r)
+		if other == nil {
+			return
+		}
+		app.renderDialog(r.Context(), w, GetUser(r.Context()), other, &templates.DialogInfo{})
+	})
+	router.Post("/{username}", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		other := app.findDialogUser(w, r)
+		if other == nil {
+			return
+		}
+		user := GetUser(r.Context())
+		text := r.Form.Get("Text")
+		msg, err := model.NewMessage(user, other, text)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			app.renderDialog(r.Context(), w, user, other, &templates.DialogInfo{Err: err.Error(), Text: text})
+			return
+		}
+		if err := app.messages.SendMessage(r.Context(), msg, user.Username, other.Username); err != nil {
+			app.log(r.Context()).Error().Err(err).Str("dialogID", msg.DialogID.String()).Msg("failed to send message")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		redirect(w, r, "/dialogs/"+other.Username)
+	})
+	return router
+}
+
+// findDialogUser returns the other participant of the dialog from url, responds with error if not found
+func (app *App) findDialogUser(w http.ResponseWriter, r *http.Request) *model.User {
+	other, err := app.storage.FindUserByUsername(r.Context(), chi.URLParam(r, "username"))
+	if err != nil {
+		app.log(r.Context()).Error().Err(err).Msg("failed to get user by username")
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if other == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("username not found"))
+		return nil
+	}
+	return other
+}
+
+func (app *App) renderDialog(ctx context.Context, w http.ResponseWriter, user, other *model.User, info *templates.DialogInfo) {
+	messages, err := app.messages.ListMessages(ctx, model.DialogID(user.ID, other.ID), dialogMessagesLimit)
+	if err != nil {
+		app.log(ctx).Error().Err(err).Msg("failed to list messages")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info.With = other.Username
+	info.Messages = make([]templates.MessageInfo, 0, len(messages))
+	for _, msg := range messages {
+		mine := uuid.Equal(msg.AuthorID, user.ID)
+		author := other.Username
+		if mine {
+			author = user.Username
+		}
+		info.Messages = append(info.Messages, templates.MessageInfo{
+			Author:    author,
+			Text:      msg.Text,
+			CreatedAt: msg.CreatedAt.Format(messageTimeFormat),
+			Mine:      mine,
+		})
+	}
+	if err := app.Templates.Dialog.Execute(w, info); err != nil {
+		app.log(ctx).Error().Err(err).Msg("failed to render dialog page")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
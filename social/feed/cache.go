@@ -0,0 +1,139 @@
+package feed
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	uuid "github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+// Cache keeps materialized feeds of users, newest posts first.
+// It is implemented in memory for now, but may be moved to redis.
+type Cache interface {
+	// Get returns cached feed and false if the feed is not cached or has expired
+	Get(userID uuid.UUID) ([]*model.Post, bool, error)
+	// Version changes with every Push and Invalidate of the feed, whether it's cached or not
+	Version(userID uuid.UUID) (uint64, error)
+	// Set caches the feed built at version, it's skipped if the feed has changed since then,
+	// so that a post pushed while the feed was being built isn't lost
+	Set(userID uuid.UUID, version uint64, posts []*model.Post) error
+	// Push adds post to the head of the feed, if the feed is cached
+	Push(userID uuid.UUID, post *model.Post) error
+	Invalidate(userID uuid.UUID) error
+}
+
+type MemoryCache struct {
+	mu    sync.RWMutex
+	size  int
+	ttl   time.Duration
+	now   func() time.Time
+	feeds map[uuid.UUID]*cachedFeed
+	// versions of feeds changed within ttl, building a feed is expected to take much less
+	versions map[uuid.UUID]feedVersion
+	current  uint64
+	prunedAt time.Time
+}
+
+type cachedFeed struct {
+	posts     []*model.Post
+	expiresAt time.Time
+}
+
+type feedVersion struct {
+	version uint64
+	at      time.Time
+}
+
+// NewMemoryCache keeps size latest posts of every feed, feeds expire after ttl
+// and are rebuilt from the storage, so changes missed by the cache are seen eventually
+func NewMemoryCache(size int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		size:     size,
+		ttl:      ttl,
+		now:      time.Now,
+		feeds:    make(map[uuid.UUID]*cachedFeed),
+		versions: make(map[uuid.UUID]feedVersion),
+		prunedAt: time.Now(),
+	}
+}
+
+func (c *MemoryCache) Get(userID uuid.UUID) ([]*model.Post, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	feed, ok := c.feeds[userID]
+	if !ok || !c.now().Before(feed.expiresAt) {
+		return nil, false, nil
+	}
+	result := make([]*model.Post, len(feed.posts))
+	copy(result, feed.posts)
+	return result, true, nil
+}
+
+func (c *MemoryCache) Version(userID uuid.UUID) (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.versions[userID].version, nil
+}
+
+func (c *MemoryCache) Set(userID uuid.UUID, version uint64, posts []*model.Post) error {
+	if len(posts) > c.size {
+		posts = posts[:c.size]
+	}
+	feed := make([]*model.Post, len(posts), c.size)
+	copy(feed, posts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versions[userID].version != version {
+		return nil
+	}
+	c.feeds[userID] = &cachedFeed{posts: feed, expiresAt: c.now().Add(c.ttl)}
+	return nil
+}
+
+func (c *MemoryCache) Push(userID uuid.UUID, post *model.Post) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.change(userID)
+	feed, ok := c.feeds[userID]
+	if !ok {
+		return nil
+	}
+	posts := feed.posts
+	if len(posts) < c.size {
+		posts = append(posts, nil)
+	}
+	copy(posts[1:], posts)
+	posts[0] = post
+	feed.posts = posts
+	return nil
+}
+
+func (c *MemoryCache) Invalidate(userID uuid.UUID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.change(userID)
+	delete(c.feeds, userID)
+	return nil
+}
+
+// change bumps the version of the feed, expired feeds and versions older than ttl
+// are dropped at most once per ttl, so changing is amortized O(1)
+func (c *MemoryCache) change(userID uuid.UUID) {
+	now := c.now()
+	c.current++
+	c.versions[userID] = feedVersion{version: c.current, at: now}
+	if now.Sub(c.prunedAt) < c.ttl {
+		return
+	}
+	for id, v := range c.versions {
+		if now.Sub(v.at) >= c.ttl {
+			delete(c.versions, id)
+		}
+	}
+	for id, feed := range c.feeds {
+		if !now.Before(feed.expiresAt) {
+			delete(c.feeds, id)
+		}
+	}
+	c.prunedAt = now
+}
@@ -0,0 +1,120 @@
+package feed
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	uuid "github.com/satori/go.uuid"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newPost(text string) *model.Post {
+	return &model.Post{ID: uuid.NewV1(), Text: text}
+}
+
+func checkCachedFeed(t *testing.T, cache Cache, userID uuid.UUID, expected ...*model.Post) {
+	posts, ok, err := cache.Get(userID)
+	if err != nil {
+		t.Fatalf("error getting feed: %v", err)
+	}
+	if !ok {
+		t.Fatalf("feed should have been cached")
+	}
+	if !reflect.DeepEqual(posts, expected) {
+		t.Fatalf("wrong feed, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, posts)
+	}
+}
+
+func TestMemoryCachePushKeepsNewestPosts(t *testing.T) {
+	cache := NewMemoryCache(3, time.Minute)
+	userID := uuid.NewV1()
+	p1, p2, p3, p4 := newPost("1"), newPost("2"), newPost("3"), newPost("4")
+
+	if err := cache.Push(userID, p1); err != nil {
+		t.Fatalf("error pushing post: %v", err)
+	}
+	if _, ok, _ := cache.Get(userID); ok {
+		t.Fatalf("push shouldn't create a feed which is not cached")
+	}
+
+	if err := cache.Set(userID, 1, []*model.Post{p2, p1}); err != nil {
+		t.Fatalf("error setting feed: %v", err)
+	}
+	checkCachedFeed(t, cache, userID, p2, p1)
+
+	for _, p := range []*model.Post{p3, p4} {
+		if err := cache.Push(userID, p); err != nil {
+			t.Fatalf("error pushing post: %v", err)
+		}
+	}
+	checkCachedFeed(t, cache, userID, p4, p3, p2)
+
+	if err := cache.Invalidate(userID); err != nil {
+		t.Fatalf("error invalidating feed: %v", err)
+	}
+	if _, ok, _ := cache.Get(userID); ok {
+		t.Fatalf("feed should have been invalidated")
+	}
+}
+
+func TestMemoryCacheSetTruncatesFeed(t *testing.T) {
+	cache := NewMemoryCache(2, time.Minute)
+	userID := uuid.NewV1()
+	p1, p2, p3 := newPost("1"), newPost("2"), newPost("3")
+	if err := cache.Set(userID, 0, []*model.Post{p3, p2, p1}); err != nil {
+		t.Fatalf("error setting feed: %v", err)
+	}
+	checkCachedFeed(t, cache, userID, p3, p2)
+}
+
+func TestMemoryCacheSkipsFeedChangedWhileBuilding(t *testing.T) {
+	cache := NewMemoryCache(10, time.Minute)
+	userID := uuid.NewV1()
+	p1, p2 := newPost("1"), newPost("2")
+	version, err := cache.Version(userID)
+	if err != nil {
+		t.Fatalf("error getting version: %v", err)
+	}
+	// the post is published after the feed has been read from the storage
+	if err := cache.Push(userID, p2); err != nil {
+		t.Fatalf("error pushing post: %v", err)
+	}
+	if err := cache.Set(userID, version, []*model.Post{p1}); err != nil {
+		t.Fatalf("error setting feed: %v", err)
+	}
+	if _, ok, _ := cache.Get(userID); ok {
+		t.Fatal("feed missing the pushed post shouldn't have been cached")
+	}
+
+	if version, err = cache.Version(userID); err != nil {
+		t.Fatalf("error getting version: %v", err)
+	}
+	if err := cache.Set(userID, version, []*model.Post{p2, p1}); err != nil {
+		t.Fatalf("error setting feed: %v", err)
+	}
+	checkCachedFeed(t, cache, userID, p2, p1)
+}
+
+func TestMemoryCacheExpiresFeeds(t *testing.T) {
+	now := time.Now()
+	cache := NewMemoryCache(10, time.Minute)
+	cache.now, cache.prunedAt = func() time.Time { return now }, now
+	userID, otherID := uuid.NewV1(), uuid.NewV1()
+	p1 := newPost("1")
+	if err := cache.Set(userID, 0, []*model.Post{p1}); err != nil {
+		t.Fatalf("error setting feed: %v", err)
+	}
+	checkCachedFeed(t, cache, userID, p1)
+
+	now = now.Add(time.Minute)
+	if _, ok, _ := cache.Get(userID); ok {
+		t.Fatal("feed should have expired")
+	}
+	// changes prune expired feeds
+	if err := cache.Push(otherID, p1); err != nil {
+		t.Fatalf("error pushing post: %v", err)
+	}
+	if len(cache.feeds) != 0 {
+		t.Fatalf("expired feeds should have been pruned, got %d", len(cache.feeds))
+	}
+}
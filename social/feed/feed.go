@@ -0,0 +1,83 @@
+package feed
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+// Feed materializes feeds in the cache on post creation (fan-out on write).
+// Feeds which are not cached yet are rebuilt from the storage on read.
+type Feed struct {
+	storage storage.Storage
+	cache   Cache
+	size    int
+}
+
+func NewFeed(storage storage.Storage, cache Cache, size int) *Feed {
+	return &Feed{
+		storage: storage,
+		cache:   cache,
+		size:    size,
+	}
+}
+
+// fanOutTimeout limits pushing a stored post to the feeds, it isn't limited by the request
+const fanOutTimeout = time.Second * 10
+
+// Publish stores the post and pushes it to the cached feeds of author's followers.
+// Once the post is stored, it's pushed even if ctx is canceled, e.g. the client has disconnected,
+// as cached feeds would miss it otherwise.
+func (f *Feed) Publish(ctx context.Context, post *model.Post) error {
+	if err := f.storage.CreatePost(ctx, post); err != nil {
+		return errors.Wrap(err, "Publish")
+	}
+	ctx, cancel := context.WithTimeout(storage.Detach(ctx), fanOutTimeout)
+	defer cancel()
+	followers, err := f.storage.ListFollowerIDs(ctx, post.AuthorID)
+	if err != nil {
+		return errors.Wrap(err, "Publish: failed to list followers")
+	}
+	for _, follower := range followers {
+		if err := f.cache.Push(follower, post); err != nil {
+			// feed can't be trusted anymore, so it will be rebuilt on the next read
+			if err := f.cache.Invalidate(follower); err != nil {
+				return errors.Wrap(err, "Publish: failed to invalidate feed")
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns latest posts for the user, newest first.
+// The version is taken before the feed is read from the storage, so the feed isn't cached
+// if a post has been published meanwhile, as the post might be missing from it.
+func (f *Feed) Get(ctx context.Context, userID uuid.UUID) ([]*model.Post, error) {
+	posts, ok, err := f.cache.Get(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get feed from cache")
+	}
+	if ok {
+		return posts, nil
+	}
+	version, err := f.cache.Version(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get feed version from cache")
+	}
+	posts, err = f.storage.ListFeed(ctx, userID, f.size)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get feed from storage")
+	}
+	if err := f.cache.Set(userID, version, posts); err != nil {
+		return nil, errors.Wrap(err, "Set feed to cache")
+	}
+	return posts, nil
+}
+
+// Invalidate drops cached feed, it should be called when users the feed is built from have changed
+func (f *Feed) Invalidate(userID uuid.UUID) error {
+	return f.cache.Invalidate(userID)
+}
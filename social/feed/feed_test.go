@@ -0,0 +1,114 @@
+package feed
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+// publishingStorage publishes a post right after the feed has been read, as if it came from another request
+type publishingStorage struct {
+	storage.Storage
+	publish func()
+}
+
+func (s *publishingStorage) ListFeed(ctx context.Context, userID uuid.UUID, limit int) ([]*model.Post, error) {
+	posts, err := s.Storage.ListFeed(ctx, userID, limit)
+	if s.publish != nil {
+		publish := s.publish
+		s.publish = nil
+		publish()
+	}
+	return posts, err
+}
+
+func TestPostPublishedWhileBuildingFeedIsNotLost(t *testing.T) {
+	ctx := context.Background()
+	s := &publishingStorage{Storage: storage.NewMemoryStorage()}
+	f := NewFeed(s, NewMemoryCache(10, time.Minute), 10)
+	reader, author := newUser("reader"), newUser("author")
+	for _, u := range []*model.User{reader, author} {
+		if err := s.InsertUser(ctx, u); err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+	}
+	if err := s.SendFriendRequest(ctx, reader.ID, author.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+
+	post, err := model.NewPost(author, "published while building")
+	if err != nil {
+		t.Fatalf("error creating post: %v", err)
+	}
+	s.publish = func() {
+		if err := f.Publish(ctx, post); err != nil {
+			t.Fatalf("error publishing post: %v", err)
+		}
+	}
+	if _, err := f.Get(ctx, reader.ID); err != nil {
+		t.Fatalf("error getting feed: %v", err)
+	}
+	posts, err := f.Get(ctx, reader.ID)
+	if err != nil {
+		t.Fatalf("error getting feed: %v", err)
+	}
+	if len(posts) != 1 || posts[0].ID != post.ID {
+		t.Fatalf("expected the published post in the feed, got %+v", posts)
+	}
+}
+
+func newUser(name string) *model.User {
+	id := uuid.NewV1()
+	return &model.User{ID: id, Username: name + "-" + id.String(), FirstName: name, Interests: []string{}}
+}
+
+// cancelingStorage cancels the request after the post has been stored, as if the client has disconnected
+type cancelingStorage struct {
+	storage.Storage
+	cancel context.CancelFunc
+}
+
+func (s *cancelingStorage) CreatePost(ctx context.Context, post *model.Post) error {
+	err := s.Storage.CreatePost(ctx, post)
+	s.cancel()
+	return err
+}
+
+func (s *cancelingStorage) ListFollowerIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Storage.ListFollowerIDs(ctx, userID)
+}
+
+func TestStoredPostIsPushedAfterRequestIsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &cancelingStorage{Storage: storage.NewMemoryStorage(), cancel: cancel}
+	cache := NewMemoryCache(10, time.Minute)
+	f := NewFeed(s, cache, 10)
+	reader, author := newUser("reader"), newUser("author")
+	for _, u := range []*model.User{reader, author} {
+		if err := s.InsertUser(ctx, u); err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+	}
+	if err := s.SendFriendRequest(ctx, reader.ID, author.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	if _, err := f.Get(ctx, reader.ID); err != nil {
+		t.Fatalf("error getting feed: %v", err)
+	}
+
+	post, err := model.NewPost(author, "published by a client which has gone")
+	if err != nil {
+		t.Fatalf("error creating post: %v", err)
+	}
+	if err := f.Publish(ctx, post); err != nil {
+		t.Fatalf("error publishing post: %v", err)
+	}
+	checkCachedFeed(t, cache, reader.ID, post)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	uuid "github.com/satori/go.uuid"
+	"net/http"
+)
+
+func (app *App) friendsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(app.checkAuthedAndRedirect(false, "/login"))
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r.Context())
+		friends, err := app.storage.ListFriends(r.Context(), user.ID)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to list friends")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pending, err := app.storage.ListPendingRequests(r.Context(), user.ID)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to list pending friend requests")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := templates.FriendsInfo{
+			Friends: usernames(friends),
+			Pending: usernames(pending),
+		}
+		if err := app.Templates.Friends.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render friends page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	router.Post("/request", app.friendAction(func(ctx context.Context, me, other *model.User) error {
+		return app.storage.SendFriendRequest(ctx, me.ID, other.ID)
+	}, false))
+	router.Post("/remove", app.friendAction(func(ctx context.Context, me, other *model.User) error {
+		return app.storage.RemoveFriend(ctx, me.ID, other.ID)
+	}, false))
+	router.Post("/accept", app.friendAction(func(ctx context.Context, me, other *model.User) error {
+		return app.storage.AcceptFriendRequest(ctx, me.ID, other.ID)
+	}, true))
+	router.Post("/decline", app.friendAction(func(ctx context.Context, me, other *model.User) error {
+		return app.storage.DeclineFriendRequest(ctx, me.ID, other.ID)
+	}, true))
+	return router
+}
+
+// friendAction applies action to the current user and the user from the form,
+// then redirects either to the friends page or to the page of the other user
+func (app *App) friendAction(action func(ctx context.Context, me, other *model.User) error, toFriends bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		me := GetUser(r.Context())
+		other, err := app.storage.FindUserByUsername(r.Context(), r.Form.Get("Username"))
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to get user by username")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if other == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("username not found"))
+			return
+		}
+		err = action(r.Context(), me, other)
+		if err == storage.ErrSelfFriendship || err == storage.ErrFriendRequestNotFound {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).
+				Str("userID", me.ID.String()).
+				Str("otherID", other.ID.String()).
+				Msg("failed friendship action")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// feeds of both users depend on their friendship
+		for _, id := range []uuid.UUID{me.ID, other.ID} {
+			if err := app.feed.Invalidate(id); err != nil {
+				app.log(r.Context()).Error().Err(err).Str("userID", id.String()).Msg("failed to invalidate feed")
+			}
+		}
+		if toFriends {
+			redirect(w, r, "/friends")
+			return
+		}
+		redirect(w, r, "/user/"+other.Username)
+	}
+}
+
+func usernames(users []*model.User) []string {
+	result := make([]string, 0, len(users))
+	for _, u := range users {
+		result = append(result, u.Username)
+	}
+	return result
+}
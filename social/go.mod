@@ -3,14 +3,22 @@ module github.com/chocosin/otus-hl/social
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/lib/pq v1.3.0 // indirect
 	github.com/mattn/go-sqlite3 v2.0.2+incompatible // indirect
 	github.com/pkg/errors v0.8.1
 	github.com/pressly/goose v2.6.0+incompatible
+	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/rs/zerolog v1.17.2
 	github.com/satori/go.uuid v1.2.0
 	github.com/ziutek/mymysql v1.5.4 // indirect
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	google.golang.org/appengine v1.6.5 // indirect
+	google.golang.org/grpc v1.27.1
+	gopkg.in/yaml.v2 v2.2.8
 )
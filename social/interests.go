@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	"net/http"
+	"net/url"
+)
+
+const similarUsersLimit = 5
+
+func (app *App) interestsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		tag, err := url.PathUnescape(chi.URLParam(r, "tag"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cursor := pageCursor(r)
+		info := templates.InterestInfo{
+			Tag:    model.NormalizeInterest(tag),
+			Cursor: string(cursor),
+		}
+		users, next, err := app.storage.UsersByInterest(r.Context(), info.Tag, cursor, app.config.PageSize)
+		if err == storage.ErrInvalidCursor {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Str("tag", info.Tag).Msg("failed to list users by interest")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info.HasNext = next != ""
+		info.NextCursor = string(next)
+		info.Results = toSearchResults(users)
+		if err := app.Templates.Interest.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render interest page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	return router
+}
+
+// fillSimilarUsers adds users sharing most interests to the page, responds with error if failed
+func (app *App) fillSimilarUsers(ctx context.Context, w http.ResponseWriter, user *model.User, userInfo *templates.UserInfo) bool {
+	similar, err := app.storage.SimilarUsers(ctx, user.ID, similarUsersLimit)
+	if err != nil {
+		app.log(ctx).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to list similar users")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	userInfo.Similar = toSearchResults(similar)
+	return true
+}
@@ -1,58 +1,106 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/chocosin/otus-hl/social/feed"
 	"github.com/chocosin/otus-hl/social/model"
 	"github.com/chocosin/otus-hl/social/storage"
 	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/chocosin/otus-hl/social/tracing"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	uuid "github.com/satori/go.uuid"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"time"
 )
 
+const tokensPurgeInterval = time.Hour
+
 type App struct {
 	logger    zerolog.Logger
 	storage   storage.Storage
+	messages  storage.MessageStorage
+	feed      *feed.Feed
+	touches   *sessionTouches
 	Templates *templates.Templates
+	config    *config.Config
 }
 
 func main() {
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
-	logger := zerolog.New(output).With().
-		Timestamp().
-		Logger()
-
-	var err error
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	printConfig := flags.Bool("print-config", false, "print effective config with secrets redacted and exit")
+	cfg, err := config.Load(flags, os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		fmt.Print(cfg)
+		return
+	}
+	logger := newLogger(&cfg.Log)
+	logger.Info().Msg("effective config:\n" + cfg.String())
 
-	templatesDir := os.Getenv("TEMPLATES")
-	if templatesDir == "" {
-		templatesDir = "./social/templates"
+	shutdownTracing, err := tracing.Setup(&cfg.Tracing)
+	if err != nil {
+		panic(err)
 	}
-	mysqlConfig := storage.NewMysqlConfig()
-	storage.CreateDatabase(mysqlConfig, false)
-	storage.Migrate(mysqlConfig)
+	defer shutdownTracing()
 
-	mysqlStorage, err := storage.NewMysqlStorage(mysqlConfig)
+	appStorage, messageStorage, err := openStorage(logger, cfg)
 	if err != nil {
 		panic(err)
 	}
+	if cfg.Cache.Size > 0 {
+		appStorage = storage.NewCachedStorage(appStorage, storage.NewLRUCache(cfg.Cache.Size), cfg.Cache.TTL.Duration)
+	}
+	appStorage = storage.NewTracedStorage(appStorage)
+	messageStorage = storage.NewTracedMessageStorage(messageStorage)
 	app := App{
-		logger:  logger,
-		storage: mysqlStorage,
+		logger:   logger,
+		storage:  appStorage,
+		messages: messageStorage,
+		feed:     feed.NewFeed(appStorage, feed.NewMemoryCache(feedSize, feedTTL), feedSize),
+		touches:  newSessionTouches(),
+		config:   cfg,
 	}
-	app.Templates, err = templates.NewTemplates(templatesDir)
+	app.Templates, err = templates.NewTemplates(cfg.Templates)
 	if err != nil {
 		panic(err)
 	}
 
+	defer app.closeStorage()
+	app.registerStorageMetrics()
+
+	server := app.newServer()
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logger.Err(err).Msg("couldn't start server")
+		return
+	}
+	logger.Info().Str("addr", server.Addr).Msg("listening")
+	if err := app.serve(signalContext(), server, listener); err != nil {
+		logger.Err(err).Msg("server stopped with error")
+		return
+	}
+	logger.Info().Msg("server stopped")
+}
+
+func (app *App) router() http.Handler {
 	root := chi.NewRouter()
-	root.Use(middleware.RequestLogger(RequestFormatter{&logger}))
-	root.Use(middleware.Timeout(time.Second * 3))
+	root.Use(app.trace)
+	root.Use(middleware.RequestLogger(RequestFormatter{&app.logger}))
+	root.Use(app.measure)
+	root.Use(middleware.Timeout(app.config.Server.HandlerTimeout.Duration))
 	root.Use(middleware.Recoverer)
 	root.Use(app.auth)
 
@@ -63,26 +111,86 @@ func main() {
 	root.Mount("/login", app.loginHandler())
 	root.Mount("/user/", app.usersHandler())
 	root.Mount("/last", app.lastUsernamesHandler())
+	root.Mount("/search", app.searchHandler())
+	root.Mount("/interests", app.interestsHandler())
+	root.Mount("/cities", app.citiesHandler())
+	root.Mount("/api/v1", app.apiHandler())
 	root.Mount("/me", app.meHandler())
 	root.Mount("/logout", app.logoutHandler())
+	root.Mount("/friends", app.friendsHandler())
+	root.Mount("/feed", app.feedHandler())
+	root.Mount("/posts", app.postsHandler())
+	root.Mount("/dialogs", app.dialogsHandler())
+	root.Handle("/metrics", promhttp.Handler())
+	return root
+}
 
-	err = http.ListenAndServe(":8080", root)
+// newLogger writes human readable logs to console or json lines
+func newLogger(cfg *config.Log) zerolog.Logger {
+	var output io.Writer = os.Stdout
+	if cfg.Format == config.LogFormatConsole {
+		output = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	}
+	// level is already validated by config
+	level, _ := zerolog.ParseLevel(cfg.Level)
+	return zerolog.New(output).Level(level).With().
+		Timestamp().
+		Logger()
+}
+
+// openStorage opens mysql storage, or in-memory one if configured
+func openStorage(logger zerolog.Logger, cfg *config.Config) (storage.Storage, storage.MessageStorage, error) {
+	if cfg.Storage == config.StorageMemory {
+		logger.Info().Msg("using in-memory storage, all data will be lost on restart")
+		memoryStorage := storage.NewMemoryStorage()
+		return memoryStorage, storage.NewMemoryMessageStorage(), nil
+	}
+	if err := storage.CreateDatabase(&cfg.MySQL); err != nil {
+		return nil, nil, err
+	}
+	if err := storage.Migrate(&cfg.MySQL); err != nil {
+		return nil, nil, err
+	}
+
+	mysqlStorage, err := storage.NewMysqlStorage(&cfg.MySQL, logger)
 	if err != nil {
-		logger.Err(err).Msg("couldn't start server")
+		return nil, nil, err
 	}
+	messageStorage, err := storage.NewMysqlMessageStorage(&cfg.MySQL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mysqlStorage, messageStorage, nil
+}
+
+// pageCursor returns position of the requested page, empty for the first one,
+// html pages and the api take it as ?after=
+func pageCursor(r *http.Request) storage.Cursor {
+	return storage.Cursor(r.URL.Query().Get("after"))
 }
 
 func (app *App) lastUsernamesHandler() http.Handler {
 	router := chi.NewRouter()
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		usernames, err := app.storage.LastUsernames()
+		cursor := pageCursor(r)
+		usernames, next, err := app.storage.LastUsernames(r.Context(), cursor, app.config.PageSize)
+		if err == storage.ErrInvalidCursor {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			app.logger.Error().Err(err).Msg("failed lastUsernamesHandler")
+			app.log(r.Context()).Error().Err(err).Msg("failed lastUsernamesHandler")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if err := app.Templates.LastUsernames.Execute(w, usernames); err != nil {
-			app.logger.Error().Err(err).Msg("failed to render last usernames")
+		info := templates.LastUsernamesInfo{
+			Usernames:  usernames,
+			Cursor:     string(cursor),
+			HasNext:    next != "",
+			NextCursor: string(next),
+		}
+		if err := app.Templates.LastUsernames.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render last usernames")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -95,11 +203,11 @@ func (app *App) logoutHandler() http.Handler {
 	router.Use(app.checkAuthedAndRedirect(false, "/"))
 	router.Post("/", func(rw http.ResponseWriter, r *http.Request) {
 		token := GetToken(r.Context())
-		if err := app.storage.DeleteToken(token); err != nil {
+		if err := app.storage.DeleteToken(r.Context(), token); err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		RemoveAuthCookie(rw)
+		app.removeAuthCookie(rw)
 		redirect(rw, r, "/")
 	})
 	return router
@@ -108,10 +216,18 @@ func (app *App) logoutHandler() http.Handler {
 func (app *App) meHandler() http.Handler {
 	router := chi.NewRouter()
 	router.Use(app.checkAuthedAndRedirect(false, "/login"))
+	router.Mount("/sessions", app.sessionsHandler())
+	router.Mount("/edit", app.profileHandler())
+	router.Mount("/delete", app.deleteHandler())
+	router.Mount("/export", app.exportHandler())
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		user := GetUser(r.Context())
-		if err := app.Templates.User.Execute(w, user.ToUserInfo(true)); err != nil {
-			app.logger.Error().Err(err).Msg("failed to render user page")
+		userInfo := user.ToUserInfo(true)
+		if !app.fillUserPosts(r.Context(), w, user, userInfo) || !app.fillSimilarUsers(r.Context(), w, user, userInfo) {
+			return
+		}
+		if err := app.Templates.User.Execute(w, userInfo); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render user page")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -127,9 +243,9 @@ func (app *App) usersHandler() http.Handler {
 			w.Write([]byte("username not found"))
 			return
 		}
-		user, err := app.storage.FindUserByUsername(username)
+		user, err := app.storage.FindUserByUsername(r.Context(), username)
 		if err != nil {
-			app.logger.Error().Err(err).Msg("failed to get user by username")
+			app.log(r.Context()).Error().Err(err).Msg("failed to get user by username")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -137,8 +253,21 @@ func (app *App) usersHandler() http.Handler {
 			w.Write([]byte("username not found"))
 			return
 		}
-		if err := app.Templates.User.Execute(w, user.ToUserInfo(false)); err != nil {
-			app.logger.Error().Err(err).Msg("failed to render user page")
+		userInfo := user.ToUserInfo(false)
+		if me := GetUser(r.Context()); me != nil && !uuid.Equal(me.ID, user.ID) {
+			userInfo.ShowFriendship = true
+			userInfo.Friendship, err = app.storage.GetFriendshipStatus(r.Context(), me.ID, user.ID)
+			if err != nil {
+				app.log(r.Context()).Error().Err(err).Msg("failed to get friendship status")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if !app.fillUserPosts(r.Context(), w, user, userInfo) || !app.fillSimilarUsers(r.Context(), w, user, userInfo) {
+			return
+		}
+		if err := app.Templates.User.Execute(w, userInfo); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render user page")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -146,16 +275,28 @@ func (app *App) usersHandler() http.Handler {
 	return router
 }
 
+// fillUserPosts adds latest posts of the user to the page, responds with error if failed
+func (app *App) fillUserPosts(ctx context.Context, w http.ResponseWriter, user *model.User, userInfo *templates.UserInfo) bool {
+	posts, err := app.storage.ListPostsByAuthor(ctx, user.ID, userPagePostLimit)
+	if err != nil {
+		app.log(ctx).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to list user posts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	userInfo.Posts = toPostInfos(posts)
+	return true
+}
+
 func (app *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 	user := GetUser(r.Context())
 	if user != nil {
-		app.logger.Info().Str("username", user.Username).
+		app.log(r.Context()).Info().Str("username", user.Username).
 			Msg("request for user index page, redirecting")
 		redirect(w, r, "/user/"+user.Username)
 		return
 	}
 	if err := app.Templates.Index.Execute(w, nil); err != nil {
-		app.logger.Error().Err(err).Msg("failed to render index page")
+		app.log(r.Context()).Error().Err(err).Msg("failed to render index page")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -166,7 +307,7 @@ func (app *App) loginHandler() http.Handler {
 	loginRouter.Use(app.checkAuthedAndRedirect(true, "/me"))
 	loginRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
-			app.logger.Error().Err(err).Msg("failed to parse url")
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse url")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -181,14 +322,14 @@ func (app *App) loginHandler() http.Handler {
 			},
 		}
 		if err := app.Templates.Login.Execute(w, &loginInfo); err != nil {
-			app.logger.Error().Err(err).Msg("failed to render template")
+			app.log(r.Context()).Error().Err(err).Msg("failed to render template")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 	})
 	loginRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
-			app.logger.Error().Err(err).Msg("failed to parse form")
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -201,13 +342,12 @@ func (app *App) loginHandler() http.Handler {
 			app.respondLoginHint(w, loginInfo, http.StatusBadRequest, hint)
 			return
 		}
-		usr, err := app.storage.FindUserByUsername(loginInfo.Username)
+		usr, newToken, err := app.login(r, loginInfo.Username, loginInfo.Password)
 		if err != nil {
-			app.logger.Error().Err(err).Msg("failed storage username search")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if usr == nil || usr.PasswordHash != model.HashPassword(loginInfo.Password) {
+		if usr == nil {
 			hint := templates.Hint{
 				HintText: "user not found or password is wrong",
 				IsError:  true,
@@ -216,15 +356,7 @@ func (app *App) loginHandler() http.Handler {
 			return
 		}
 
-		newToken := uuid.NewV1()
-		app.logger.Info().Str("userID", usr.ID.String()).Msg("user logged in, generated new token")
-		if err := app.storage.InsertToken(newToken, usr.ID); err != nil {
-			app.logger.Error().Err(err).Msg("failed to insert new token")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		SetAuthCookie(w, newToken)
+		app.setAuthCookie(w, newToken)
 
 		redirect(w, r, "/")
 	})
@@ -232,6 +364,42 @@ func (app *App) loginHandler() http.Handler {
 	return loginRouter
 }
 
+// login checks user credentials and issues a new token.
+// Returns nil user if username is not found or password is wrong.
+func (app *App) login(r *http.Request, username, password string) (*model.User, uuid.UUID, error) {
+	// the user may have just signed up or changed the password, so replicas and the cache aren't read
+	usr, err := app.storage.FindUserForLogin(r.Context(), username)
+	if err != nil {
+		app.log(r.Context()).Error().Err(err).Msg("failed storage username search")
+		return nil, uuid.Nil, err
+	}
+	if usr == nil {
+		failedLoginsTotal.Inc()
+		return nil, uuid.Nil, nil
+	}
+	ok, needsRehash, err := model.VerifyPassword(password, usr.PasswordHash)
+	if err != nil {
+		app.log(r.Context()).Error().Err(err).Str("userID", usr.ID.String()).Msg("failed to verify password")
+		return nil, uuid.Nil, err
+	}
+	if !ok {
+		failedLoginsTotal.Inc()
+		return nil, uuid.Nil, nil
+	}
+	if needsRehash {
+		app.rehashPassword(r.Context(), usr, password)
+	}
+
+	session := model.NewSession(usr.ID, r.UserAgent(), clientIP(r), SessionTTL)
+	app.log(r.Context()).Info().Str("userID", usr.ID.String()).Msg("user logged in, generated new token")
+	if err := app.storage.InsertToken(r.Context(), session); err != nil {
+		app.log(r.Context()).Error().Err(err).Msg("failed to insert new token")
+		return nil, uuid.Nil, err
+	}
+	loginsTotal.Inc()
+	return usr, session.Token, nil
+}
+
 func (app *App) respondLoginHint(w http.ResponseWriter, loginInfo *templates.LoginInfo,
 	status int, hint templates.Hint) {
 	loginInfo.ToResponse(hint)
@@ -256,31 +424,20 @@ func (app *App) signupHandler() http.Handler {
 	})
 	signupRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
-			app.logger.Err(err).Msg("failed parsing form")
+			app.log(r.Context()).Err(err).Msg("failed parsing form")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		info := templates.NewSignupInfo(r.Form)
-		app.logger.Info().Msgf("parsed form: %+v", *info)
+		app.log(r.Context()).Info().Msgf("parsed form: %+v", *info)
 
-		usr, err := model.NewUserFromSignup(info)
-		if err != nil {
-			app.returnErrorOnSingUp(w, info, err)
-			return
-		}
-		anotherUsr, err := app.storage.FindUserByUsername(usr.Username)
+		_, invalid, err := app.signup(r.Context(), info)
 		if err != nil {
-			app.logger.Err(err).Msg("failed to check for existing username in storage")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if anotherUsr != nil {
-			app.returnErrorOnSingUp(w, info, errors.New("username already exists, choose another one"))
-			return
-		}
-		if err = app.storage.InsertUser(usr); err != nil {
-			app.logger.Err(err).Msg("failed to store new user")
-			w.WriteHeader(http.StatusInternalServerError)
+		if invalid != nil {
+			app.returnErrorOnSingUp(w, info, invalid)
 			return
 		}
 
@@ -289,6 +446,45 @@ func (app *App) signupHandler() http.Handler {
 	return signupRouter
 }
 
+// rehashPassword upgrades password hash made by legacy algorithm or with outdated parameters.
+// Failure is not critical for logging in, so it is only logged.
+func (app *App) rehashPassword(ctx context.Context, usr *model.User, password string) {
+	hash, err := model.HashPassword(password)
+	if err != nil {
+		app.log(ctx).Error().Err(err).Msg("failed to rehash password")
+		return
+	}
+	if err := app.storage.UpdatePasswordHash(ctx, usr.ID, hash); err != nil {
+		app.log(ctx).Error().Err(err).Str("userID", usr.ID.String()).Msg("failed to update password hash")
+		return
+	}
+	usr.PasswordHash = hash
+	app.log(ctx).Info().Str("userID", usr.ID.String()).Msg("password hash upgraded")
+}
+
+// signup validates signup info and stores a new user.
+// invalid is an error to be shown to the user, err is an internal failure.
+func (app *App) signup(ctx context.Context, info *templates.SignupInfo) (usr *model.User, invalid error, err error) {
+	usr, invalid = model.NewUserFromSignup(info)
+	if invalid != nil {
+		return nil, invalid, nil
+	}
+	taken, err := app.storage.IsUsernameTaken(ctx, usr.Username)
+	if err != nil {
+		app.log(ctx).Err(err).Msg("failed to check for existing username in storage")
+		return nil, nil, err
+	}
+	if taken {
+		return nil, errors.New("username already exists, choose another one"), nil
+	}
+	if err = app.storage.InsertUser(ctx, usr); err != nil {
+		app.log(ctx).Err(err).Msg("failed to store new user")
+		return nil, nil, err
+	}
+	signupsTotal.Inc()
+	return usr, nil, nil
+}
+
 func (app *App) returnErrorOnSingUp(w http.ResponseWriter, info *templates.SignupInfo, err error) {
 	app.logger.Info().Err(err).Msg("falied to sing up")
 	info.Err = err.Error()
@@ -325,8 +521,9 @@ type RequestFormatter struct {
 	*zerolog.Logger
 }
 
+// NewLogEntry uses the logger of the request, so that entries have trace ids
 func (rf RequestFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
-	return LogEntry{r: r, logger: rf.Logger}
+	return LogEntry{r: r, logger: requestLogger(r.Context(), rf.Logger)}
 }
 
 func redirect(w http.ResponseWriter, r *http.Request, where string) {
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/chocosin/otus-hl/social/feed"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/api/global"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestApp(t *testing.T) *App {
+	tmpl, err := templates.NewTemplates("./templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryStorage := storage.NewMemoryStorage()
+	return &App{
+		logger:    zerolog.Nop(),
+		storage:   memoryStorage,
+		messages:  storage.NewMemoryMessageStorage(),
+		feed:      feed.NewFeed(memoryStorage, feed.NewMemoryCache(feedSize, feedTTL), feedSize),
+		touches:   newSessionTouches(),
+		Templates: tmpl,
+		config:    config.Default(),
+	}
+}
+
+func postForm(t *testing.T, h http.Handler, path string, form url.Values, cookies ...*http.Cookie) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func get(t *testing.T, h http.Handler, path string, cookies ...*http.Cookie) (*http.Response, string) {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	body, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Result(), string(body)
+}
+
+func authCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == config.Default().Cookie.Name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSignupLoginAndMe(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+
+	resp := postForm(t, h, "/signup", url.Values{
+		"Username":  {"ivan"},
+		"Password":  {"secret"},
+		"FirstName": {"Ivan"},
+		"LastName":  {"Ivanov"},
+		"Age":       {"30"},
+		"Gender":    {"male"},
+		"City":      {"Moscow"},
+		"Interests": {"chess,books"},
+	})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("signup: expected redirect, got %d", resp.StatusCode)
+	}
+
+	resp = postForm(t, h, "/login", url.Values{"Username": {"ivan"}, "Password": {"wrong"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("login with wrong password: expected 401, got %d", resp.StatusCode)
+	}
+
+	resp = postForm(t, h, "/login", url.Values{"Username": {"ivan"}, "Password": {"secret"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login: expected redirect, got %d", resp.StatusCode)
+	}
+	cookie := authCookie(resp)
+	if cookie == nil {
+		t.Fatal("login didn't set auth cookie")
+	}
+
+	resp, body := get(t, h, "/me", cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/me: expected 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, "Ivanov") {
+		t.Errorf("/me doesn't contain user's last name: %s", body)
+	}
+
+	resp, _ = get(t, h, "/me")
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("/me without cookie: expected redirect to login, got %d", resp.StatusCode)
+	}
+}
+
+func TestSignupRejectsTakenUsername(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+
+	form := url.Values{
+		"Username":  {"petr"},
+		"Password":  {"secret"},
+		"FirstName": {"Petr"},
+		"LastName":  {"Petrov"},
+		"Age":       {"25"},
+		"Gender":    {"male"},
+		"City":      {"Omsk"},
+	}
+	if resp := postForm(t, h, "/signup", form); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("signup: expected redirect, got %d", resp.StatusCode)
+	}
+	resp := postForm(t, h, "/signup", form)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "username already exists") {
+		t.Errorf("second signup should fail, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func signupAndLogin(t *testing.T, h http.Handler, username, password string) *http.Cookie {
+	signup(t, h, username, password, "")
+	return login(t, h, username, password)
+}
+
+func signup(t *testing.T, h http.Handler, username, password, interests string) {
+	resp := postForm(t, h, "/signup", url.Values{
+		"Username":  {username},
+		"Password":  {password},
+		"FirstName": {"Anna"},
+		"LastName":  {"Smirnova"},
+		"Age":       {"28"},
+		"Gender":    {"female"},
+		"City":      {"Kazan"},
+		"Interests": {interests},
+	})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("signup: expected redirect, got %d", resp.StatusCode)
+	}
+}
+
+func login(t *testing.T, h http.Handler, username, password string) *http.Cookie {
+	resp := postForm(t, h, "/login", url.Values{"Username": {username}, "Password": {password}})
+	cookie := authCookie(resp)
+	if cookie == nil {
+		t.Fatalf("login didn't set auth cookie, status %d", resp.StatusCode)
+	}
+	return cookie
+}
+
+// touchCountingStorage counts prolonging sessions
+type touchCountingStorage struct {
+	storage.Storage
+	touches int
+}
+
+func (s *touchCountingStorage) TouchToken(ctx context.Context, token uuid.UUID, seenAt time.Time, expiresAt time.Time,
+	minInterval time.Duration) (bool, error) {
+	s.touches++
+	return s.Storage.TouchToken(ctx, token, seenAt, expiresAt, minInterval)
+}
+
+func TestSessionIsTouchedOncePerInterval(t *testing.T) {
+	app := newTestApp(t)
+	counting := &touchCountingStorage{Storage: app.storage}
+	app.storage = counting
+	h := app.router()
+	cookie := signupAndLogin(t, h, "anna", "secret")
+
+	for idx := 0; idx < 5; idx++ {
+		if resp, _ := get(t, h, "/me/edit", cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the edit page, got %d", resp.StatusCode)
+		}
+	}
+	if counting.touches != 1 {
+		t.Fatalf("expected the session to be touched once, touched %d times", counting.touches)
+	}
+}
+
+func TestEditProfileAndChangePassword(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+	cookie := signupAndLogin(t, h, "anna", "secret")
+	otherCookie := login(t, h, "anna", "secret")
+
+	_, body := get(t, h, "/me/edit", cookie)
+	if !strings.Contains(body, `value="Kazan"`) {
+		t.Fatalf("edit form isn't pre-filled: %s", body)
+	}
+
+	profile := url.Values{
+		"FirstName": {"Anna"},
+		"LastName":  {"Ivanova"},
+		"Age":       {"29"},
+		"Gender":    {"female"},
+		"City":      {"Moscow"},
+		"Interests": {"music, travel"},
+	}
+	if resp := postForm(t, h, "/me/edit", profile, cookie); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("edit: expected redirect, got %d", resp.StatusCode)
+	}
+	usr, err := app.storage.FindUserByUsername(context.Background(), "anna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.LastName != "Ivanova" || usr.Age != 29 || usr.City != "Moscow" || usr.JoinInterests() != "music, travel" {
+		t.Fatalf("profile wasn't updated: %+v", usr)
+	}
+
+	profile.Set("CurrentPassword", "wrong")
+	profile.Set("NewPassword", "newsecret")
+	if resp := postForm(t, h, "/me/edit", profile, cookie); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("password change with wrong current password: expected 403, got %d", resp.StatusCode)
+	}
+
+	profile.Set("CurrentPassword", "secret")
+	if resp := postForm(t, h, "/me/edit", profile, cookie); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("password change: expected redirect, got %d", resp.StatusCode)
+	}
+	if resp, _ := get(t, h, "/me", cookie); resp.StatusCode != http.StatusOK {
+		t.Errorf("current session should stay alive, got %d", resp.StatusCode)
+	}
+	if resp, _ := get(t, h, "/me", otherCookie); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("other sessions should be revoked, got %d", resp.StatusCode)
+	}
+	login(t, h, "anna", "newsecret")
+}
+
+func TestExportAndDeleteAccount(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+	cookie := signupAndLogin(t, h, "olga", "secret")
+	if resp := postForm(t, h, "/posts", url.Values{"Text": {"hello world"}}, cookie); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("post: expected redirect, got %d", resp.StatusCode)
+	}
+
+	resp, body := get(t, h, "/me/export", cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export: expected 200, got %d", resp.StatusCode)
+	}
+	var export userExport
+	if err := json.Unmarshal([]byte(body), &export); err != nil {
+		t.Fatalf("export isn't valid json: %v", err)
+	}
+	if export.Profile.Username != "olga" || len(export.Posts) != 1 || len(export.Sessions) != 1 {
+		t.Fatalf("wrong export: %+v", export)
+	}
+
+	resp, body = get(t, h, "/me/export?format=zip", cookie)
+	archive, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("export isn't valid zip: %v", err)
+	}
+	if len(archive.File) != 6 || archive.File[0].Name != "profile.json" {
+		t.Fatalf("wrong files in export archive: %v", archive.File)
+	}
+
+	if resp := postForm(t, h, "/me/delete", url.Values{"Password": {"wrong"}}, cookie); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("delete with wrong password: expected 403, got %d", resp.StatusCode)
+	}
+	ctx := context.Background()
+	signup(t, h, "ivan", "secret", "")
+	olga, err := app.storage.FindUserByUsername(ctx, "olga")
+	if err != nil {
+		t.Fatalf("error finding user: %v", err)
+	}
+	ivan, err := app.storage.FindUserByUsername(ctx, "ivan")
+	if err != nil {
+		t.Fatalf("error finding user: %v", err)
+	}
+	msg, err := model.NewMessage(olga, ivan, "bye")
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if err := app.messages.SendMessage(ctx, msg, olga.Username, ivan.Username); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+
+	if resp := postForm(t, h, "/me/delete", url.Values{"Password": {"secret"}}, cookie); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("delete: expected redirect, got %d", resp.StatusCode)
+	}
+	if dialogs, err := app.messages.ListDialogs(ctx, ivan.ID); err != nil || len(dialogs) != 0 {
+		t.Errorf("dialogs of deleted user should be deleted, got %+v, %v", dialogs, err)
+	}
+	if resp, _ := get(t, h, "/me", cookie); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("session of deleted user should be revoked, got %d", resp.StatusCode)
+	}
+	resp = postForm(t, h, "/signup", url.Values{
+		"Username":  {"olga"},
+		"Password":  {"secret"},
+		"FirstName": {"Olga"},
+		"LastName":  {"Petrova"},
+		"Age":       {"40"},
+		"Gender":    {"female"},
+		"City":      {"Perm"},
+	})
+	signupBody, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(signupBody), "username already exists") {
+		t.Errorf("username of deleted user shouldn't be reclaimed, got %d", resp.StatusCode)
+	}
+}
+
+func TestInterestPagesAndSimilarUsers(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+	signup(t, h, "chessplayer", "secret", "Chess, Books")
+	signup(t, h, "reader", "secret", "books,chess ,travel")
+	signup(t, h, "traveller", "secret", "travel")
+
+	_, body := get(t, h, "/interests/CHESS")
+	if !strings.Contains(body, "chessplayer") || !strings.Contains(body, "reader") ||
+		strings.Contains(body, "traveller") {
+		t.Fatalf("wrong users interested in chess: %s", body)
+	}
+
+	_, body = get(t, h, "/user/chessplayer")
+	if !strings.Contains(body, `href="/interests/chess"`) {
+		t.Errorf("interests should be normalized and linked: %s", body)
+	}
+	if !strings.Contains(body, `href="/user/reader"`) || strings.Contains(body, `href="/user/traveller"`) {
+		t.Errorf("wrong similar users: %s", body)
+	}
+}
+
+func TestCityPages(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+	signup(t, h, "first", "secret", "")
+	signup(t, h, "second", "secret", "")
+	resp := postForm(t, h, "/signup", url.Values{
+		"Username":  {"third"},
+		"Password":  {"secret"},
+		"FirstName": {"Ivan"},
+		"LastName":  {"Ivanov"},
+		"Age":       {"30"},
+		"Gender":    {"male"},
+		"City":      {"  Nizhny   Novgorod "},
+	})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("signup: expected redirect, got %d", resp.StatusCode)
+	}
+
+	_, body := get(t, h, "/cities")
+	if !strings.Contains(body, `<a href="/cities/Kazan">Kazan</a> 2`) ||
+		!strings.Contains(body, `<a href="/cities/Nizhny%20Novgorod">Nizhny Novgorod</a> 1`) {
+		t.Fatalf("wrong cities: %s", body)
+	}
+
+	_, body = get(t, h, "/cities/%20kazan")
+	if !strings.Contains(body, `href="/user/first"`) || !strings.Contains(body, `href="/user/second"`) ||
+		strings.Contains(body, `href="/user/third"`) {
+		t.Fatalf("wrong users of the city: %s", body)
+	}
+}
+
+func TestLastUsernamesPages(t *testing.T) {
+	app := newTestApp(t)
+	app.config.PageSize = 2
+	h := app.router()
+	signup(t, h, "first", "secret", "")
+	signup(t, h, "second", "secret", "")
+	signup(t, h, "third", "secret", "")
+
+	_, body := get(t, h, "/last")
+	if !strings.Contains(body, `href="/user/third"`) || !strings.Contains(body, `href="/user/second"`) ||
+		strings.Contains(body, `href="/user/first"`) {
+		t.Fatalf("wrong first page: %s", body)
+	}
+	next := regexp.MustCompile(`href="(/last\?after=[^"]+)"`).FindStringSubmatch(body)
+	if next == nil {
+		t.Fatalf("first page has no next link: %s", body)
+	}
+
+	_, body = get(t, h, html.UnescapeString(next[1]))
+	if !strings.Contains(body, `href="/user/first"`) || strings.Contains(body, `href="/user/second"`) ||
+		strings.Contains(body, "?after=") {
+		t.Fatalf("wrong last page: %s", body)
+	}
+
+	if resp, _ := get(t, h, "/last?after=broken"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid cursor: expected 400, got %d", resp.StatusCode)
+	}
+
+	// the api takes the cursor the same way
+	var page apiUsernames
+	_, body = get(t, h, "/api/v1/users/last")
+	if err := json.Unmarshal([]byte(body), &page); err != nil || page.Next == "" {
+		t.Fatalf("expected api page with next cursor, got %s", body)
+	}
+	_, body = get(t, h, "/api/v1/users/last?after="+url.QueryEscape(page.Next))
+	page = apiUsernames{}
+	if err := json.Unmarshal([]byte(body), &page); err != nil ||
+		len(page.Usernames) != 1 || page.Usernames[0] != "first" || page.Next != "" {
+		t.Fatalf("wrong last api page: %s", body)
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	app := newTestApp(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := app.newServer()
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serve(ctx, server, listener)
+	}()
+
+	responded := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			responded <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responded <- string(body)
+	}()
+	<-started
+	shutdown()
+
+	if body := <-responded; body != "done" {
+		t.Errorf("in-flight request should be finished, got: %s", body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve should stop without error, got: %v", err)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+		t.Errorf("server should stop accepting requests")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	app := newTestApp(t)
+	h := app.router()
+	signups, logins, failed := testutil.ToFloat64(signupsTotal), testutil.ToFloat64(loginsTotal),
+		testutil.ToFloat64(failedLoginsTotal)
+
+	cookie := signupAndLogin(t, h, "metrics", "password1")
+	postForm(t, h, "/login", url.Values{"Username": {"metrics"}, "Password": {"wrong"}})
+	get(t, h, "/user/metrics", cookie)
+
+	if testutil.ToFloat64(signupsTotal)-signups != 1 || testutil.ToFloat64(loginsTotal)-logins != 1 ||
+		testutil.ToFloat64(failedLoginsTotal)-failed != 1 {
+		t.Errorf("expected one signup, login and failed login")
+	}
+	if err := app.refreshActiveSessions(context.Background()); err != nil {
+		t.Fatalf("failed to count active sessions: %v", err)
+	}
+	if active := testutil.ToFloat64(activeSessions); active != 1 {
+		t.Errorf("expected 1 active session, got %v", active)
+	}
+
+	resp, body := get(t, h, "/metrics")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected metrics, got %d", resp.StatusCode)
+	}
+	for _, metric := range []string{
+		`social_http_request_duration_seconds_count{method="GET",route="/user/{username}",status="200"}`,
+		`social_http_request_duration_seconds_count{method="POST",route="/login/",status="401"}`,
+		`social_active_sessions 1`,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("metrics should contain %s", metric)
+		}
+	}
+}
+
+// spanRecorder keeps exported spans
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+func (sr *spanRecorder) ExportSpan(ctx context.Context, span *export.SpanData) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.spans = append(sr.spans, span)
+}
+
+func (sr *spanRecorder) byName() map[string]*export.SpanData {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	spans := make(map[string]*export.SpanData)
+	for _, span := range sr.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	recorder := &spanRecorder{}
+	provider, err := sdktrace.NewProvider(sdktrace.WithSyncer(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.SetTraceProvider(provider)
+
+	var logs bytes.Buffer
+	app := newTestApp(t)
+	app.logger = zerolog.New(&logs)
+	app.storage = storage.NewTracedStorage(app.storage)
+	h := app.router()
+	cookie := signupAndLogin(t, h, "traced", "password1")
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	r := httptest.NewRequest(http.MethodGet, "/user/traced", nil)
+	r.AddCookie(cookie)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected user page, got %d", w.Code)
+	}
+
+	spans := recorder.byName()
+	server, query := spans["GET /user/{username}"], spans["Storage.FindUserByUsername"]
+	if server == nil || query == nil {
+		t.Fatalf("expected request and storage spans, got %v", spans)
+	}
+	if server.SpanContext.TraceID.String() != traceID || server.ParentSpanID.String() != parentID {
+		t.Errorf("request span should continue the trace from traceparent: %+v", server.SpanContext)
+	}
+	if query.SpanContext.TraceID != server.SpanContext.TraceID || query.ParentSpanID != server.SpanContext.SpanID {
+		t.Errorf("storage span should be a child of the request span")
+	}
+	if !strings.Contains(logs.String(), `"traceID":"`+traceID+`"`) {
+		t.Errorf("request logs should have the trace id: %s", logs.String())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const activeSessionsInterval = time.Minute
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "social",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by chi route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	signupsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "social",
+		Name:      "signups_total",
+		Help:      "Number of registered users.",
+	})
+	loginsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "social",
+		Name:      "logins_total",
+		Help:      "Number of successful logins.",
+	})
+	failedLoginsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "social",
+		Name:      "failed_logins_total",
+		Help:      "Number of logins with unknown username or wrong password.",
+	})
+	activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "social",
+		Name:      "active_sessions",
+		Help:      "Number of not expired sessions, refreshed every minute.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, signupsTotal, loginsTotal, failedLoginsTotal, activeSessions)
+}
+
+// measure observes request duration labelled by the route pattern,
+// so that requests to /user/alice and /user/bob are counted together
+func (app *App) measure(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		h.ServeHTTP(ww, r)
+
+		requestDuration.WithLabelValues(r.Method, routePattern(r), strconv.Itoa(responseStatus(ww))).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// registerStorageMetrics exports stats of storages holding connection pools
+func (app *App) registerStorageMetrics() {
+	for _, s := range []interface{}{app.storage, app.messages} {
+		if collector, ok := storage.Unwrap(s).(prometheus.Collector); ok {
+			prometheus.MustRegister(collector)
+		}
+	}
+}
+
+// countActiveSessions periodically refreshes the active sessions gauge until ctx is done
+func (app *App) countActiveSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := app.refreshActiveSessions(ctx); err != nil && ctx.Err() == nil {
+			app.logger.Err(err).Msg("failed to count active sessions")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) refreshActiveSessions(ctx context.Context) error {
+	count, err := app.storage.CountActiveTokens(ctx, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	activeSessions.Set(float64(count))
+	return nil
+}
@@ -0,0 +1,18 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Friend request is stored as a single pending row (userID -> friendID).
+-- Accepted friendship is stored as two symmetric accepted rows,
+-- so that friends of a user can be read by primary key prefix.
+create table if not exists friendships
+(
+    userID    char(36) not null,
+    friendID  char(36) not null,
+    status    char(10) not null,
+    createdAt timestamp not null default current_timestamp,
+    PRIMARY KEY (userID, friendID),
+    INDEX friendships_friend_status (friendID, status)
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+drop table friendships;
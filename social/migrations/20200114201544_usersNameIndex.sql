@@ -0,0 +1,7 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE INDEX users_first_last_name ON users (firstName, lastName);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX users_first_last_name ON users;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- password keeps encoded hash with algorithm, parameters and salt instead of md5 hex
+ALTER TABLE users
+    MODIFY COLUMN password VARCHAR(255) NOT NULL;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+ALTER TABLE users
+    MODIFY COLUMN password CHAR(32) NOT NULL;
@@ -0,0 +1,26 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- times are UTC as the app writes them, CURRENT_TIMESTAMP is in the server time zone,
+-- so existing tokens are set with UTC_TIMESTAMP and new ones always get times from the app
+ALTER TABLE auth_tokens
+    ADD COLUMN created_at   DATETIME     NOT NULL DEFAULT '1970-01-01 00:00:00',
+    ADD COLUMN last_seen_at DATETIME     NOT NULL DEFAULT '1970-01-01 00:00:00',
+    ADD COLUMN expires_at   DATETIME     NOT NULL DEFAULT '1970-01-01 00:00:00',
+    ADD COLUMN user_agent   VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN ip           VARCHAR(45)  NOT NULL DEFAULT '';
+-- tokens issued before expiration was introduced get the same 30 days as cookies
+UPDATE auth_tokens
+SET created_at   = UTC_TIMESTAMP(),
+    last_seen_at = UTC_TIMESTAMP(),
+    expires_at   = DATE_ADD(UTC_TIMESTAMP(), INTERVAL 30 DAY);
+CREATE INDEX auth_tokens_expires_at ON auth_tokens (expires_at);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX auth_tokens_expires_at ON auth_tokens;
+ALTER TABLE auth_tokens
+    DROP COLUMN created_at,
+    DROP COLUMN last_seen_at,
+    DROP COLUMN expires_at,
+    DROP COLUMN user_agent,
+    DROP COLUMN ip;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE INDEX auth_tokens_user ON auth_tokens (userID);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX auth_tokens_user ON auth_tokens;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+create table if not exists posts
+(
+    id         char(36) primary key,
+    authorID   char(36)      not null,
+    text       varchar(1000) not null,
+    created_at datetime      not null,
+    INDEX posts_author_created (authorID, created_at)
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+drop table posts;
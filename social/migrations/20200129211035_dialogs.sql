@@ -0,0 +1,29 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- every dialog has a row per participant, so dialogs of a user are read by primary key prefix
+create table if not exists dialogs
+(
+    userID          char(36) not null,
+    otherID         char(36) not null,
+    dialogID        char(36) not null,
+    last_message_at datetime(6) not null,
+    PRIMARY KEY (userID, otherID)
+);
+
+-- messages are keyed by dialogID, so they can be sharded by it
+create table if not exists messages
+(
+    dialogID    char(36)      not null,
+    id          char(36)      not null,
+    authorID    char(36)      not null,
+    recipientID char(36)      not null,
+    text        varchar(4000) not null,
+    created_at  datetime(6)   not null,
+    PRIMARY KEY (dialogID, id),
+    INDEX messages_dialog_created (dialogID, created_at)
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+drop table messages;
+drop table dialogs;
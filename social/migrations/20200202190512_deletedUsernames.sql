@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- usernames of deleted users can't be registered again until released_at
+create table if not exists deleted_usernames
+(
+    username    varchar(50) primary key,
+    released_at datetime    not null
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+drop table deleted_usernames;
@@ -0,0 +1,72 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+create table if not exists interests
+(
+    id  bigint auto_increment primary key,
+    tag varchar(64) not null,
+    UNIQUE INDEX interests_tag (tag)
+);
+
+-- position keeps the order in which user has listed interests
+create table if not exists user_interests
+(
+    userID     char(36) not null,
+    interestID bigint   not null,
+    position   int      not null,
+    PRIMARY KEY (userID, interestID),
+    INDEX user_interests_interest (interestID)
+);
+
+-- splitting comma joined interests, there are no more than 128 of them in varchar(255)
+create table interests_backfill_numbers
+(
+    n int primary key
+);
+insert into interests_backfill_numbers(n)
+select a.n * 16 + b.n + 1
+from (select 0 n union all select 1 union all select 2 union all select 3 union all select 4 union all select 5
+      union all select 6 union all select 7) a
+         cross join (select 0 n union all select 1 union all select 2 union all select 3 union all select 4
+                     union all select 5 union all select 6 union all select 7 union all select 8 union all select 9
+                     union all select 10 union all select 11 union all select 12 union all select 13
+                     union all select 14 union all select 15) b;
+
+create table interests_backfill
+(
+    userID   char(36)    not null,
+    tag      varchar(64) not null,
+    position int         not null
+);
+-- legacy tags may be up to 255 chars, they are cut to the max length of a tag as validated on signup
+insert into interests_backfill(userID, tag, position)
+select u.id, lower(trim(left(trim(substring_index(substring_index(u.interests, ',', n.n), ',', -1)), 64))), n.n
+from users u
+         join interests_backfill_numbers n
+              on n.n <= char_length(u.interests) - char_length(replace(u.interests, ',', '')) + 1
+where trim(substring_index(substring_index(u.interests, ',', n.n), ',', -1)) <> '';
+
+insert into interests(tag)
+select distinct tag from interests_backfill;
+
+-- the same tag may be listed twice, the first position is kept
+insert into user_interests(userID, interestID, position)
+select b.userID, i.id, min(b.position)
+from interests_backfill b
+         join interests i on i.tag = b.tag
+group by b.userID, i.id;
+
+drop table interests_backfill;
+drop table interests_backfill_numbers;
+
+alter table users drop column interests;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+alter table users add column interests varchar(255) not null default '';
+update users u
+set interests = coalesce((select group_concat(i.tag order by ui.position separator ',')
+                          from user_interests ui
+                                   join interests i on i.id = ui.interestID
+                          where ui.userID = u.id), '');
+drop table user_interests;
+drop table interests;
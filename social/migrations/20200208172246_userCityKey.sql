@@ -0,0 +1,17 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- city_key is the city folded to lowercase with single spaces, users are grouped by it.
+-- Runs of any whitespace are folded like model.NormalizeCity does, so keys match the ones made by the app
+UPDATE users
+SET city = TRIM(REGEXP_REPLACE(city, '[[:space:]]+', ' '));
+ALTER TABLE users
+    ADD COLUMN city_key VARCHAR(50) NOT NULL DEFAULT '';
+UPDATE users
+SET city_key = LOWER(city);
+CREATE INDEX users_city_key_id ON users (city_key, id);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX users_city_key_id ON users;
+ALTER TABLE users
+    DROP COLUMN city_key;
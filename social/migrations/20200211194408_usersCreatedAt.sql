@@ -0,0 +1,23 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+ALTER TABLE users
+    ADD COLUMN created_at DATETIME(6) NOT NULL DEFAULT '1970-01-01 00:00:00';
+-- ids of existing users are uuid v1, so registration time is taken from them:
+-- 100ns intervals since 1582-10-15, which is 12219292800 seconds before unix epoch.
+-- FROM_UNIXTIME returns time of the session time zone, it's converted to UTC which the app writes.
+UPDATE users
+SET created_at = CONVERT_TZ(FROM_UNIXTIME(
+            CONV(CONCAT(SUBSTRING(id, 16, 3), SUBSTRING(id, 10, 4), SUBSTRING(id, 1, 8)), 16, 10) DIV 10
+            / 1000000 - 12219292800), @@session.time_zone, '+00:00')
+WHERE SUBSTRING(id, 15, 1) = '1';
+CREATE INDEX users_created_at_id ON users (created_at, id);
+DROP INDEX users_city_key_id ON users;
+CREATE INDEX users_city_key_created_at_id ON users (city_key, created_at, id);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX users_city_key_created_at_id ON users;
+CREATE INDEX users_city_key_id ON users (city_key, id);
+DROP INDEX users_created_at_id ON users;
+ALTER TABLE users
+    DROP COLUMN created_at;
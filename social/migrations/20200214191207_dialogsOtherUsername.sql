@@ -0,0 +1,14 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- usernames are kept in dialogs, so listing dialogs doesn't join users, which may be in another database
+ALTER TABLE dialogs
+    ADD COLUMN otherUsername varchar(50) NOT NULL DEFAULT '';
+UPDATE dialogs
+SET otherUsername = coalesce((SELECT u.username FROM users u WHERE u.id = dialogs.otherID), '');
+-- dialogs with deleted users used to be hidden by the join
+DELETE FROM dialogs WHERE otherUsername = '';
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+ALTER TABLE dialogs
+    DROP COLUMN otherUsername;
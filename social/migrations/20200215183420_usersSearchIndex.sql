@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- the first name prefix is a range of the index, so matching users are still sorted by (created_at, id),
+-- but the last name prefix and the cursor are checked on index entries (index condition pushdown),
+-- so only users of the page's search are read from the table and sorted, not all with the first name prefix
+CREATE INDEX users_first_last_created_at_id ON users (firstName, lastName, created_at, id);
+DROP INDEX users_first_last_name ON users;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+CREATE INDEX users_first_last_name ON users (firstName, lastName);
+DROP INDEX users_first_last_created_at_id ON users;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- searching by the last name only matches every first name, so it takes a range of this index instead
+CREATE INDEX users_last_first_created_at_id ON users (lastName, firstName, created_at, id);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX users_last_first_created_at_id ON users;
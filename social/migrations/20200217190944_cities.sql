@@ -0,0 +1,18 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- users are counted per city on insert, update and delete, so listing cities doesn't aggregate all users
+create table if not exists cities
+(
+    city_key varchar(50) not null primary key,
+    name     varchar(50) not null,
+    users    int         not null,
+    INDEX cities_users (users, city_key)
+);
+insert into cities(city_key, name, users)
+select city_key, min(city), count(*)
+from users
+group by city_key;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+drop table cities;
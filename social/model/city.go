@@ -0,0 +1,20 @@
+package model
+
+import "strings"
+
+// City is a group of users living in the same city
+type City struct {
+	// Name is how one of the users has spelled the city
+	Name  string
+	Users int
+}
+
+// NormalizeCity trims the city and collapses whitespace inside it
+func NormalizeCity(city string) string {
+	return strings.Join(strings.Fields(city), " ")
+}
+
+// CityKey is the same for cities which differ only in case or whitespace
+func CityKey(city string) string {
+	return strings.ToLower(NormalizeCity(city))
+}
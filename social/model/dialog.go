@@ -0,0 +1,61 @@
+package model
+
+import (
+	"errors"
+	uuid "github.com/satori/go.uuid"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxMessageLength = 4000
+
+var dialogNamespace = uuid.FromStringOrNil("5b1c8e4e-3f0a-4d43-9a55-6f1bde3c9e21")
+
+// DialogID is the same for both participants regardless of their order
+func DialogID(a, b uuid.UUID) uuid.UUID {
+	first, second := a.String(), b.String()
+	if first > second {
+		first, second = second, first
+	}
+	return uuid.NewV5(dialogNamespace, first+":"+second)
+}
+
+type Dialog struct {
+	ID      uuid.UUID
+	UserID  uuid.UUID
+	OtherID uuid.UUID
+	// Other is the username of the other participant
+	Other         string
+	LastMessageAt time.Time
+}
+
+type Message struct {
+	ID          uuid.UUID
+	DialogID    uuid.UUID
+	AuthorID    uuid.UUID
+	RecipientID uuid.UUID
+	Text        string
+	CreatedAt   time.Time
+}
+
+func NewMessage(author, recipient *User, text string) (*Message, error) {
+	if uuid.Equal(author.ID, recipient.ID) {
+		return nil, errors.New("can't send message to yourself")
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("message is empty")
+	}
+	if utf8.RuneCountInString(text) > maxMessageLength {
+		return nil, errors.New("message is longer than 4000 chars")
+	}
+	return &Message{
+		ID:          uuid.NewV1(),
+		DialogID:    DialogID(author.ID, recipient.ID),
+		AuthorID:    author.ID,
+		RecipientID: recipient.ID,
+		Text:        text,
+		CreatedAt:   time.Now().UTC().Truncate(time.Microsecond),
+	}, nil
+}
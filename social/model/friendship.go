@@ -0,0 +1,11 @@
+package model
+
+// FriendshipStatus is a relation between two users as seen by the first one
+type FriendshipStatus = string
+
+const (
+	FriendshipNone      FriendshipStatus = "none"
+	FriendshipRequested FriendshipStatus = "requested"
+	FriendshipIncoming  FriendshipStatus = "incoming"
+	FriendshipAccepted  FriendshipStatus = "accepted"
+)
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes passwords into self-describing strings,
+// which contain algorithm, parameters and salt
+type PasswordHasher interface {
+	// Hash returns encoded hash of the password
+	Hash(password string) (string, error)
+	// Verify checks the password against the hash produced by this hasher
+	Verify(password, encoded string) (bool, error)
+	// Supports tells whether encoded hash is produced by this algorithm
+	Supports(encoded string) bool
+	// NeedsRehash tells whether encoded hash has other parameters than the ones used by hasher now
+	NeedsRehash(encoded string) bool
+}
+
+// DefaultPasswordHasher is used for all new password hashes
+var DefaultPasswordHasher PasswordHasher = NewArgon2idHasher()
+
+// passwordHashers are used to verify hashes made by any of supported algorithms
+var passwordHashers = []PasswordHasher{
+	NewArgon2idHasher(),
+	NewBcryptHasher(bcrypt.DefaultCost),
+	legacyMD5Hasher{},
+}
+
+func HashPassword(pass string) (string, error) {
+	return DefaultPasswordHasher.Hash(pass)
+}
+
+// VerifyPassword checks the password against encoded hash made by any of supported algorithms.
+// needsRehash is true when the password is correct, but the hash should be upgraded to DefaultPasswordHasher.
+func VerifyPassword(pass, encoded string) (ok bool, needsRehash bool, err error) {
+	hasher := DefaultPasswordHasher
+	if !hasher.Supports(encoded) {
+		hasher = nil
+		for _, h := range passwordHashers {
+			if h.Supports(encoded) {
+				hasher = h
+				break
+			}
+		}
+		if hasher == nil {
+			return false, false, ErrUnknownPasswordHash
+		}
+	}
+	ok, err = hasher.Verify(pass, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, hasher != DefaultPasswordHasher || hasher.NeedsRehash(encoded), nil
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// Argon2idHasher encodes hashes in the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    1,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+func (a *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+type argon2idHash struct {
+	version int
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrUnknownPasswordHash
+	}
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &h.version); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, err
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (a *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	h, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	if h.version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %d", h.version)
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+func (a *Argon2idHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (a *Argon2idHasher) NeedsRehash(encoded string) bool {
+	h, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return h.memory != a.Memory || h.time != a.Time || h.threads != a.Threads ||
+		uint32(len(h.key)) != a.KeyLen || uint32(len(h.salt)) != a.SaltLen
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{Cost: cost}
+}
+
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *BcryptHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+// legacyMD5Hasher verifies unsalted md5 hashes stored before switching to argon2id
+type legacyMD5Hasher struct{}
+
+func (legacyMD5Hasher) Hash(password string) (string, error) {
+	hash := md5.Sum([]byte(password))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (l legacyMD5Hasher) Verify(password, encoded string) (bool, error) {
+	hash, _ := l.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(encoded)) == 1, nil
+}
+
+func (legacyMD5Hasher) Supports(encoded string) bool {
+	if len(encoded) != md5.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func (legacyMD5Hasher) NeedsRehash(string) bool {
+	return true
+}
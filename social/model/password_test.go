@@ -0,0 +1,62 @@
+package model
+
+import (
+	"testing"
+)
+
+func checkVerify(t *testing.T, pass, encoded string, expectedOK, expectedRehash bool) {
+	ok, rehash, err := VerifyPassword(pass, encoded)
+	if err != nil {
+		t.Fatalf("error verifying password: %v", err)
+	}
+	if ok != expectedOK || rehash != expectedRehash {
+		t.Fatalf("wrong verification result for %v, expected ok=%v rehash=%v, actual ok=%v rehash=%v",
+			encoded, expectedOK, expectedRehash, ok, rehash)
+	}
+}
+
+func TestHashAndVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	another, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	if hash == another {
+		t.Fatalf("hashes of the same password should be salted differently")
+	}
+	checkVerify(t, "secret", hash, true, false)
+	checkVerify(t, "wrong", hash, false, false)
+}
+
+func TestLegacyMD5PasswordNeedsRehash(t *testing.T) {
+	// md5 of "secret"
+	legacy := "5ebe2294ecd0e0f08eab7690d2a6ee69"
+	checkVerify(t, "secret", legacy, true, true)
+	checkVerify(t, "wrong", legacy, false, false)
+}
+
+func TestOutdatedParametersNeedRehash(t *testing.T) {
+	weak := NewArgon2idHasher()
+	weak.Memory = 1024
+	hash, err := weak.Hash("secret")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	checkVerify(t, "secret", hash, true, true)
+
+	bcryptHash, err := NewBcryptHasher(4).Hash("secret")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	checkVerify(t, "secret", bcryptHash, true, true)
+	checkVerify(t, "wrong", bcryptHash, false, false)
+}
+
+func TestUnknownPasswordHash(t *testing.T) {
+	if _, _, err := VerifyPassword("secret", "plain"); err != ErrUnknownPasswordHash {
+		t.Fatalf("expected ErrUnknownPasswordHash, actual: %v", err)
+	}
+}
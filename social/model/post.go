@@ -0,0 +1,37 @@
+package model
+
+import (
+	"errors"
+	uuid "github.com/satori/go.uuid"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxPostLength = 1000
+
+type Post struct {
+	ID       uuid.UUID
+	AuthorID uuid.UUID
+	// Author is the username of the author, it is filled when reading posts
+	Author    string
+	Text      string
+	CreatedAt time.Time
+}
+
+func NewPost(author *User, text string) (*Post, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("post is empty")
+	}
+	if utf8.RuneCountInString(text) > maxPostLength {
+		return nil, errors.New("post is longer than 1000 chars")
+	}
+	return &Post{
+		ID:        uuid.NewV1(),
+		AuthorID:  author.ID,
+		Author:    author.Username,
+		Text:      text,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+const maxUserAgentLength = 255
+
+type Session struct {
+	Token      uuid.UUID
+	UserID     uuid.UUID
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	IP         string
+}
+
+func NewSession(userID uuid.UUID, userAgent, ip string, ttl time.Duration) *Session {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	// mysql datetime doesn't keep fractional seconds
+	now := time.Now().UTC().Truncate(time.Second)
+	return &Session{
+		Token:      uuid.NewV1(),
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+		UserAgent:  userAgent,
+		IP:         ip,
+	}
+}
+
+// ID identifies the session without revealing the token itself, so it can be shown on pages
+func (s *Session) ID() string {
+	hash := sha256.Sum256(s.Token.Bytes())
+	return hex.EncodeToString(hash[:8])
+}
@@ -1,14 +1,15 @@
 package model
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/chocosin/otus-hl/social/templates"
 	uuid "github.com/satori/go.uuid"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type GenderType = string
@@ -29,20 +30,41 @@ type User struct {
 	Interests    []string
 	City         string
 	Gender       GenderType
+	CreatedAt    time.Time
 }
 
 func (u *User) JoinInterests() string {
 	return strings.Join(u.Interests, ", ")
 }
+
+// SetInterests parses comma separated interests, they are normalized and deduplicated
 func (u *User) SetInterests(joined string) {
-	u.Interests = strings.FieldsFunc(joined, func(r rune) bool {
+	tags := strings.FieldsFunc(joined, func(r rune) bool {
 		return r == ','
 	})
-	for idx := range u.Interests {
-		u.Interests[idx] = strings.TrimSpace(u.Interests[idx])
+	u.Interests = make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = NormalizeInterest(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		u.Interests = append(u.Interests, tag)
 	}
 }
 
+// MaxInterestLength is the max length of a single interest tag
+const MaxInterestLength = 64
+
+// NormalizeInterest makes interest tags, which differ only in case or spaces around, the same
+func NormalizeInterest(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// UsernameQuarantine is how long the username of a deleted account can't be registered again
+const UsernameQuarantine = time.Hour * 24 * 30
+
 var usernameRegexp = regexp.MustCompile("^[a-zA-Z]\\w+$")
 
 func NewUserFromSignup(response *templates.SignupInfo) (*User, error) {
@@ -53,55 +75,123 @@ func NewUserFromSignup(response *templates.SignupInfo) (*User, error) {
 	if !usernameRegexp.MatchString(username) {
 		return nil, errors.New("invalid username")
 	}
-	password := response.Password
+	if err := validatePassword(response.Password); err != nil {
+		return nil, err
+	}
+	passHash, err := HashPassword(response.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := User{
+		ID:           uuid.NewV1(),
+		Username:     username,
+		PasswordHash: passHash,
+		// mysql keeps microseconds
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err = user.setProfile(response.FirstName, response.LastName, response.Age,
+		response.Gender, response.City, response.Interests)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateProfile validates edited profile and applies it to the user.
+// Password is changed only if a new one is given, current password must be correct then.
+func (u *User) UpdateProfile(info *templates.ProfileInfo) error {
+	updated := *u
+	err := updated.setProfile(info.FirstName, info.LastName, info.Age,
+		info.Gender, info.City, info.Interests)
+	if err != nil {
+		return err
+	}
+	if info.NewPassword != "" {
+		ok, _, err := VerifyPassword(info.CurrentPassword, u.PasswordHash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrWrongPassword
+		}
+		if err := updated.ResetPassword(info.NewPassword); err != nil {
+			return err
+		}
+	}
+	*u = updated
+	return nil
+}
+
+// ToProfileInfo fills profile editing form with current values
+func (u *User) ToProfileInfo() *templates.ProfileInfo {
+	return &templates.ProfileInfo{
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Age:       strconv.Itoa(u.Age),
+		Gender:    u.Gender,
+		Interests: u.JoinInterests(),
+		City:      u.City,
+	}
+}
+
+var ErrWrongPassword = errors.New("current password is wrong")
+
+// ResetPassword validates and sets the new password without checking the current one
+func (u *User) ResetPassword(password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	return nil
+}
+
+func validatePassword(password string) error {
 	if len(password) < 3 {
-		return nil, errors.New("password contains less than 3 chars")
+		return errors.New("password contains less than 3 chars")
 	}
-	passHash := HashPassword(password)
+	return nil
+}
 
-	lastName := strings.TrimSpace(response.LastName)
+// setProfile validates and sets fields which are filled both on signup and on profile editing
+func (u *User) setProfile(firstName, lastName, age, gender, city, interests string) error {
+	lastName = strings.TrimSpace(lastName)
 	if len(lastName) < 2 {
-		return nil, errors.New("last name is less than 2 chars")
+		return errors.New("last name is less than 2 chars")
 	}
-	firstName := strings.TrimSpace(response.FirstName)
+	firstName = strings.TrimSpace(firstName)
 	if len(firstName) < 2 {
-		return nil, errors.New("first name is less than 2 chars")
+		return errors.New("first name is less than 2 chars")
 	}
-	age, err := strconv.Atoi(response.Age)
+	parsedAge, err := strconv.Atoi(age)
 	if err != nil {
-		return nil, errors.New("couldn't parse age " + response.Age)
+		return errors.New("couldn't parse age " + age)
 	}
-	gender, err := getGender(response.Gender)
+	parsedGender, err := getGender(gender)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	city := strings.TrimSpace(response.City)
+	city = NormalizeCity(city)
 	if len(city) < 2 {
-		return nil, errors.New("city is less than 2 chars")
+		return errors.New("city is less than 2 chars")
 	}
-	interests := strings.FieldsFunc(response.Interests, func(r rune) bool {
-		return r == ','
-	})
 
-	user := User{
-		ID:           uuid.NewV1(),
-		Username:     username,
-		PasswordHash: passHash,
-		FirstName:    firstName,
-		LastName:     lastName,
-		Age:          age,
-		Gender:       gender,
-		Interests:    interests,
-		City:         city,
+	u.FirstName = firstName
+	u.LastName = lastName
+	u.Age = parsedAge
+	u.Gender = parsedGender
+	u.City = city
+	u.SetInterests(interests)
+	for _, tag := range u.Interests {
+		if utf8.RuneCountInString(tag) > MaxInterestLength {
+			return fmt.Errorf("interest %q is longer than %d chars", tag, MaxInterestLength)
+		}
 	}
-
-	return &user, nil
-}
-
-func HashPassword(pass string) string {
-	hash := md5.New()
-	hash.Write([]byte(pass))
-	return hex.EncodeToString(hash.Sum(nil))
+	return nil
 }
 
 func getGender(str string) (GenderType, error) {
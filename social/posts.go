@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	"net/http"
+	"time"
+)
+
+const (
+	feedSize          = 100
+	feedTTL           = time.Minute * 10
+	userPagePostLimit = 20
+	postTimeFormat    = "2006-01-02 15:04"
+)
+
+func (app *App) feedHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(app.checkAuthedAndRedirect(false, "/login"))
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		app.renderFeed(r.Context(), w, GetUser(r.Context()), &templates.FeedInfo{})
+	})
+	return router
+}
+
+func (app *App) postsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(app.checkAuthedAndRedirect(false, "/login"))
+	router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		user := GetUser(r.Context())
+		text := r.Form.Get("Text")
+		post, err := model.NewPost(user, text)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			app.renderFeed(r.Context(), w, user, &templates.FeedInfo{Err: err.Error(), Text: text})
+			return
+		}
+		if err := app.feed.Publish(r.Context(), post); err != nil {
+			app.log(r.Context()).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to publish post")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		app.log(r.Context()).Info().Str("userID", user.ID.String()).Str("postID", post.ID.String()).Msg("post published")
+		redirect(w, r, "/feed")
+	})
+	return router
+}
+
+func (app *App) renderFeed(ctx context.Context, w http.ResponseWriter, user *model.User, info *templates.FeedInfo) {
+	posts, err := app.feed.Get(ctx, user.ID)
+	if err != nil {
+		app.log(ctx).Error().Err(err).Str("userID", user.ID.String()).Msg("failed to get feed")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info.Posts = toPostInfos(posts)
+	if err := app.Templates.Feed.Execute(w, info); err != nil {
+		app.log(ctx).Error().Err(err).Msg("failed to render feed page")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func toPostInfos(posts []*model.Post) []templates.PostInfo {
+	infos := make([]templates.PostInfo, 0, len(posts))
+	for _, p := range posts {
+		infos = append(infos, templates.PostInfo{
+			Author:    p.Author,
+			Text:      p.Text,
+			CreatedAt: p.CreatedAt.Format(postTimeFormat),
+		})
+	}
+	return infos
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	"net/http"
+)
+
+// profileHandler is mounted into /me, so only authed users get here
+func (app *App) profileHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r.Context())
+		app.renderProfile(w, user.ToProfileInfo())
+	})
+	router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := templates.NewProfileInfo(r.Form)
+		user := GetUser(r.Context())
+		if err := user.UpdateProfile(info); err != nil {
+			info.Err = err.Error()
+			info.CurrentPassword, info.NewPassword = "", ""
+			if err == model.ErrWrongPassword {
+				w.WriteHeader(http.StatusForbidden)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			app.renderProfile(w, info)
+			return
+		}
+		if err := app.storage.UpdateUser(r.Context(), user); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to update user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		app.log(r.Context()).Info().Str("userID", user.ID.String()).Msg("profile updated")
+
+		if info.NewPassword != "" {
+			// somebody else may know the old password, so logging out everywhere except here
+			if err := app.storage.DeleteAllTokens(r.Context(), user.ID, GetToken(r.Context())); err != nil {
+				app.log(r.Context()).Error().Err(err).Msg("failed to revoke sessions after password change")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			app.log(r.Context()).Info().Str("userID", user.ID.String()).Msg("password changed, other sessions revoked")
+		}
+		redirect(w, r, "/me")
+	})
+	return router
+}
+
+func (app *App) renderProfile(w http.ResponseWriter, info *templates.ProfileInfo) {
+	if err := app.Templates.Profile.Execute(w, info); err != nil {
+		app.logger.Error().Err(err).Msg("failed to render profile page")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
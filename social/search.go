@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	"net/http"
+	"strings"
+)
+
+func (app *App) searchHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse url")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := templates.SearchInfo{
+			First:  strings.TrimSpace(r.Form.Get("first")),
+			Last:   strings.TrimSpace(r.Form.Get("last")),
+			Cursor: r.Form.Get("after"),
+		}
+		// a prefix of either name is a range of the index starting with that name,
+		// searching without any prefix would read every user
+		if info.First != "" || info.Last != "" {
+			users, next, err := app.storage.SearchUsers(r.Context(), info.First, info.Last, storage.Cursor(info.Cursor), app.config.PageSize)
+			if err == storage.ErrInvalidCursor {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				app.log(r.Context()).Error().Err(err).Msg("failed to search users")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			info.HasNext = next != ""
+			info.NextCursor = string(next)
+			info.Results = toSearchResults(users)
+		}
+		if err := app.Templates.Search.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render search page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	return router
+}
+
+func toSearchResults(users []*model.User) []templates.SearchResult {
+	results := make([]templates.SearchResult, 0, len(users))
+	for _, u := range users {
+		results = append(results, templates.SearchResult{
+			Username:  u.Username,
+			FirstName: u.FirstName,
+			LastName:  u.LastName,
+		})
+	}
+	return results
+}
@@ -0,0 +1,156 @@
+// Package seed generates realistic users for load testing: Russian names, cities weighted by population,
+// normally distributed ages and interests picked by popularity.
+package seed
+
+import (
+	"fmt"
+	"github.com/chocosin/otus-hl/social/model"
+	uuid "github.com/satori/go.uuid"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+var maleFirstNames = []string{
+	"Alexander", "Dmitry", "Maxim", "Sergey", "Andrey", "Alexey", "Artem", "Ilya", "Kirill", "Mikhail",
+	"Nikita", "Matvey", "Roman", "Egor", "Arseny", "Ivan", "Denis", "Evgeny", "Daniil", "Timofey",
+	"Vladislav", "Igor", "Vladimir", "Pavel", "Ruslan", "Mark", "Konstantin", "Timur", "Oleg", "Yaroslav",
+	"Anton", "Nikolay", "Gleb", "Vadim", "Stepan", "Yury", "Bogdan", "Artur", "Semyon", "Makar",
+	"Lev", "Viktor", "Grigory", "Georgy", "Fedor", "Boris", "Leonid", "Vasily", "Petr", "Valery",
+}
+
+var femaleFirstNames = []string{
+	"Anastasia", "Maria", "Anna", "Victoria", "Ekaterina", "Natalia", "Marina", "Polina", "Sofia", "Darya",
+	"Alisa", "Ksenia", "Alexandra", "Elena", "Olga", "Irina", "Tatiana", "Yulia", "Svetlana", "Valeria",
+	"Veronika", "Arina", "Elizaveta", "Kristina", "Alina", "Yana", "Vera", "Lyudmila", "Galina", "Nadezhda",
+	"Larisa", "Margarita", "Diana", "Milana", "Ulyana", "Evgenia", "Oksana", "Varvara", "Eva", "Zlata",
+}
+
+// lastNames are male forms, female forms end with "a"
+var lastNames = []string{
+	"Ivanov", "Smirnov", "Kuznetsov", "Popov", "Vasiliev", "Petrov", "Sokolov", "Mikhailov", "Novikov", "Fedorov",
+	"Morozov", "Volkov", "Alekseev", "Lebedev", "Semenov", "Egorov", "Pavlov", "Kozlov", "Stepanov", "Nikolaev",
+	"Orlov", "Andreev", "Makarov", "Nikitin", "Zakharov", "Zaitsev", "Soloviev", "Borisov", "Yakovlev", "Grigoriev",
+	"Romanov", "Vorobiev", "Sergeev", "Kuzmin", "Frolov", "Alexandrov", "Dmitriev", "Korolev", "Gusev", "Kiselev",
+	"Ilyin", "Maximov", "Polyakov", "Sorokin", "Vinogradov", "Kovalev", "Belov", "Medvedev", "Antonov", "Tarasov",
+}
+
+// cities are weighted by population in thousands, so a few cities have most of the users
+var cities = []struct {
+	name   string
+	weight int
+}{
+	{"Moscow", 12600}, {"Saint Petersburg", 5400}, {"Novosibirsk", 1620}, {"Yekaterinburg", 1490},
+	{"Kazan", 1250}, {"Nizhny Novgorod", 1250}, {"Chelyabinsk", 1200}, {"Samara", 1150},
+	{"Omsk", 1150}, {"Rostov-on-Don", 1130}, {"Ufa", 1130}, {"Krasnoyarsk", 1090},
+	{"Voronezh", 1050}, {"Perm", 1050}, {"Volgograd", 1010}, {"Krasnodar", 930},
+	{"Saratov", 840}, {"Tyumen", 800}, {"Tolyatti", 700}, {"Izhevsk", 650},
+	{"Barnaul", 630}, {"Ulyanovsk", 620}, {"Irkutsk", 620}, {"Khabarovsk", 620},
+	{"Yaroslavl", 600}, {"Vladivostok", 600}, {"Makhachkala", 600}, {"Tomsk", 570},
+	{"Orenburg", 560}, {"Kemerovo", 550}, {"Kaliningrad", 490}, {"Murmansk", 290},
+}
+
+// interests are ordered by popularity, they are picked with zipf distribution
+var interests = []string{
+	"music", "movies", "travel", "books", "sports", "cooking", "photography", "games", "art", "fitness",
+	"football", "programming", "hiking", "cars", "fashion", "dancing", "yoga", "science", "history", "cycling",
+	"running", "swimming", "chess", "theater", "anime", "gardening", "fishing", "hockey", "skiing", "coffee",
+	"wine", "painting", "guitar", "languages", "startups", "investing", "psychology", "astronomy", "board games", "crafts",
+	"climbing", "surfing", "volunteering", "pets", "poetry", "jazz", "rock", "electronic music", "podcasts", "design",
+}
+
+// createdSpread is how far in the past seeded users are registered
+const createdSpread = time.Hour * 24 * 365 * 2
+
+// Generator makes users for load testing, it is not safe for concurrent use
+type Generator struct {
+	rnd          *rand.Rand
+	interests    *rand.Zipf
+	cityWeights  []int
+	passwordHash string
+	// tag makes usernames of different seed runs differ
+	tag string
+	now time.Time
+}
+
+// NewGenerator makes a generator, the same seed gives the same profiles.
+// Usernames end with tag and a sequence number, passwordHash is shared by all users.
+func NewGenerator(seed int64, tag, passwordHash string) *Generator {
+	rnd := rand.New(rand.NewSource(seed))
+	g := &Generator{
+		rnd:          rnd,
+		interests:    rand.NewZipf(rnd, 1.1, 2, uint64(len(interests)-1)),
+		passwordHash: passwordHash,
+		tag:          tag,
+		now:          time.Now().UTC(),
+	}
+	total := 0
+	for _, city := range cities {
+		total += city.weight
+		g.cityWeights = append(g.cityWeights, total)
+	}
+	return g
+}
+
+// User makes a user, seq should be unique among users with the same tag
+func (g *Generator) User(seq int64) *model.User {
+	user := &model.User{
+		ID:           uuid.NewV1(),
+		PasswordHash: g.passwordHash,
+		Age:          g.age(),
+		City:         g.city(),
+		Interests:    g.pickInterests(),
+		// mysql keeps microseconds
+		CreatedAt: g.now.Add(-time.Duration(g.rnd.Int63n(int64(createdSpread)))).Truncate(time.Microsecond),
+	}
+	lastName := lastNames[g.rnd.Intn(len(lastNames))]
+	switch n := g.rnd.Intn(100); {
+	case n < 48:
+		user.Gender, user.FirstName, user.LastName = model.Male, maleFirstNames[g.rnd.Intn(len(maleFirstNames))], lastName
+	case n < 96:
+		user.Gender, user.FirstName, user.LastName = model.Female, femaleFirstNames[g.rnd.Intn(len(femaleFirstNames))], lastName+"a"
+	default:
+		names := maleFirstNames
+		if g.rnd.Intn(2) == 0 {
+			names = femaleFirstNames
+		}
+		user.Gender, user.FirstName, user.LastName = model.Other, names[g.rnd.Intn(len(names))], lastName
+	}
+	user.Username = fmt.Sprintf("%s_%s_%s%d",
+		strings.ToLower(user.FirstName), strings.ToLower(user.LastName), g.tag, seq)
+	return user
+}
+
+// age is normally distributed around 32, users are at least 14
+func (g *Generator) age() int {
+	age := int(g.rnd.NormFloat64()*11 + 32)
+	if age < 14 {
+		return 14
+	}
+	if age > 90 {
+		return 90
+	}
+	return age
+}
+
+func (g *Generator) city() string {
+	n := g.rnd.Intn(g.cityWeights[len(g.cityWeights)-1])
+	return cities[sort.SearchInts(g.cityWeights, n+1)].name
+}
+
+// pickInterests picks up to 6 distinct interests, some users have none
+func (g *Generator) pickInterests() []string {
+	count := g.rnd.Intn(7)
+	picked := make([]string, 0, count)
+	seen := make(map[uint64]bool, count)
+	for len(picked) < count {
+		idx := g.interests.Uint64()
+		if seen[idx] {
+			continue
+		}
+		seen[idx] = true
+		picked = append(picked, interests[idx])
+	}
+	return picked
+}
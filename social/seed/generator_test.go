@@ -0,0 +1,37 @@
+package seed
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/templates"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestGeneratedUsersAreValid(t *testing.T) {
+	gen := NewGenerator(1, "t_", "hash")
+	// users are validated as on signup, which hashes the password, so there are few of them
+	for seq := int64(0); seq < 30; seq++ {
+		user := gen.User(seq)
+		_, err := model.NewUserFromSignup(&templates.SignupInfo{
+			Username:  user.Username,
+			Password:  "password",
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Age:       strconv.Itoa(user.Age),
+			Gender:    user.Gender,
+			City:      user.City,
+			Interests: user.JoinInterests(),
+		})
+		if err != nil {
+			t.Fatalf("generated user %+v is invalid: %v", user, err)
+		}
+	}
+
+	// the same seed generates the same profiles
+	first, second := NewGenerator(7, "t_", "hash").User(1), NewGenerator(7, "t_", "hash").User(1)
+	second.ID, second.CreatedAt = first.ID, first.CreatedAt
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected the same users, got %+v and %+v", first, second)
+	}
+}
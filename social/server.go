@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/storage"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+func (app *App) newServer() *http.Server {
+	cfg := app.config.Server
+	return &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      app.router(),
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
+	}
+}
+
+// serve runs background jobs and serves requests until ctx is done,
+// then drains in-flight requests within the shutdown timeout and waits for the jobs to stop
+func (app *App) serve(ctx context.Context, server *http.Server, listener net.Listener) error {
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+	jobs.Add(2)
+	go func() {
+		defer jobs.Done()
+		app.purgeExpiredTokens(jobsCtx, tokensPurgeInterval)
+	}()
+	go func() {
+		defer jobs.Done()
+		app.countActiveSessions(jobsCtx, activeSessionsInterval)
+	}()
+	defer func() {
+		stopJobs()
+		jobs.Wait()
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	app.logger.Info().Msg("shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.config.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// signalContext is done on SIGINT or SIGTERM
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+// closeStorage closes storages holding connections, in-memory ones have nothing to close
+func (app *App) closeStorage() {
+	for _, s := range []interface{}{app.messages, app.storage} {
+		closer, ok := storage.Unwrap(s).(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			app.logger.Error().Err(err).Msg("failed to close storage")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/templates"
+	"github.com/go-chi/chi"
+	uuid "github.com/satori/go.uuid"
+	"net/http"
+)
+
+const sessionTimeFormat = "2006-01-02 15:04:05 MST"
+
+// sessionsHandler is mounted into /me, so only authed users get here
+func (app *App) sessionsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r.Context())
+		current := GetToken(r.Context())
+		sessions, err := app.storage.ListTokens(r.Context(), user.ID)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to list sessions")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := templates.SessionsInfo{
+			Sessions: make([]templates.SessionInfo, 0, len(sessions)),
+		}
+		for _, s := range sessions {
+			info.Sessions = append(info.Sessions, templates.SessionInfo{
+				ID:         s.ID(),
+				UserAgent:  s.UserAgent,
+				IP:         s.IP,
+				CreatedAt:  s.CreatedAt.Format(sessionTimeFormat),
+				LastSeenAt: s.LastSeenAt.Format(sessionTimeFormat),
+				Current:    uuid.Equal(s.Token, current),
+			})
+		}
+		if err := app.Templates.Sessions.Execute(w, &info); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to render sessions page")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	router.Post("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to parse form")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		user := GetUser(r.Context())
+		// looking for the session among user's own ones, so nobody can revoke sessions of others
+		sessions, err := app.storage.ListTokens(r.Context(), user.ID)
+		if err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to list sessions")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		session := findSession(sessions, r.Form.Get("ID"))
+		if session == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("session not found"))
+			return
+		}
+		if err := app.storage.DeleteToken(r.Context(), session.Token); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to revoke session")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		app.log(r.Context()).Info().Str("userID", user.ID.String()).
+			Str("session", session.ID()).
+			Msg("session revoked")
+		if uuid.Equal(session.Token, GetToken(r.Context())) {
+			app.removeAuthCookie(w)
+			redirect(w, r, "/")
+			return
+		}
+		redirect(w, r, "/me/sessions")
+	})
+	router.Post("/revoke-others", func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r.Context())
+		if err := app.storage.DeleteAllTokens(r.Context(), user.ID, GetToken(r.Context())); err != nil {
+			app.log(r.Context()).Error().Err(err).Msg("failed to revoke other sessions")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		app.log(r.Context()).Info().Str("userID", user.ID.String()).Msg("all other sessions revoked")
+		redirect(w, r, "/me/sessions")
+	})
+	return router
+}
+
+func findSession(sessions []*model.Session, id string) *model.Session {
+	for _, s := range sessions {
+		if s.ID() == id {
+			return s
+		}
+	}
+	return nil
+}
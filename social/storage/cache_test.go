@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	uuid "github.com/satori/go.uuid"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(2)
+	c.Set(ctx, "a", []byte("1"), time.Minute)
+	c.Set(ctx, "b", []byte("2"), time.Minute)
+	// a becomes the recently used one
+	if value, ok, _ := c.Get(ctx, "a"); !ok || string(value) != "1" {
+		t.Fatalf("expected a to be cached, got %q", value)
+	}
+	c.Set(ctx, "c", []byte("3"), time.Minute)
+
+	if _, ok, _ := c.Get(ctx, "b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok, _ := c.Get(ctx, key); !ok {
+			t.Fatalf("%s shouldn't have been evicted", key)
+		}
+	}
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", c.Len())
+	}
+}
+
+func TestLRUCacheExpiresEntries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := NewLRUCache(10)
+	c.now = func() time.Time { return now }
+	c.Set(ctx, "short", []byte("1"), time.Second)
+	c.Set(ctx, "long", []byte("2"), time.Minute)
+
+	now = now.Add(time.Second)
+	if _, ok, _ := c.Get(ctx, "short"); ok {
+		t.Fatal("short should have expired")
+	}
+	if _, ok, _ := c.Get(ctx, "long"); !ok {
+		t.Fatal("long shouldn't have expired")
+	}
+	c.Delete(ctx, "long", "missing")
+	if c.Len() != 0 {
+		t.Fatalf("expected no entries, got %d", c.Len())
+	}
+}
+
+// countingStorage counts finding users and listing similar ones, the first find waits for release after reading the user if it's set,
+// so that the user may be changed while being loaded
+type countingStorage struct {
+	Storage
+	finds   int64
+	similar int64
+	release chan struct{}
+}
+
+func (s *countingStorage) SimilarUsers(ctx context.Context, userID uuid.UUID, limit int) ([]*model.User, error) {
+	atomic.AddInt64(&s.similar, 1)
+	return s.Storage.SimilarUsers(ctx, userID, limit)
+}
+
+func (s *countingStorage) FindUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	user, err := s.Storage.FindUserByUsername(ctx, username)
+	if atomic.AddInt64(&s.finds, 1) == 1 && s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return user, err
+}
+
+func waitForFinds(s *countingStorage, finds int64) {
+	for atomic.LoadInt64(&s.finds) < finds {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// laggingStorage finds users as they were when added to stale, like a lagging replica
+type laggingStorage struct {
+	Storage
+	stale map[string]*model.User
+}
+
+func (s *laggingStorage) FindUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	if user, ok := s.stale[username]; ok {
+		return copyUser(user), nil
+	}
+	return s.Storage.FindUserByUsername(ctx, username)
+}
+
+func cacheRequestsCount(kind, result string) float64 {
+	return testutil.ToFloat64(cacheRequests.WithLabelValues(kind, result))
+}
+
+func TestCachedStorageInvalidatesUsers(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: NewMemoryStorage()}
+	s := NewCachedStorage(inner, NewLRUCache(100), time.Minute)
+	user := randomUser()
+	if err := s.InsertUser(ctx, user); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	session := model.NewSession(user.ID, "test-agent", "127.0.0.1", time.Hour)
+	if err := s.InsertToken(ctx, session); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+
+	hits, misses := cacheRequestsCount("username", "hit"), cacheRequestsCount("username", "miss")
+	for idx := 0; idx < 3; idx++ {
+		found, err := s.FindUserByUsername(ctx, user.Username)
+		if err != nil || found == nil || found.FirstName != user.FirstName {
+			t.Fatalf("expected the user, got %+v, %v", found, err)
+		}
+		// callers may change returned users
+		found.FirstName = "changed"
+	}
+	if inner.finds != 1 || cacheRequestsCount("username", "hit")-hits != 2 ||
+		cacheRequestsCount("username", "miss")-misses != 1 {
+		t.Fatalf("expected 1 miss and 2 hits, the storage was called %d times", inner.finds)
+	}
+	if _, err := s.GetUserByToken(ctx, session.Token); err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+
+	user.LastName = "updated"
+	if err := s.UpdateUser(ctx, user); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	for _, get := range []func() (*model.User, error){
+		func() (*model.User, error) { return s.FindUserByUsername(ctx, user.Username) },
+		func() (*model.User, error) { return s.GetUserByToken(ctx, session.Token) },
+	} {
+		found, err := get()
+		if err != nil || found == nil || found.LastName != "updated" {
+			t.Fatalf("expected the updated user, got %+v, %v", found, err)
+		}
+	}
+
+	if err := s.DeleteToken(ctx, session.Token); err != nil {
+		t.Fatalf("error deleting token: %v", err)
+	}
+	if found, err := s.GetUserByToken(ctx, session.Token); err != nil || found != nil {
+		t.Fatalf("deleted token shouldn't be found, got %+v, %v", found, err)
+	}
+	if err := s.DeleteUser(ctx, user.ID, time.Now()); err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+	if found, err := s.FindUserByUsername(ctx, user.Username); err != nil || found != nil {
+		t.Fatalf("deleted user shouldn't be found, got %+v, %v", found, err)
+	}
+}
+
+func TestCachedStorageLoadsUserOnce(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: NewMemoryStorage(), release: make(chan struct{})}
+	s := NewCachedStorage(inner, NewLRUCache(100), time.Minute)
+	user := randomUser()
+	if err := inner.Storage.InsertUser(ctx, user); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	const callers = 10
+	misses := cacheRequestsCount("username", "miss")
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for idx := 0; idx < callers; idx++ {
+		go func() {
+			defer wg.Done()
+			if found, err := s.FindUserByUsername(ctx, user.Username); err != nil || found == nil {
+				t.Errorf("expected the user, got %+v, %v", found, err)
+			}
+		}()
+	}
+	// all callers miss the cache and wait for the first one to load the user
+	for cacheRequestsCount("username", "miss")-misses < callers {
+		time.Sleep(time.Millisecond)
+	}
+	waitForFinds(inner, 1)
+	time.Sleep(time.Millisecond * 10)
+	close(inner.release)
+	wg.Wait()
+	if inner.finds != 1 {
+		t.Fatalf("expected the user to be loaded once, loaded %d times", inner.finds)
+	}
+}
+
+func TestCanceledCallerDoesntFailSharedLoad(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: NewMemoryStorage(), release: make(chan struct{})}
+	s := NewCachedStorage(inner, NewLRUCache(100), time.Minute)
+	user := randomUser()
+	if err := inner.Storage.InsertUser(ctx, user); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	misses := cacheRequestsCount("username", "miss")
+	canceled, cancel := context.WithCancel(ctx)
+	canceledErr := make(chan error)
+	go func() {
+		_, err := s.FindUserByUsername(canceled, user.Username)
+		canceledErr <- err
+	}()
+	waitForFinds(inner, 1)
+	found := make(chan *model.User)
+	go func() {
+		user, err := s.FindUserByUsername(ctx, user.Username)
+		if err != nil {
+			t.Errorf("error finding by username: %v", err)
+		}
+		found <- user
+	}()
+	for cacheRequestsCount("username", "miss")-misses < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	// the caller which started the load goes away, the other one still waits for it
+	cancel()
+	if err := <-canceledErr; err != context.Canceled {
+		t.Fatalf("canceled caller should stop waiting, got %v", err)
+	}
+	close(inner.release)
+	if user := <-found; user == nil {
+		t.Fatal("expected the user to be found")
+	}
+	if inner.finds != 1 {
+		t.Fatalf("expected the user to be loaded once, loaded %d times", inner.finds)
+	}
+}
+
+func TestUserChangedWhileLoadingIsntCached(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: NewMemoryStorage(), release: make(chan struct{})}
+	s := NewCachedStorage(inner, NewLRUCache(100), time.Minute)
+	user := randomUser()
+	if err := inner.Storage.InsertUser(ctx, user); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		if _, err := s.FindUserByUsername(ctx, user.Username); err != nil {
+			t.Errorf("error finding by username: %v", err)
+		}
+	}()
+	// the old user has been read, and is updated before the load is over
+	waitForFinds(inner, 1)
+	user.LastName = "updated"
+	if err := s.UpdateUser(ctx, user); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	close(inner.release)
+	<-loaded
+
+	found, err := s.FindUserByUsername(ctx, user.Username)
+	if err != nil || found == nil || found.LastName != "updated" {
+		t.Fatalf("the old user shouldn't have been cached, got %+v, %v", found, err)
+	}
+
+	// filling the cache with the user loaded before invalidation is skipped
+	cached := s.(*cachedStorage)
+	version := cached.invalidations.version()
+	if err := s.UpdatePasswordHash(ctx, user.ID, "new-hash"); err != nil {
+		t.Fatalf("error updating password hash: %v", err)
+	}
+	cached.fill(ctx, version, usernameKey(user.Username), user, time.Time{})
+	if _, ok, _ := cached.cache.Get(ctx, userKey(user.ID)); ok {
+		t.Fatal("user loaded before invalidation shouldn't have been cached")
+	}
+}
+
+func TestTokenIsCachedUntilItExpires(t *testing.T) {
+	ctx := context.Background()
+	s := NewCachedStorage(NewMemoryStorage(), NewLRUCache(100), time.Minute)
+	user := randomUser()
+	if err := s.InsertUser(ctx, user); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	session := model.NewSession(user.ID, "test-agent", "127.0.0.1", time.Hour)
+	session.ExpiresAt = time.Now().Add(time.Millisecond * 200)
+	if err := s.InsertToken(ctx, session); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+
+	hits := cacheRequestsCount("token", "hit")
+	for idx := 0; idx < 2; idx++ {
+		if found, err := s.GetUserByToken(ctx, session.Token); err != nil || found == nil {
+			t.Fatalf("expected the user, got %+v, %v", found, err)
+		}
+	}
+	if cacheRequestsCount("token", "hit")-hits != 1 {
+		t.Fatal("token should have been cached")
+	}
+	time.Sleep(time.Until(session.ExpiresAt))
+	if found, err := s.GetUserByToken(ctx, session.Token); err != nil || found != nil {
+		t.Fatalf("expired token shouldn't be found, got %+v, %v", found, err)
+	}
+}
+
+func TestChangedUserIsReloadedFromPrimary(t *testing.T) {
+	ctx := context.Background()
+	inner := &laggingStorage{Storage: NewMemoryStorage(), stale: make(map[string]*model.User)}
+	s := NewCachedStorage(inner, NewLRUCache(100), time.Minute)
+	user := randomUser()
+	if err := s.InsertUser(ctx, user); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	// the replica hasn't got the update yet
+	inner.stale[user.Username] = copyUser(user)
+	user.LastName = "updated"
+	if err := s.UpdateUser(ctx, user); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	for idx := 0; idx < 2; idx++ {
+		found, err := s.FindUserByUsername(ctx, user.Username)
+		if err != nil || found == nil || found.LastName != "updated" {
+			t.Fatalf("expected the updated user, got %+v, %v", found, err)
+		}
+	}
+}
+
+func TestCachedStorageListsSimilarUsersOnce(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: NewMemoryStorage()}
+	s := NewCachedStorage(inner, NewLRUCache(100), time.Minute)
+	me, other := randomUser(), randomUser()
+	for _, u := range []*model.User{me, other} {
+		if err := s.InsertUser(ctx, u); err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		similar, err := s.SimilarUsers(ctx, me.ID, 5)
+		if err != nil {
+			t.Fatalf("error listing similar users: %v", err)
+		}
+		if len(similar) != 1 || similar[0].ID != other.ID {
+			t.Fatalf("expected the other user to be similar, got %+v", similar)
+		}
+	}
+	if inner.similar != 1 {
+		t.Fatalf("expected similar users to be listed once, listed %d times", inner.similar)
+	}
+	// a different limit is a different list
+	if _, err := s.SimilarUsers(ctx, me.ID, 1); err != nil {
+		t.Fatalf("error listing similar users: %v", err)
+	}
+	if inner.similar != 2 {
+		t.Fatalf("expected similar users to be listed twice, listed %d times", inner.similar)
+	}
+}
+
+func TestCachedStorageIsUnwrapped(t *testing.T) {
+	inner := NewMemoryStorage()
+	s := NewTracedStorage(NewCachedStorage(inner, NewLRUCache(1), time.Minute))
+	if Unwrap(s) != inner {
+		t.Fatal("expected the memory storage under decorators")
+	}
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+var cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "social",
+	Subsystem: "storage_cache",
+	Name:      "requests_total",
+	Help:      "Number of cached lookups by kind: token, username or similar, and result: hit, miss or error of the cache.",
+}, []string{"kind", "result"})
+
+func init() {
+	prometheus.MustRegister(cacheRequests)
+}
+
+// cachedStorage reads users by tokens and usernames through the cache.
+// Tokens and usernames are cached as user ids pointing to a single entry of the user,
+// so changing the user by id invalidates every way to find them.
+type cachedStorage struct {
+	Storage
+	cache         Cache
+	ttl           time.Duration
+	flights       flightGroup
+	invalidations *invalidations
+}
+
+// cacheLoadTimeout limits loads shared by concurrent callers, they aren't canceled with the callers
+const cacheLoadTimeout = time.Second * 5
+
+// NewCachedStorage caches users returned by GetUserByToken, FindUserByUsername and SimilarUsers for ttl,
+// tokens are cached no longer than until they expire. Writes through the storage invalidate the cache,
+// others, e.g. changes by another instance not sharing the cache, are seen after ttl at most.
+// Missing users aren't cached.
+func NewCachedStorage(s Storage, cache Cache, ttl time.Duration) Storage {
+	return &cachedStorage{Storage: s, cache: cache, ttl: ttl, invalidations: newInvalidations(ttl)}
+}
+
+func (c *cachedStorage) unwrap() interface{} {
+	return c.Storage
+}
+
+func tokenKey(token uuid.UUID) string {
+	return "token:" + token.String()
+}
+
+func usernameKey(username string) string {
+	return "username:" + username
+}
+
+func userKey(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
+
+func similarKey(userID uuid.UUID, limit int) string {
+	return fmt.Sprintf("similar:%s:%d", userID, limit)
+}
+
+// GetUserByToken caches the token until it expires, the expiration is looked up in sessions of the user.
+// A token not listed yet, e.g. by a lagging replica, isn't cached.
+func (c *cachedStorage) GetUserByToken(ctx context.Context, token uuid.UUID) (*model.User, error) {
+	return c.getUser(ctx, "token", tokenKey(token), func(ctx context.Context) (*model.User, time.Time, error) {
+		user, err := c.Storage.GetUserByToken(ctx, token)
+		if err != nil || user == nil {
+			return user, time.Time{}, err
+		}
+		sessions, err := c.Storage.ListTokens(ctx, user.ID)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		for _, session := range sessions {
+			if session.Token == token {
+				return user, session.ExpiresAt, nil
+			}
+		}
+		return user, time.Now(), nil
+	})
+}
+
+func (c *cachedStorage) FindUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	return c.getUser(ctx, "username", usernameKey(username), func(ctx context.Context) (*model.User, time.Time, error) {
+		user, err := c.Storage.FindUserByUsername(ctx, username)
+		return user, time.Time{}, err
+	})
+}
+
+// SimilarUsers are cached as they are, so they aren't queried on every view of the profile.
+// They aren't invalidated, changes of interests and of the users shown are seen after ttl.
+func (c *cachedStorage) SimilarUsers(ctx context.Context, userID uuid.UUID, limit int) ([]*model.User, error) {
+	key := similarKey(userID, limit)
+	data, ok, err := c.cache.Get(ctx, key)
+	var users []*model.User
+	switch {
+	case err != nil:
+		cacheRequests.WithLabelValues("similar", "error").Inc()
+	case ok && json.Unmarshal(data, &users) == nil:
+		cacheRequests.WithLabelValues("similar", "hit").Inc()
+		return users, nil
+	default:
+		cacheRequests.WithLabelValues("similar", "miss").Inc()
+	}
+	users, err = c.Storage.SimilarUsers(ctx, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	if data, err := json.Marshal(users); err == nil {
+		c.cache.Set(ctx, key, data, c.ttl)
+	}
+	return users, nil
+}
+
+// getUser returns the cached user or loads it once for all concurrent callers.
+// Load returns when the key stops pointing to the user, zero time if it's cached for ttl.
+func (c *cachedStorage) getUser(ctx context.Context, kind, key string,
+	load func(ctx context.Context) (*model.User, time.Time, error)) (*model.User, error) {
+	user, err := c.cachedUser(ctx, key)
+	switch {
+	case err != nil:
+		// the cache being unavailable shouldn't fail requests which the storage is able to serve
+		cacheRequests.WithLabelValues(kind, "error").Inc()
+	case user != nil:
+		cacheRequests.WithLabelValues(kind, "hit").Inc()
+		return user, nil
+	default:
+		cacheRequests.WithLabelValues(kind, "miss").Inc()
+	}
+	return c.flights.do(ctx, key, func(ctx context.Context) (*model.User, error) {
+		version := c.invalidations.version()
+		user, expiresAt, err := load(ctx)
+		if err != nil || user == nil {
+			return user, err
+		}
+		if c.invalidations.recent(userKey(user.ID)) {
+			// the user has just been changed, a lagging replica might have returned the old one
+			version = c.invalidations.version()
+			fresh, err := c.Storage.FindUserForLogin(ctx, user.Username)
+			if err != nil || fresh == nil || fresh.ID != user.ID {
+				return nil, err
+			}
+			user = fresh
+		}
+		// a recently deleted token might still be found on a replica, so it isn't cached
+		if !c.invalidations.recent(key) {
+			c.fill(ctx, version, key, user, expiresAt)
+		}
+		return user, nil
+	})
+}
+
+func (c *cachedStorage) cachedUser(ctx context.Context, key string) (*model.User, error) {
+	id, ok, err := c.cache.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	userID, err := uuid.FromString(string(id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cached user id of %s", key)
+	}
+	data, ok, err := c.cache.Get(ctx, userKey(userID))
+	if err != nil || !ok {
+		return nil, err
+	}
+	var user model.User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, errors.Wrapf(err, "invalid cached %s", userKey(userID))
+	}
+	return &user, nil
+}
+
+// fill caches the user found by key unless it has been invalidated since version, when loading has started.
+// The key is cached until expiresAt if it comes before ttl. Failures are ignored as the next lookup
+// just loads the user again.
+func (c *cachedStorage) fill(ctx context.Context, version uint64, key string, user *model.User, expiresAt time.Time) {
+	keyTTL := c.ttl
+	if !expiresAt.IsZero() {
+		if left := time.Until(expiresAt); left < keyTTL {
+			keyTTL = left
+		}
+	}
+	keys := []string{key, userKey(user.ID)}
+	if keyTTL <= 0 || c.invalidations.since(version, keys...) {
+		return
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		return
+	}
+	if err := c.cache.Set(ctx, userKey(user.ID), data, c.ttl); err != nil {
+		return
+	}
+	c.cache.Set(ctx, key, []byte(user.ID.String()), keyTTL)
+	// invalidation might have happened between the check and setting, then its delete might have come first
+	if c.invalidations.since(version, keys...) {
+		c.cache.Delete(ctx, keys...)
+	}
+}
+
+// invalidate is called after the storage is changed, the keys are recorded before deleting,
+// so that fill either sees the record or is followed by the delete
+func (c *cachedStorage) invalidate(ctx context.Context, keys ...string) error {
+	c.invalidations.add(keys...)
+	return errors.Wrap(c.cache.Delete(ctx, keys...), "failed to invalidate cache")
+}
+
+// InsertUser forgets the user previously registered with the same username. The username has been released
+// long after that user was deleted, so there is no need to record invalidation as replicas don't have the user.
+func (c *cachedStorage) InsertUser(ctx context.Context, user *model.User) error {
+	if err := c.Storage.InsertUser(ctx, user); err != nil {
+		return err
+	}
+	return errors.Wrap(c.cache.Delete(ctx, usernameKey(user.Username)), "failed to invalidate cache")
+}
+
+func (c *cachedStorage) UpdateUser(ctx context.Context, user *model.User) error {
+	if err := c.Storage.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, userKey(user.ID))
+}
+
+func (c *cachedStorage) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	if err := c.Storage.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, userKey(userID))
+}
+
+func (c *cachedStorage) DeleteUser(ctx context.Context, userID uuid.UUID, releaseAt time.Time) error {
+	if err := c.Storage.DeleteUser(ctx, userID, releaseAt); err != nil {
+		return err
+	}
+	// tokens point to the deleted user entry, so they aren't found either
+	return c.invalidate(ctx, userKey(userID))
+}
+
+func (c *cachedStorage) DeleteToken(ctx context.Context, id uuid.UUID) error {
+	if err := c.Storage.DeleteToken(ctx, id); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, tokenKey(id))
+}
+
+func (c *cachedStorage) DeleteAllTokens(ctx context.Context, userID uuid.UUID, except uuid.UUID) error {
+	// tokens are listed first, the deleted ones can't be listed
+	sessions, err := c.Storage.ListTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := c.Storage.DeleteAllTokens(ctx, userID, except); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		if session.Token != except {
+			keys = append(keys, tokenKey(session.Token))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.invalidate(ctx, keys...)
+}
+
+// flightGroup makes concurrent loads of the same key share a single call,
+// so that an expired popular entry doesn't send a stampede of queries to the storage
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	user *model.User
+	err  error
+}
+
+// do calls load unless it's already being called for the key, then its result is waited for.
+// load runs with the values of ctx, e.g. the trace, but isn't canceled with it, so that a caller
+// which has gone doesn't fail the others, each caller stops waiting when its ctx is done.
+// Every caller gets its own copy of the user.
+func (g *flightGroup) do(ctx context.Context, key string, load func(ctx context.Context) (*model.User, error)) (*model.User, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f, ok := g.calls[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		g.calls[key] = f
+		go g.load(detachedContext{ctx}, key, f, load)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.user == nil {
+		return nil, f.err
+	}
+	return copyUser(f.user), f.err
+}
+
+// load releases the waiters even if load panics, the panic is returned to them as an error
+func (g *flightGroup) load(ctx context.Context, key string, f *flight, load func(ctx context.Context) (*model.User, error)) {
+	ctx, cancel := context.WithTimeout(ctx, cacheLoadTimeout)
+	defer func() {
+		if p := recover(); p != nil {
+			f.user, f.err = nil, fmt.Errorf("panic loading %s: %v", key, p)
+		}
+		cancel()
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.user, f.err = load(ctx)
+}
+
+// Detach returns a context with values of ctx, e.g. the trace, but neither its deadline nor cancellation,
+// for work which should be finished even if the request that has started it goes away
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// invalidations remembers keys invalidated within ttl. Versions tell whether a key has been invalidated
+// while a user was being loaded, recency tells whether a replica might still have the old data.
+// It sees invalidations made by this instance only.
+type invalidations struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	now      func() time.Time
+	current  uint64
+	keys     map[string]invalidation
+	prunedAt time.Time
+}
+
+type invalidation struct {
+	version uint64
+	at      time.Time
+}
+
+func newInvalidations(ttl time.Duration) *invalidations {
+	return &invalidations{ttl: ttl, now: time.Now, keys: make(map[string]invalidation), prunedAt: time.Now()}
+}
+
+func (i *invalidations) version() uint64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.current
+}
+
+func (i *invalidations) add(keys ...string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := i.now()
+	i.current++
+	for _, key := range keys {
+		i.keys[key] = invalidation{version: i.current, at: now}
+	}
+	// records older than ttl are dropped at most once per ttl, so adding is amortized O(1)
+	if now.Sub(i.prunedAt) < i.ttl {
+		return
+	}
+	for key, inv := range i.keys {
+		if now.Sub(inv.at) >= i.ttl {
+			delete(i.keys, key)
+		}
+	}
+	i.prunedAt = now
+}
+
+// since returns whether any of the keys has been invalidated after the version
+func (i *invalidations) since(version uint64, keys ...string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, key := range keys {
+		if inv, ok := i.keys[key]; ok && inv.version > version {
+			return true
+		}
+	}
+	return false
+}
+
+// recent returns whether the key has been invalidated within ttl
+func (i *invalidations) recent(key string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	inv, ok := i.keys[key]
+	return ok && i.now().Sub(inv.at) < i.ttl
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/base64"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is an opaque position in a list ordered by (created_at, id).
+// Empty cursor is the beginning of the list, lists return empty next cursor after the last page.
+type Cursor string
+
+// the beginning of lists, mysql datetime doesn't support zero time
+var (
+	minCursorTime = time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxCursorTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+)
+
+func newCursor(createdAt time.Time, id string) Cursor {
+	raw := strconv.FormatInt(createdAt.UnixNano(), 10) + "|" + id
+	return Cursor(base64.RawURLEncoding.EncodeToString([]byte(raw)))
+}
+
+// position decodes the cursor, empty cursor points before the first item of ascending list,
+// or of descending one if desc is set
+func (c Cursor) position(desc bool) (time.Time, string, error) {
+	if c == "" {
+		if desc {
+			return maxCursorTime, "", nil
+		}
+		return minCursorTime, "", nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return time.Unix(0, nanos).UTC(), parts[1], nil
+}
+
+// cutUsersPage cuts users read with limit+1 to the page, next cursor is set if there are more users
+func cutUsersPage(users []*model.User, limit int) ([]*model.User, Cursor) {
+	if len(users) <= limit {
+		return users, ""
+	}
+	users = users[:limit]
+	last := users[len(users)-1]
+	return users, newCursor(last.CreatedAt, last.ID.String())
+}
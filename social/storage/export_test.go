@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"github.com/chocosin/otus-hl/social/model"
+	"testing"
+)
+
+// randomUser is storagetest.RandomUser set by SetRandomUser from storage_test.go,
+// storagetest imports the package, so its internal tests can't import storagetest
+var randomUser func() *model.User
+
+func SetRandomUser(fn func() *model.User) {
+	randomUser = fn
+}
+
+// MysqlTestStorages returns storages connected to the test database, shared by all tests.
+// The test is skipped if MySQL isn't configured.
+func MysqlTestStorages(t *testing.T) (*MysqlStorage, *MysqlMessageStorage) {
+	requireMysql(t)
+	return testStorage, testMessageStorage
+}
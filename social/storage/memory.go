@@ -0,0 +1,593 @@
+package storage
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type friendKey struct {
+	userID   uuid.UUID
+	friendID uuid.UUID
+}
+
+type friendRow struct {
+	status    string
+	createdAt time.Time
+}
+
+// MemoryStorage keeps everything in process memory with the same semantics as MysqlStorage,
+// it is meant for tests and local development
+type MemoryStorage struct {
+	mu sync.RWMutex
+
+	users       map[uuid.UUID]*model.User
+	byUsername  map[string]uuid.UUID
+	tokens      map[uuid.UUID]*model.Session
+	friendships map[friendKey]*friendRow
+	posts       []*model.Post
+	// tombstones keep usernames of deleted users until their release time
+	tombstones map[string]time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:       make(map[uuid.UUID]*model.User),
+		byUsername:  make(map[string]uuid.UUID),
+		tokens:      make(map[uuid.UUID]*model.Session),
+		friendships: make(map[friendKey]*friendRow),
+		tombstones:  make(map[string]time.Time),
+	}
+}
+
+func copyUser(u *model.User) *model.User {
+	result := *u
+	// like in mysql, user without interests has empty ones
+	result.Interests = make([]string, len(u.Interests))
+	copy(result.Interests, u.Interests)
+	return &result
+}
+
+func (m *MemoryStorage) LastUsernames(ctx context.Context, cursor Cursor, limit int) ([]string, Cursor, error) {
+	createdAt, id, err := cursor.position(true)
+	if err != nil {
+		return nil, "", err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := make([]*model.User, 0)
+	for _, u := range m.users {
+		if u.CreatedAt.Before(createdAt) || (u.CreatedAt.Equal(createdAt) && u.ID.String() < id) {
+			found = append(found, u)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return !userBefore(found[i], found[j])
+	})
+	page, next := cutUsersPage(found, limit)
+	usernames := make([]string, 0, len(page))
+	for _, u := range page {
+		usernames = append(usernames, u.Username)
+	}
+	return usernames, next, nil
+}
+
+// userBefore is the order of users in lists, by (created_at, id)
+func userBefore(a, b *model.User) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID.String() < b.ID.String()
+}
+
+func (m *MemoryStorage) InsertUser(ctx context.Context, user *model.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[user.ID]; ok {
+		return errors.New("failed to insert user: duplicate id")
+	}
+	m.users[user.ID] = copyUser(user)
+	m.byUsername[user.Username] = user.ID
+	return nil
+}
+
+func (m *MemoryStorage) UpdateUser(ctx context.Context, user *model.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[user.ID]
+	if !ok {
+		return nil
+	}
+	updated := copyUser(user)
+	// username and creation time can't be changed
+	updated.Username = stored.Username
+	updated.CreatedAt = stored.CreatedAt
+	m.users[user.ID] = updated
+	return nil
+}
+
+func (m *MemoryStorage) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[userID]; ok {
+		u.PasswordHash = passwordHash
+	}
+	return nil
+}
+
+func (m *MemoryStorage) FindUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id, ok := m.byUsername[username]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(m.users[id]), nil
+}
+
+func (m *MemoryStorage) FindUserForLogin(ctx context.Context, username string) (*model.User, error) {
+	return m.FindUserByUsername(ctx, username)
+}
+
+func (m *MemoryStorage) IsUsernameTaken(ctx context.Context, username string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.byUsername[username]; ok {
+		return true, nil
+	}
+	releaseAt, ok := m.tombstones[username]
+	return ok && releaseAt.After(time.Now()), nil
+}
+
+func (m *MemoryStorage) DeleteUser(ctx context.Context, userID uuid.UUID, releaseAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+	for token, session := range m.tokens {
+		if uuid.Equal(session.UserID, userID) {
+			delete(m.tokens, token)
+		}
+	}
+	for key := range m.friendships {
+		if uuid.Equal(key.userID, userID) || uuid.Equal(key.friendID, userID) {
+			delete(m.friendships, key)
+		}
+	}
+	posts := m.posts[:0]
+	for _, p := range m.posts {
+		if !uuid.Equal(p.AuthorID, userID) {
+			posts = append(posts, p)
+		}
+	}
+	m.posts = posts
+	delete(m.byUsername, user.Username)
+	delete(m.users, userID)
+	m.tombstones[user.Username] = releaseAt
+	return nil
+}
+
+func (m *MemoryStorage) SearchUsers(ctx context.Context, firstPrefix, lastPrefix string, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// like in mysql, names are compared case insensitive
+	firstPrefix, lastPrefix = strings.ToLower(firstPrefix), strings.ToLower(lastPrefix)
+	found := make([]*model.User, 0)
+	for _, u := range m.users {
+		if strings.HasPrefix(strings.ToLower(u.FirstName), firstPrefix) &&
+			strings.HasPrefix(strings.ToLower(u.LastName), lastPrefix) {
+			found = append(found, u)
+		}
+	}
+	return usersPage(found, cursor, limit)
+}
+
+// usersPage sorts users like mysql does and returns copies of the page after the cursor
+func usersPage(users []*model.User, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	createdAt, id, err := cursor.position(false)
+	if err != nil {
+		return nil, "", err
+	}
+	after := make([]*model.User, 0, len(users))
+	for _, u := range users {
+		if u.CreatedAt.After(createdAt) || (u.CreatedAt.Equal(createdAt) && u.ID.String() > id) {
+			after = append(after, u)
+		}
+	}
+	sort.Slice(after, func(i, j int) bool {
+		return userBefore(after[i], after[j])
+	})
+	page, next := cutUsersPage(after, limit)
+	return copyUsers(page), next, nil
+}
+
+func (m *MemoryStorage) UsersByInterest(ctx context.Context, tag string, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := make([]*model.User, 0)
+	for _, u := range m.users {
+		for _, interest := range u.Interests {
+			if interest == tag {
+				found = append(found, u)
+				break
+			}
+		}
+	}
+	return usersPage(found, cursor, limit)
+}
+
+func (m *MemoryStorage) UsersByCity(ctx context.Context, city string, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key := model.CityKey(city)
+	found := make([]*model.User, 0)
+	for _, u := range m.users {
+		if model.CityKey(u.City) == key {
+			found = append(found, u)
+		}
+	}
+	return usersPage(found, cursor, limit)
+}
+
+func (m *MemoryStorage) Cities(ctx context.Context, limit int) ([]*model.City, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	byKey := make(map[string]*model.City)
+	for _, u := range m.users {
+		key := model.CityKey(u.City)
+		city, ok := byKey[key]
+		if !ok {
+			city = &model.City{Name: u.City}
+			byKey[key] = city
+		}
+		// like min(city) in mysql
+		if u.City < city.Name {
+			city.Name = u.City
+		}
+		city.Users++
+	}
+	cities := make([]*model.City, 0, len(byKey))
+	for _, city := range byKey {
+		cities = append(cities, city)
+	}
+	sort.Slice(cities, func(i, j int) bool {
+		if cities[i].Users != cities[j].Users {
+			return cities[i].Users > cities[j].Users
+		}
+		return model.CityKey(cities[i].Name) < model.CityKey(cities[j].Name)
+	})
+	if len(cities) > limit {
+		cities = cities[:limit]
+	}
+	return cities, nil
+}
+
+func (m *MemoryStorage) SimilarUsers(ctx context.Context, userID uuid.UUID, limit int) ([]*model.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return []*model.User{}, nil
+	}
+	mine := make(map[string]bool, len(user.Interests))
+	for _, interest := range user.Interests {
+		mine[interest] = true
+	}
+	shared := make(map[uuid.UUID]int)
+	found := make([]*model.User, 0)
+	for _, u := range m.users {
+		if uuid.Equal(u.ID, userID) {
+			continue
+		}
+		for _, interest := range u.Interests {
+			if mine[interest] {
+				shared[u.ID]++
+			}
+		}
+		if shared[u.ID] > 0 {
+			found = append(found, u)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if shared[found[i].ID] != shared[found[j].ID] {
+			return shared[found[i].ID] > shared[found[j].ID]
+		}
+		return found[i].ID.String() < found[j].ID.String()
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return copyUsers(found), nil
+}
+
+func copyUsers(users []*model.User) []*model.User {
+	result := make([]*model.User, 0, len(users))
+	for _, u := range users {
+		result = append(result, copyUser(u))
+	}
+	return result
+}
+
+func (m *MemoryStorage) InsertToken(ctx context.Context, session *model.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := *session
+	m.tokens[session.Token] = &s
+	return nil
+}
+
+func (m *MemoryStorage) DeleteToken(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, id)
+	return nil
+}
+
+func (m *MemoryStorage) GetUserByToken(ctx context.Context, token uuid.UUID) (*model.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.tokens[token]
+	if !ok || !s.ExpiresAt.After(time.Now().UTC()) {
+		return nil, nil
+	}
+	u, ok := m.users[s.UserID]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(u), nil
+}
+
+func (m *MemoryStorage) TouchToken(ctx context.Context, token uuid.UUID, seenAt time.Time, expiresAt time.Time,
+	minInterval time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.tokens[token]
+	if !ok || !s.LastSeenAt.Before(seenAt.Add(-minInterval)) {
+		return false, nil
+	}
+	s.LastSeenAt = seenAt
+	s.ExpiresAt = expiresAt
+	return true, nil
+}
+
+func (m *MemoryStorage) DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for token, s := range m.tokens {
+		if !s.ExpiresAt.After(now) {
+			delete(m.tokens, token)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStorage) CountActiveTokens(ctx context.Context, now time.Time) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var count int64
+	for _, s := range m.tokens {
+		if s.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryStorage) ListTokens(ctx context.Context, userID uuid.UUID) ([]*model.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now().UTC()
+	sessions := make([]*model.Session, 0)
+	for _, s := range m.tokens {
+		if uuid.Equal(s.UserID, userID) && s.ExpiresAt.After(now) {
+			session := *s
+			sessions = append(sessions, &session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (m *MemoryStorage) DeleteAllTokens(ctx context.Context, userID uuid.UUID, except uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, s := range m.tokens {
+		if uuid.Equal(s.UserID, userID) && !uuid.Equal(token, except) {
+			delete(m.tokens, token)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) friendshipStatus(userID uuid.UUID, otherID uuid.UUID) model.FriendshipStatus {
+	if row, ok := m.friendships[friendKey{userID, otherID}]; ok {
+		if row.status == friendshipAccepted {
+			return model.FriendshipAccepted
+		}
+		return model.FriendshipRequested
+	}
+	if _, ok := m.friendships[friendKey{otherID, userID}]; ok {
+		return model.FriendshipIncoming
+	}
+	return model.FriendshipNone
+}
+
+func (m *MemoryStorage) GetFriendshipStatus(ctx context.Context, userID uuid.UUID, otherID uuid.UUID) (model.FriendshipStatus, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.friendshipStatus(userID, otherID), nil
+}
+
+func (m *MemoryStorage) SendFriendRequest(ctx context.Context, from uuid.UUID, to uuid.UUID) error {
+	if uuid.Equal(from, to) {
+		return ErrSelfFriendship
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.friendshipStatus(from, to) {
+	case model.FriendshipIncoming:
+		return m.acceptFriendRequest(from, to)
+	case model.FriendshipNone:
+		m.friendships[friendKey{from, to}] = &friendRow{
+			status:    friendshipPending,
+			createdAt: time.Now().UTC(),
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) AcceptFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acceptFriendRequest(userID, requesterID)
+}
+
+func (m *MemoryStorage) acceptFriendRequest(userID uuid.UUID, requesterID uuid.UUID) error {
+	row, ok := m.friendships[friendKey{requesterID, userID}]
+	if !ok || row.status != friendshipPending {
+		return ErrFriendRequestNotFound
+	}
+	row.status = friendshipAccepted
+	m.friendships[friendKey{userID, requesterID}] = &friendRow{
+		status:    friendshipAccepted,
+		createdAt: time.Now().UTC(),
+	}
+	return nil
+}
+
+func (m *MemoryStorage) DeclineFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := friendKey{requesterID, userID}
+	row, ok := m.friendships[key]
+	if !ok || row.status != friendshipPending {
+		return ErrFriendRequestNotFound
+	}
+	delete(m.friendships, key)
+	return nil
+}
+
+func (m *MemoryStorage) RemoveFriend(ctx context.Context, userID uuid.UUID, friendID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.friendships, friendKey{userID, friendID})
+	delete(m.friendships, friendKey{friendID, userID})
+	return nil
+}
+
+func (m *MemoryStorage) ListFriends(ctx context.Context, userID uuid.UUID) ([]*model.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	friends := make([]*model.User, 0)
+	for key, row := range m.friendships {
+		if uuid.Equal(key.userID, userID) && row.status == friendshipAccepted {
+			if u, ok := m.users[key.friendID]; ok {
+				friends = append(friends, copyUser(u))
+			}
+		}
+	}
+	sort.Slice(friends, func(i, j int) bool {
+		return friends[i].Username < friends[j].Username
+	})
+	return friends, nil
+}
+
+func (m *MemoryStorage) ListPendingRequests(ctx context.Context, userID uuid.UUID) ([]*model.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type request struct {
+		user      *model.User
+		createdAt time.Time
+	}
+	requests := make([]request, 0)
+	for key, row := range m.friendships {
+		if uuid.Equal(key.friendID, userID) && row.status == friendshipPending {
+			if u, ok := m.users[key.userID]; ok {
+				requests = append(requests, request{copyUser(u), row.createdAt})
+			}
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if !requests[i].createdAt.Equal(requests[j].createdAt) {
+			return requests[i].createdAt.After(requests[j].createdAt)
+		}
+		return requests[i].user.Username < requests[j].user.Username
+	})
+	users := make([]*model.User, 0, len(requests))
+	for _, r := range requests {
+		users = append(users, r.user)
+	}
+	return users, nil
+}
+
+func (m *MemoryStorage) ListFollowerIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]uuid.UUID, 0)
+	for key := range m.friendships {
+		if uuid.Equal(key.friendID, userID) {
+			ids = append(ids, key.userID)
+		}
+	}
+	return ids, nil
+}
+
+func (m *MemoryStorage) CreatePost(ctx context.Context, post *model.Post) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := *post
+	m.posts = append(m.posts, &p)
+	return nil
+}
+
+// latestPosts returns posts matching the filter, newest first, with author usernames filled
+func (m *MemoryStorage) latestPosts(limit int, filter func(p *model.Post) bool) []*model.Post {
+	posts := make([]*model.Post, 0)
+	for _, p := range m.posts {
+		author, ok := m.users[p.AuthorID]
+		if !ok || !filter(p) {
+			continue
+		}
+		post := *p
+		post.Author = author.Username
+		posts = append(posts, &post)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].CreatedAt.Equal(posts[j].CreatedAt) {
+			return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		}
+		return posts[i].ID.String() > posts[j].ID.String()
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts
+}
+
+func (m *MemoryStorage) ListPostsByAuthor(ctx context.Context, authorID uuid.UUID, limit int) ([]*model.Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.latestPosts(limit, func(p *model.Post) bool {
+		return uuid.Equal(p.AuthorID, authorID)
+	}), nil
+}
+
+func (m *MemoryStorage) ListFeed(ctx context.Context, userID uuid.UUID, limit int) ([]*model.Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.latestPosts(limit, func(p *model.Post) bool {
+		_, follows := m.friendships[friendKey{userID, p.AuthorID}]
+		return follows
+	}), nil
+}
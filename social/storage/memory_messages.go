@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	uuid "github.com/satori/go.uuid"
+	"sort"
+	"sync"
+)
+
+// MemoryMessageStorage is MessageStorage for tests and local development
+type MemoryMessageStorage struct {
+	mu       sync.RWMutex
+	messages map[uuid.UUID][]*model.Message
+	// dialogs are keyed by user and the other participant
+	dialogs map[friendKey]*model.Dialog
+}
+
+func NewMemoryMessageStorage() *MemoryMessageStorage {
+	return &MemoryMessageStorage{
+		messages: make(map[uuid.UUID][]*model.Message),
+		dialogs:  make(map[friendKey]*model.Dialog),
+	}
+}
+
+func (m *MemoryMessageStorage) SendMessage(ctx context.Context, msg *model.Message, author, recipient string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *msg
+	m.messages[msg.DialogID] = append(m.messages[msg.DialogID], &stored)
+	for _, d := range dialogsOf(msg, author, recipient) {
+		key := friendKey{d.UserID, d.OtherID}
+		// messages may be stored out of order, the dialog keeps the latest time
+		if existing, ok := m.dialogs[key]; ok && existing.LastMessageAt.After(d.LastMessageAt) {
+			continue
+		}
+		m.dialogs[key] = d
+	}
+	return nil
+}
+
+func (m *MemoryMessageStorage) ListMessages(ctx context.Context, dialogID uuid.UUID, limit int) ([]*model.Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	messages := make([]*model.Message, 0, len(m.messages[dialogID]))
+	for _, msg := range m.messages[dialogID] {
+		stored := *msg
+		messages = append(messages, &stored)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].CreatedAt.Equal(messages[j].CreatedAt) {
+			return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+		}
+		return messages[i].ID.String() < messages[j].ID.String()
+	})
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+func (m *MemoryMessageStorage) DeleteUserDialogs(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, d := range m.dialogs {
+		if uuid.Equal(key.userID, userID) || uuid.Equal(key.friendID, userID) {
+			delete(m.messages, d.ID)
+			delete(m.dialogs, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryMessageStorage) ListDialogs(ctx context.Context, userID uuid.UUID) ([]*model.Dialog, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dialogs := make([]*model.Dialog, 0)
+	for key, d := range m.dialogs {
+		if !uuid.Equal(key.userID, userID) {
+			continue
+		}
+		dialog := *d
+		dialogs = append(dialogs, &dialog)
+	}
+	sort.Slice(dialogs, func(i, j int) bool {
+		return dialogs[i].LastMessageAt.After(dialogs[j].LastMessageAt)
+	})
+	return dialogs, nil
+}
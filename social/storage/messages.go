@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	uuid "github.com/satori/go.uuid"
+)
+
+// MessageStorage keeps private dialogs, it is separate from Storage
+// so that messages can be moved to their own sharded database
+type MessageStorage interface {
+	// SendMessage stores the message and creates the dialog if needed. Author and recipient are usernames
+	// kept in dialogs, so that listing dialogs doesn't read users, which may be in another database.
+	SendMessage(ctx context.Context, msg *model.Message, author, recipient string) error
+	// ListMessages returns latest messages of the dialog, oldest first
+	ListMessages(ctx context.Context, dialogID uuid.UUID, limit int) ([]*model.Message, error)
+	// ListDialogs returns dialogs of the user, recently active first
+	ListDialogs(ctx context.Context, userID uuid.UUID) ([]*model.Dialog, error)
+	// DeleteUserDialogs deletes every dialog of the user with all of its messages,
+	// other participants lose the dialog too, as it would be left with half of the conversation
+	DeleteUserDialogs(ctx context.Context, userID uuid.UUID) error
+}
+
+// dialogsOf returns the dialog of each participant, which the message is the last one of
+func dialogsOf(msg *model.Message, author, recipient string) []*model.Dialog {
+	return []*model.Dialog{
+		{ID: msg.DialogID, UserID: msg.AuthorID, OtherID: msg.RecipientID, Other: recipient, LastMessageAt: msg.CreatedAt},
+		{ID: msg.DialogID, UserID: msg.RecipientID, OtherID: msg.AuthorID, Other: author, LastMessageAt: msg.CreatedAt},
+	}
+}
@@ -2,50 +2,72 @@ package storage
 
 import (
 	"database/sql"
-	"fmt"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/pkg/errors"
 	"github.com/pressly/goose"
 	"log"
-	"os"
 )
 
-func Migrate(config *MysqlConfig) {
-	db, err := sql.Open("mysql", config.dsn())
-	if err != nil {
-		panic(err)
-	}
-	defer db.Close()
+func init() {
 	if err := goose.SetDialect("mysql"); err != nil {
 		panic(err)
 	}
-	migrationDir := os.Getenv("MIGRATION_DIR")
-	log.Printf("migration dir is: %v\n", migrationDir)
-	if err := goose.Status(db, migrationDir); err != nil {
-		panic(err)
-	}
-	if err := goose.Up(db, migrationDir); err != nil {
-		panic(err)
-	}
 }
 
-func CreateDatabase(config *MysqlConfig, drop bool) {
-	db, err := sql.Open("mysql",
-		fmt.Sprintf("%s:%s@tcp(%s:3306)/",
-			config.username, config.password, config.host),
-	)
+// withDB runs fn on a plain connection to the primary, statements of migrations are not instrumented.
+// Empty database connects to the server without selecting a database.
+func withDB(cfg *config.MySQL, database string, fn func(db *sql.DB) error) error {
+	db, err := sql.Open("mysql", dsn(cfg, cfg.Host, database))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer func() {
 		if err := db.Close(); err != nil {
-			fmt.Printf("error closing db: %v", err)
+			log.Printf("error closing db: %v", err)
 		}
 	}()
-	if drop {
-		if _, err = db.Exec("drop database if exists " + config.dbName); err != nil {
-			panic(err)
-		}
-	}
-	if _, err = db.Exec("create database if not exists " + config.dbName); err != nil {
-		panic(err)
-	}
+	return fn(db)
+}
+
+// Migrate applies all pending migrations from cfg.MigrationDir
+func Migrate(cfg *config.MySQL) error {
+	log.Printf("migration dir is: %v\n", cfg.MigrationDir)
+	return withDB(cfg, cfg.Database, func(db *sql.DB) error {
+		return errors.Wrap(goose.Up(db, cfg.MigrationDir), "failed to apply migrations")
+	})
+}
+
+// MigrateDown rolls back the latest applied migration
+func MigrateDown(cfg *config.MySQL) error {
+	return withDB(cfg, cfg.Database, func(db *sql.DB) error {
+		return errors.Wrap(goose.Down(db, cfg.MigrationDir), "failed to roll back migration")
+	})
+}
+
+// MigrationStatus logs which migrations are applied and when
+func MigrationStatus(cfg *config.MySQL) error {
+	return withDB(cfg, cfg.Database, func(db *sql.DB) error {
+		return goose.Status(db, cfg.MigrationDir)
+	})
+}
+
+// CreateMigration writes a blank sql migration named by the current timestamp and name
+func CreateMigration(dir, name string) error {
+	return goose.Create(nil, dir, name, "sql")
+}
+
+// CreateDatabase creates cfg.Database unless it exists
+func CreateDatabase(cfg *config.MySQL) error {
+	return withDB(cfg, "", func(db *sql.DB) error {
+		_, err := db.Exec("create database if not exists `" + cfg.Database + "`")
+		return errors.Wrap(err, "failed to create database")
+	})
+}
+
+// DropDatabase drops cfg.Database with all the data, it is not an error if it doesn't exist
+func DropDatabase(cfg *config.MySQL) error {
+	return withDB(cfg, "", func(db *sql.DB) error {
+		_, err := db.Exec("drop database if exists `" + cfg.Database + "`")
+		return errors.Wrap(err, "failed to drop database")
+	})
 }
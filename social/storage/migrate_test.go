@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pressly/goose"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// legacyVersion is the last migration before interests were moved out of users and cities got keys
+const legacyVersion = 20200202190512
+
+func TestMigratingLegacyUsers(t *testing.T) {
+	requireMysql(t)
+	cfg := *testConfig
+	cfg.Database = "test_migrations"
+	for _, step := range []func(*config.MySQL) error{DropDatabase, CreateDatabase} {
+		if err := step(&cfg); err != nil {
+			t.Fatalf("error creating database: %v", err)
+		}
+	}
+	longTag := strings.Repeat("x", 70)
+	err := withDB(&cfg, cfg.Database, func(db *sql.DB) error {
+		if err := goose.UpTo(db, cfg.MigrationDir, legacyVersion); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`insert into users(id, username, password, firstName, lastName, age, gender, interests, city)
+		values ('legacy-1', 'legacy1', '', 'First', 'Last', 30, 'male', ?, ?),
+		       ('legacy-2', 'legacy2', '', 'First', 'Last', 30, 'male', '', ?)`,
+			"Chess, "+longTag+", chess", " Saint\r\n\tPetersburg ", "saint"+strings.Repeat(" ", 20)+"petersburg"); err != nil {
+			return err
+		}
+		return goose.Up(db, cfg.MigrationDir)
+	})
+	if err != nil {
+		t.Fatalf("error migrating legacy users: %v", err)
+	}
+
+	var tags []string
+	err = withDB(&cfg, cfg.Database, func(db *sql.DB) error {
+		rows, err := db.Query(`select i.tag from user_interests ui join interests i on i.id=ui.interestID
+		where ui.userID='legacy-1' order by ui.position`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatalf("error reading interests: %v", err)
+	}
+	if expected := []string{"chess", longTag[:64]}; !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("wrong interests, expected %v, got %v", expected, tags)
+	}
+
+	// keys of legacy cities are the same as the app makes, so their users are counted together
+	var cities, users int
+	var key string
+	err = withDB(&cfg, cfg.Database, func(db *sql.DB) error {
+		return db.QueryRow(`select count(*), min(city_key), sum(users) from cities`).Scan(&cities, &key, &users)
+	})
+	if err != nil {
+		t.Fatalf("error reading cities: %v", err)
+	}
+	if cities != 1 || key != model.CityKey(" Saint\r\n\tPetersburg ") || users != 2 {
+		t.Fatalf("legacy cities should be counted together, got %d cities, %q key, %d users", cities, key, users)
+	}
+}
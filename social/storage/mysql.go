@@ -1,123 +1,367 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"github.com/chocosin/otus-hl/social/config"
 	"github.com/chocosin/otus-hl/social/model"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
 	uuid "github.com/satori/go.uuid"
-	"os"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const dbName = "social"
-
 type MysqlStorage struct {
-	db *sql.DB
+	db     *sql.DB
+	logger zerolog.Logger
+
+	// read-only statements are also prepared on replicas
+	readQueries map[*sql.Stmt]string
+	replicas    []*replica
+	nextReplica uint32
+	done        chan struct{}
+	stats       *dbStats
 
 	insertUserSt       *sql.Stmt
+	updatePasswordSt   *sql.Stmt
+	updateUserSt       *sql.Stmt
 	findByUsernameSt   *sql.Stmt
 	getUserSt          *sql.Stmt
 	deleteTokenSt      *sql.Stmt
-	getTokenSt         *sql.Stmt
+	getUserByTokenSt   *sql.Stmt
 	insertTokenSt      *sql.Stmt
+	touchTokenSt       *sql.Stmt
+	deleteExpiredSt    *sql.Stmt
+	listTokensSt       *sql.Stmt
+	countTokensSt      *sql.Stmt
+	deleteAllTokensSt  *sql.Stmt
 	getLatestUsernames *sql.Stmt
+	searchUsersSt      *sql.Stmt
+
+	getFriendshipsSt       *sql.Stmt
+	lockFriendPairSt       *sql.Stmt
+	insertFriendRequestSt  *sql.Stmt
+	acceptFriendRequestSt  *sql.Stmt
+	insertAcceptedFriendSt *sql.Stmt
+	deleteFriendRequestSt  *sql.Stmt
+	deleteFriendshipSt     *sql.Stmt
+	listFriendsSt          *sql.Stmt
+	listPendingFriendsSt   *sql.Stmt
+	listFollowersSt        *sql.Stmt
+
+	insertPostSt        *sql.Stmt
+	listPostsByAuthorSt *sql.Stmt
+	listFeedSt          *sql.Stmt
+
+	upsertInterestSt      *sql.Stmt
+	findInterestSt        *sql.Stmt
+	insertUserInterestSt  *sql.Stmt
+	deleteUserInterestsSt *sql.Stmt
+	usersByInterestSt     *sql.Stmt
+	listInterestIDsSt     *sql.Stmt
+
+	usersByCitySt    *sql.Stmt
+	citiesSt         *sql.Stmt
+	addCityUserSt    *sql.Stmt
+	removeCityUserSt *sql.Stmt
+	getUserCitySt    *sql.Stmt
+
+	deleteUserTokensSt      *sql.Stmt
+	deleteUserFriendshipsSt *sql.Stmt
+	deleteUserPostsSt       *sql.Stmt
+	deleteUserSt            *sql.Stmt
+	insertTombstoneSt       *sql.Stmt
+	isTombstonedSt          *sql.Stmt
 }
 
 func (m *MysqlStorage) Close() error {
+	close(m.done)
+	if err := m.closeReplicas(); err != nil {
+		m.db.Close()
+		return err
+	}
 	return m.db.Close()
 }
 
 func (m *MysqlStorage) prepareStatements() error {
 	var err error
-	m.insertUserSt, err = m.db.Prepare(`
-	insert into users(id, username, password, firstName, lastName, age, gender, interests, city) 
-	values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	m.insertUserSt, err = prepare(m.db, "insert_user", `
+	insert into users(id, username, password, firstName, lastName, age, gender, city, city_key, created_at) 
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
 	}
-	m.findByUsernameSt, err = m.db.Prepare(`
-	select id, username, password, firstName, lastName, age, gender, interests, city from users where username=?
+	if m.updatePasswordSt, err = prepare(m.db, "update_password", `
+	update users set password=? where id=?
+	`); err != nil {
+		return err
+	}
+	if m.updateUserSt, err = prepare(m.db, "update_user", `
+	update users set password=?, firstName=?, lastName=?, age=?, gender=?, city=?, city_key=? where id=?
+	`); err != nil {
+		return err
+	}
+	m.findByUsernameSt, err = m.prepareRead("find_by_username", `
+	select id, username, password, firstName, lastName, age, gender, city, created_at from users where username=?
 	`)
 	if err != nil {
 		return err
 	}
-	m.getUserSt, err = m.db.Prepare(`
-	select id, username, password, firstName, lastName, age, gender, interests, city from users where id=?
+	m.getUserSt, err = m.prepareRead("get_user", `
+	select id, username, password, firstName, lastName, age, gender, city, created_at from users where id=?
 	`)
 	if err != nil {
 		return err
 	}
-	m.getLatestUsernames, err = m.db.Prepare(`
-	select username from users order by id desc limit ?
+	m.getLatestUsernames, err = m.prepareRead("get_latest_usernames", `
+	select username, created_at, id from users
+	where (created_at, id) < (?, ?) order by created_at desc, id desc limit ?
 	`)
 	if err != nil {
 		return err
 	}
-	if m.insertTokenSt, err = m.db.Prepare(`
-	insert into auth_tokens(token, userID) values (?, ?)
+	if m.searchUsersSt, err = m.prepareRead("search_users", `
+	select id, username, password, firstName, lastName, age, gender, city, created_at from users
+	where firstName like ? and lastName like ? and (created_at, id) > (?, ?)
+	order by created_at, id limit ?
+	`); err != nil {
+		return err
+	}
+	if m.insertTokenSt, err = prepare(m.db, "insert_token", `
+	insert into auth_tokens(token, userID, created_at, last_seen_at, expires_at, user_agent, ip)
+	values (?, ?, ?, ?, ?, ?, ?)
+	`); err != nil {
+		return err
+	}
+	if m.touchTokenSt, err = prepare(m.db, "touch_token", `
+	update auth_tokens set last_seen_at=?, expires_at=? where token=? and last_seen_at<?
+	`); err != nil {
+		return err
+	}
+	if m.deleteExpiredSt, err = prepare(m.db, "delete_expired", `
+	delete from auth_tokens where expires_at<=?
 	`); err != nil {
 		return err
 	}
-	if m.deleteTokenSt, err = m.db.Prepare(`
+	if m.listTokensSt, err = prepare(m.db, "list_tokens", `
+	select token, userID, created_at, last_seen_at, expires_at, user_agent, ip from auth_tokens
+	where userID=? and expires_at>? order by last_seen_at desc
+	`); err != nil {
+		return err
+	}
+	if m.deleteAllTokensSt, err = prepare(m.db, "delete_all_tokens", `
+	delete from auth_tokens where userID=? and token<>?
+	`); err != nil {
+		return err
+	}
+	if m.deleteTokenSt, err = prepare(m.db, "delete_token", `
 	delete from auth_tokens where token=?
 	`); err != nil {
 		return err
 	}
-	if m.getTokenSt, err = m.db.Prepare(`
-	select token, userID from auth_tokens where token=?
+	if m.getUserByTokenSt, err = m.prepareRead("get_user_by_token", `
+	select u.id, u.username, u.password, u.firstName, u.lastName, u.age, u.gender, u.city, u.created_at
+	from auth_tokens t join users u on u.id=t.userID where t.token=? and t.expires_at>?
 	`); err != nil {
 		return err
 	}
-	return nil
+	if m.countTokensSt, err = m.prepareRead("count_tokens", `
+	select count(*) from auth_tokens where expires_at>?
+	`); err != nil {
+		return err
+	}
+	if err = m.prepareFriendStatements(); err != nil {
+		return err
+	}
+	if err = m.preparePostStatements(); err != nil {
+		return err
+	}
+	if err = m.prepareInterestStatements(); err != nil {
+		return err
+	}
+	if err = m.prepareCityStatements(); err != nil {
+		return err
+	}
+	return m.prepareDeleteStatements()
 }
 
-func (m *MysqlStorage) InsertToken(token uuid.UUID, userId uuid.UUID) error {
-	_, err := m.insertTokenSt.Exec(token.String(), userId.String())
+func (m *MysqlStorage) InsertToken(ctx context.Context, session *model.Session) error {
+	_, err := m.insertTokenSt.ExecContext(ctx, session.Token.String(), session.UserID.String(),
+		session.CreatedAt, session.LastSeenAt, session.ExpiresAt, session.UserAgent, session.IP)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert token")
 	}
 	return nil
 }
 
-func (m *MysqlStorage) DeleteToken(id uuid.UUID) error {
-	_, err := m.deleteTokenSt.Exec(id.String())
+func (m *MysqlStorage) TouchToken(ctx context.Context, token uuid.UUID, seenAt time.Time, expiresAt time.Time,
+	minInterval time.Duration) (bool, error) {
+	res, err := m.touchTokenSt.ExecContext(ctx, seenAt, expiresAt, token.String(), seenAt.Add(-minInterval))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to touch token")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to touch token")
+	}
+	return affected > 0, nil
+}
+
+func (m *MysqlStorage) DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error) {
+	res, err := m.deleteExpiredSt.ExecContext(ctx, now)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete expired tokens")
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete expired tokens")
+	}
+	return deleted, nil
+}
+
+func (m *MysqlStorage) DeleteToken(ctx context.Context, id uuid.UUID) error {
+	_, err := m.deleteTokenSt.ExecContext(ctx, id.String())
 	if err != nil {
 		return errors.Wrap(err, "failed to delete token")
 	}
 	return nil
 }
 
-func (m *MysqlStorage) GetUserByToken(token uuid.UUID) (*model.User, error) {
-	row := m.getTokenSt.QueryRow(token.String())
-	var dbToken, dbUserID string
-	err := row.Scan(&dbToken, &dbUserID)
+func (m *MysqlStorage) CountActiveTokens(ctx context.Context, now time.Time) (int64, error) {
+	var count int64
+	err := m.read(func(r *replica) error {
+		return m.replicaStmt(r, m.countTokensSt).QueryRowContext(ctx, now).Scan(&count)
+	})
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		return 0, errors.Wrap(err, "failed to count active tokens")
+	}
+	return count, nil
+}
+
+func (m *MysqlStorage) ListTokens(ctx context.Context, userID uuid.UUID) ([]*model.Session, error) {
+	rows, err := m.listTokensSt.QueryContext(ctx, userID.String(), time.Now().UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "ListTokens")
+	}
+	defer rows.Close()
+
+	sessions := make([]*model.Session, 0)
+	for rows.Next() {
+		var s model.Session
+		var token, dbUserID string
+		if err := rows.Scan(&token, &dbUserID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt,
+			&s.UserAgent, &s.IP); err != nil {
+			return nil, errors.Wrap(err, "ListTokens")
 		}
-		return nil, errors.Wrap(err, "failed to GetUserByToken")
+		if s.Token, err = uuid.FromString(token); err != nil {
+			return nil, errors.Wrap(err, "ListTokens: failed to parse token")
+		}
+		if s.UserID, err = uuid.FromString(dbUserID); err != nil {
+			return nil, errors.Wrap(err, "ListTokens: failed to parse user id")
+		}
+		sessions = append(sessions, &s)
 	}
-	user, err := m.getUser(dbUserID)
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "ListTokens")
+	}
+	return sessions, nil
+}
+
+func (m *MysqlStorage) DeleteAllTokens(ctx context.Context, userID uuid.UUID, except uuid.UUID) error {
+	_, err := m.deleteAllTokensSt.ExecContext(ctx, userID.String(), except.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to delete all tokens")
+	}
+	return nil
+}
+
+func (m *MysqlStorage) GetUserByToken(ctx context.Context, token uuid.UUID) (*model.User, error) {
+	var user *model.User
+	var fromReplica bool
+	err := m.read(func(r *replica) (err error) {
+		fromReplica = r != nil
+		user, err = m.getUserByToken(ctx, m.replicaStmt(r, m.getUserByTokenSt), token)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to GetUserByToken")
 	}
+	if user == nil && fromReplica {
+		// token might have just been created and not replicated yet
+		user, err = m.getUserByToken(ctx, m.getUserByTokenSt, token)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to GetUserByToken")
+		}
+	}
+	if err := m.fillInterests(ctx, user); err != nil {
+		return nil, errors.Wrap(err, "failed to GetUserByToken")
+	}
 	return user, nil
 }
 
-func (m *MysqlStorage) InsertUser(user *model.User) error {
+func (m *MysqlStorage) getUserByToken(ctx context.Context, st *sql.Stmt, token uuid.UUID) (*model.User, error) {
+	return m.scanUser(st.QueryRowContext(ctx, token.String(), time.Now().UTC()))
+}
+
+func (m *MysqlStorage) InsertUser(ctx context.Context, user *model.User) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert user")
+	}
+	defer tx.Rollback()
+
 	// for now storing UUID as string
-	_, err := m.insertUserSt.Exec(user.ID.String(), user.Username, user.PasswordHash,
-		user.FirstName, user.LastName, user.Age, user.Gender, user.JoinInterests(), user.City)
+	_, err = tx.Stmt(m.insertUserSt).ExecContext(ctx, user.ID.String(), user.Username, user.PasswordHash,
+		user.FirstName, user.LastName, user.Age, user.Gender, user.City, model.CityKey(user.City), user.CreatedAt)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert user")
 	}
+	if _, err := tx.Stmt(m.addCityUserSt).ExecContext(ctx, model.CityKey(user.City), user.City); err != nil {
+		return errors.Wrap(err, "failed to count user in city")
+	}
+	if err := m.saveInterests(ctx, tx, user); err != nil {
+		return errors.Wrap(err, "failed to insert user interests")
+	}
+	return errors.Wrap(tx.Commit(), "failed to insert user")
+}
+
+func (m *MysqlStorage) UpdateUser(ctx context.Context, user *model.User) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to update user")
+	}
+	defer tx.Rollback()
+
+	if err := m.moveCityUser(ctx, tx, user); err != nil {
+		return errors.Wrap(err, "failed to count user in city")
+	}
+	_, err = tx.Stmt(m.updateUserSt).ExecContext(ctx, user.PasswordHash, user.FirstName, user.LastName,
+		user.Age, user.Gender, user.City, model.CityKey(user.City), user.ID.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to update user")
+	}
+	if err := m.saveInterests(ctx, tx, user); err != nil {
+		return errors.Wrap(err, "failed to update user interests")
+	}
+	return errors.Wrap(tx.Commit(), "failed to update user")
+}
+
+func (m *MysqlStorage) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	_, err := m.updatePasswordSt.ExecContext(ctx, passwordHash, userID.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to update password hash")
+	}
 	return nil
 }
 
-func (m *MysqlStorage) getUser(userID string) (*model.User, error) {
-	row := m.getUserSt.QueryRow(userID)
+func (m *MysqlStorage) getUser(ctx context.Context, st *sql.Stmt, userID string) (*model.User, error) {
+	row := st.QueryRowContext(ctx, userID)
 	user, err := m.scanUser(row)
 	if err != nil {
 		return nil, errors.Wrap(err, "getUser")
@@ -125,43 +369,146 @@ func (m *MysqlStorage) getUser(userID string) (*model.User, error) {
 	return user, nil
 }
 
-func (m *MysqlStorage) FindUserByUsername(username string) (*model.User, error) {
-	row := m.findByUsernameSt.QueryRow(username)
-	user, err := m.scanUser(row)
+func (m *MysqlStorage) FindUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	var user *model.User
+	var fromReplica bool
+	err := m.read(func(r *replica) (err error) {
+		fromReplica = r != nil
+		user, err = m.scanUser(m.replicaStmt(r, m.findByUsernameSt).QueryRowContext(ctx, username))
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "FindUserByUsername")
 	}
+	if user == nil && fromReplica {
+		// user might have just signed up and not replicated yet
+		return m.FindUserForLogin(ctx, username)
+	}
+	if err := m.fillInterests(ctx, user); err != nil {
+		return nil, errors.Wrap(err, "FindUserByUsername")
+	}
 	return user, nil
 }
 
-const lastUsernamesLimit = 10
+// FindUserForLogin reads from the primary, so a just registered user or a just changed password is never missed
+func (m *MysqlStorage) FindUserForLogin(ctx context.Context, username string) (*model.User, error) {
+	user, err := m.scanUser(m.findByUsernameSt.QueryRowContext(ctx, username))
+	if err != nil {
+		return nil, errors.Wrap(err, "FindUserForLogin")
+	}
+	if err := m.fillInterests(ctx, user); err != nil {
+		return nil, errors.Wrap(err, "FindUserForLogin")
+	}
+	return user, nil
+}
 
-func (m *MysqlStorage) LastUsernames() ([]string, error) {
-	rows, err := m.getLatestUsernames.Query(lastUsernamesLimit)
+// IsUsernameTaken reads from the primary, so a just registered username is never missed
+func (m *MysqlStorage) IsUsernameTaken(ctx context.Context, username string) (bool, error) {
+	user, err := m.scanUser(m.findByUsernameSt.QueryRowContext(ctx, username))
 	if err != nil {
-		return nil, errors.Wrap(err, "LastRegistered")
+		return false, errors.Wrap(err, "IsUsernameTaken")
 	}
-	defer rows.Close()
+	if user != nil {
+		return true, nil
+	}
+	tombstoned, err := m.isTombstoned(ctx, username)
+	return tombstoned, errors.Wrap(err, "IsUsernameTaken")
+}
+
+func (m *MysqlStorage) LastUsernames(ctx context.Context, cursor Cursor, limit int) ([]string, Cursor, error) {
+	createdAt, id, err := cursor.position(true)
+	if err != nil {
+		return nil, "", err
+	}
+	var usernames []string
+	var next Cursor
+	err = m.queryRead(ctx, m.getLatestUsernames, func(rows *sql.Rows) error {
+		usernames, next = make([]string, 0, limit), ""
+		var lastCreatedAt time.Time
+		var lastID string
+		for rows.Next() {
+			var username, rowID string
+			var rowCreatedAt time.Time
+			if err := rows.Scan(&username, &rowCreatedAt, &rowID); err != nil {
+				return err
+			}
+			if len(usernames) == limit {
+				// there is one more row, so the last returned one is where the next page starts
+				next = newCursor(lastCreatedAt, lastID)
+				break
+			}
+			usernames = append(usernames, username)
+			lastCreatedAt, lastID = rowCreatedAt, rowID
+		}
+		return nil
+	}, createdAt, id, limit+1)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "LastRegistered")
+	}
+	return usernames, next, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func likePrefix(prefix string) string {
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+func (m *MysqlStorage) SearchUsers(ctx context.Context, firstPrefix, lastPrefix string, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	users, next, err := m.queryUsersPage(ctx, m.searchUsersSt, cursor, limit, likePrefix(firstPrefix), likePrefix(lastPrefix))
+	if err == ErrInvalidCursor {
+		return nil, "", err
+	}
+	return users, next, errors.Wrap(err, "SearchUsers")
+}
+
+// queryUsersPage reads a page of users ordered by (created_at, id),
+// the statement takes args followed by created_at, id of the cursor and limit
+func (m *MysqlStorage) queryUsersPage(ctx context.Context, st *sql.Stmt, cursor Cursor, limit int, args ...interface{}) ([]*model.User, Cursor, error) {
+	createdAt, id, err := cursor.position(false)
+	if err != nil {
+		return nil, "", err
+	}
+	var users []*model.User
+	err = m.queryRead(ctx, st, func(rows *sql.Rows) (err error) {
+		users, err = m.scanUsers(rows)
+		return err
+	}, append(args, createdAt, id, limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := cutUsersPage(users, limit)
+	if err := m.fillInterests(ctx, users...); err != nil {
+		return nil, "", err
+	}
+	return users, next, nil
+}
 
-	usernames := make([]string, 0, lastUsernamesLimit)
+func (m *MysqlStorage) scanUsers(rows *sql.Rows) ([]*model.User, error) {
+	defer rows.Close()
+	users := make([]*model.User, 0)
 	for rows.Next() {
-		var username string
-		if err := rows.Scan(&username); err != nil {
-			return nil, errors.Wrap(err, "LastRegistered")
+		user, err := m.scanUser(rows)
+		if err != nil {
+			return nil, err
 		}
-		usernames = append(usernames, username)
+		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, errors.Wrap(err, "LastRegistered")
+		return nil, err
 	}
-	return usernames, nil
+	return users, nil
 }
 
-func (m *MysqlStorage) scanUser(row *sql.Row) (*model.User, error) {
+func (m *MysqlStorage) scanUser(row rowScanner) (*model.User, error) {
 	var u model.User
-	var idStr, interestsJoined string
+	var idStr string
 	err := row.Scan(&idStr, &u.Username, &u.PasswordHash, &u.FirstName, &u.LastName,
-		&u.Age, &u.Gender, &interestsJoined, &u.City)
+		&u.Age, &u.Gender, &u.City, &u.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -172,47 +519,76 @@ func (m *MysqlStorage) scanUser(row *sql.Row) (*model.User, error) {
 	if u.ID, err = uuid.FromString(idStr); err != nil {
 		return nil, errors.Wrap(err, "failed to parse user id")
 	}
-	u.SetInterests(interestsJoined)
 
 	return &u, nil
 }
 
-func NewMysqlStorage(config *MysqlConfig) (*MysqlStorage, error) {
-	db, err := sql.Open("mysql", config.dsn())
+func NewMysqlStorage(cfg *config.MySQL, logger zerolog.Logger) (*MysqlStorage, error) {
+	db, err := openDB(cfg, cfg.Host)
 	if err != nil {
 		return nil, err
 	}
 	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	storage := &MysqlStorage{
+		db:          db,
+		logger:      logger,
+		readQueries: make(map[*sql.Stmt]string),
+		done:        make(chan struct{}),
+	}
+	// closing the storage closes the primary, replicas connected so far and stops checking them
+	if err := storage.prepareStatements(); err != nil {
+		storage.Close()
 		return nil, err
 	}
-	storage := &MysqlStorage{db: db}
-	err = storage.prepareStatements()
-	return storage, err
+	if err := storage.connectReplicas(cfg); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	dbs := map[string]*sql.DB{"primary": db}
+	for _, r := range storage.replicas {
+		dbs["replica:"+r.host] = r.db
+	}
+	storage.stats = newDBStats(dbs)
+	return storage, nil
 }
 
-type MysqlConfig struct {
-	host     string
-	username string
-	password string
-	dbName   string
+// Describe and Collect export stats of connection pools of the primary and replicas
+
+func (m *MysqlStorage) Describe(ch chan<- *prometheus.Desc) {
+	m.stats.Describe(ch)
 }
 
-func (mc *MysqlConfig) dsn() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true&timeout=6s",
-		mc.username, mc.password, mc.host, mc.dbName)
+func (m *MysqlStorage) Collect(ch chan<- prometheus.Metric) {
+	m.stats.Collect(ch)
 }
 
-func NewMysqlConfig() *MysqlConfig {
-	host := os.Getenv("MYSQL_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	username := os.Getenv("MYSQL_USER")
-	password := os.Getenv("MYSQL_PASS")
-	return &MysqlConfig{
-		host:     host,
-		username: username,
-		password: password,
-		dbName:   dbName,
+// openDB opens the database on the host with pool settings from the config
+func openDB(cfg *config.MySQL, host string) (*sql.DB, error) {
+	db, err := sql.Open(instrumentedDriver, dsn(cfg, host, cfg.Database))
+	if err != nil {
+		return nil, err
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration)
+	return db, nil
+}
+
+// dsn connects to the database on the host, empty database is used to create one
+func dsn(cfg *config.MySQL, host string, database string) string {
+	c := mysql.NewConfig()
+	c.User = cfg.User
+	c.Passwd = cfg.Password
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+	c.DBName = database
+	c.ParseTime = true
+	c.Timeout = cfg.ConnectTimeout.Duration
+	c.ReadTimeout = cfg.ReadTimeout.Duration
+	c.WriteTimeout = cfg.WriteTimeout.Duration
+	c.Params = cfg.Params
+	return c.FormatDSN()
 }
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// MaxInsertBatch keeps batched inserts under the limit of 65535 placeholders in a statement
+const MaxInsertBatch = 5000
+
+// maxInterestRows limits rows of a single user_interests insert, users may have many interests
+const maxInterestRows = 20000
+
+const (
+	insertUsersBatch = `insert into users(id, username, password, firstName, lastName, age, gender, city, city_key, created_at)
+	values `
+	insertUserInterestsBatch = `insert into user_interests(userID, interestID, position) values `
+	upsertInterestsBatch     = `insert into interests(tag) values `
+	findInterestsBatch       = `select id, tag from interests where tag in `
+	upsertCitiesBatch        = `insert into cities(city_key, name, users) values `
+	listUsersInterestsBatch  = `select ui.userID, i.tag from user_interests ui join interests i on i.id=ui.interestID
+	where ui.userID in `
+	similarUsersBatch = `select u.id, u.username, u.password, u.firstName, u.lastName, u.age, u.gender, u.city, u.created_at
+	from (select c.userID, count(*) sharedCount from (`
+	similarUsersCandidates = `select userID from (select userID from user_interests
+		where interestID=? and userID<>? order by userID limit ?) i`
+	similarUsersBatchEnd = `) c group by c.userID order by sharedCount desc, c.userID limit ?) s
+	join users u on u.id=s.userID order by s.sharedCount desc, u.id`
+)
+
+// batchStatements differ in the number of rows, so they are named by the query prefix
+var batchStatements = []struct{ name, prefix string }{
+	{"insert_users_batch", insertUsersBatch},
+	{"insert_user_interests_batch", insertUserInterestsBatch},
+	{"upsert_interests_batch", upsertInterestsBatch},
+	{"find_interests_batch", findInterestsBatch},
+	{"upsert_cities_batch", upsertCitiesBatch},
+	{"list_users_interests_batch", listUsersInterestsBatch},
+	{"similar_users_batch", similarUsersBatch},
+}
+
+// InsertUsers inserts users with multi-row statements, a batch is one transaction.
+// It is meant for seeding: unlike InsertUser, it doesn't go through a prepared statement per row.
+func (m *MysqlStorage) InsertUsers(ctx context.Context, users []*model.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	if len(users) > MaxInsertBatch {
+		return errors.Errorf("batch of %d users is larger than %d", len(users), MaxInsertBatch)
+	}
+	interestIDs, err := m.upsertInterests(ctx, users)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert interests")
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert users")
+	}
+	defer tx.Rollback()
+
+	args := make([]interface{}, 0, len(users)*10)
+	for _, user := range users {
+		args = append(args, user.ID.String(), user.Username, user.PasswordHash, user.FirstName, user.LastName,
+			user.Age, user.Gender, user.City, model.CityKey(user.City), user.CreatedAt)
+	}
+	if _, err := tx.ExecContext(ctx, insertUsersBatch+placeholders(len(users), 10), args...); err != nil {
+		return errors.Wrap(err, "failed to insert users")
+	}
+	if err := countCityUsers(ctx, tx, users); err != nil {
+		return errors.Wrap(err, "failed to count users in cities")
+	}
+
+	args = args[:0]
+	for _, user := range users {
+		seen := make(map[string]bool, len(user.Interests))
+		for idx, tag := range user.Interests {
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			interestID, ok := interestIDs[tag]
+			if !ok {
+				return errors.Errorf("interest %q is not found after inserting", tag)
+			}
+			args = append(args, user.ID.String(), interestID, idx+1)
+		}
+	}
+	for len(args) > 0 {
+		chunk := args
+		if len(chunk) > maxInterestRows*3 {
+			chunk = chunk[:maxInterestRows*3]
+		}
+		args = args[len(chunk):]
+		if _, err := tx.ExecContext(ctx, insertUserInterestsBatch+placeholders(len(chunk)/3, 3), chunk...); err != nil {
+			return errors.Wrap(err, "failed to insert user interests")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "failed to insert users")
+}
+
+// countCityUsers adds users of the batch to counts of their cities,
+// cities are upserted in sorted order, so that parallel batches don't deadlock
+func countCityUsers(ctx context.Context, tx *sql.Tx, users []*model.User) error {
+	counts := make(map[string]int)
+	names := make(map[string]string)
+	for _, user := range users {
+		key := model.CityKey(user.City)
+		if counts[key] == 0 {
+			names[key] = user.City
+		}
+		counts[key]++
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]interface{}, 0, len(keys)*3)
+	for _, key := range keys {
+		args = append(args, key, names[key], counts[key])
+	}
+	upsert := upsertCitiesBatch + placeholders(len(keys), 3) +
+		` on duplicate key update name=if(users>0, name, values(name)), users=users+values(users)`
+	_, err := tx.ExecContext(ctx, upsert, args...)
+	return err
+}
+
+// upsertInterests makes sure interests of the users exist and returns their ids by tag.
+// Tags are upserted in sorted order outside of the users transaction,
+// so parallel batches sharing tags hold the locks briefly and don't deadlock.
+func (m *MysqlStorage) upsertInterests(ctx context.Context, users []*model.User) (map[string]int64, error) {
+	var tags []interface{}
+	seen := make(map[string]bool)
+	for _, user := range users {
+		for _, tag := range user.Interests {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	ids := make(map[string]int64, len(tags))
+	if len(tags) == 0 {
+		return ids, nil
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].(string) < tags[j].(string)
+	})
+
+	upsert := upsertInterestsBatch + placeholders(len(tags), 1) + ` on duplicate key update tag=tag`
+	if _, err := m.db.ExecContext(ctx, upsert, tags...); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.QueryContext(ctx, findInterestsBatch+placeholders(1, len(tags)), tags...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		ids[tag] = id
+	}
+	return ids, rows.Err()
+}
+
+// placeholders makes values list of a multi-row insert, e.g. (?, ?), (?, ?)
+func placeholders(rows, columns int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", columns), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
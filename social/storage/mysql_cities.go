@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+)
+
+func (m *MysqlStorage) prepareCityStatements() error {
+	var err error
+	// city_key, created_at, id index is used both for filtering and ordering
+	if m.usersByCitySt, err = m.prepareRead("users_by_city", `
+	select id, username, password, firstName, lastName, age, gender, city, created_at from users
+	where city_key=? and (created_at, id) > (?, ?) order by created_at, id limit ?
+	`); err != nil {
+		return err
+	}
+	if m.citiesSt, err = m.prepareRead("cities", `
+	select name, users from cities where users>0 order by users desc, city_key limit ?
+	`); err != nil {
+		return err
+	}
+	// a city left by all users takes the name of the next one coming
+	if m.addCityUserSt, err = prepare(m.db, "add_city_user", `
+	insert into cities(city_key, name, users) values (?, ?, 1)
+	on duplicate key update name=if(users>0, name, values(name)), users=users+1
+	`); err != nil {
+		return err
+	}
+	if m.removeCityUserSt, err = prepare(m.db, "remove_city_user", `
+	update cities set users=users-1 where city_key=?
+	`); err != nil {
+		return err
+	}
+	if m.getUserCitySt, err = prepare(m.db, "get_user_city", `
+	select city_key from users where id=? for update
+	`); err != nil {
+		return err
+	}
+	return nil
+}
+
+// moveCityUser counts the user in the new city if it has changed, the user is locked until tx ends,
+// so that concurrent updates don't both move the user out of the old city
+func (m *MysqlStorage) moveCityUser(ctx context.Context, tx *sql.Tx, user *model.User) error {
+	var oldKey string
+	err := tx.Stmt(m.getUserCitySt).QueryRowContext(ctx, user.ID.String()).Scan(&oldKey)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	newKey := model.CityKey(user.City)
+	if oldKey == newKey {
+		return nil
+	}
+	remove := func() error {
+		_, err := tx.Stmt(m.removeCityUserSt).ExecContext(ctx, oldKey)
+		return err
+	}
+	add := func() error {
+		_, err := tx.Stmt(m.addCityUserSt).ExecContext(ctx, newKey, user.City)
+		return err
+	}
+	// cities are locked in the order of keys, so that users moving both ways don't deadlock
+	if oldKey > newKey {
+		remove, add = add, remove
+	}
+	if err := remove(); err != nil {
+		return err
+	}
+	return add()
+}
+
+func (m *MysqlStorage) UsersByCity(ctx context.Context, city string, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	users, next, err := m.queryUsersPage(ctx, m.usersByCitySt, cursor, limit, model.CityKey(city))
+	if err == ErrInvalidCursor {
+		return nil, "", err
+	}
+	return users, next, errors.Wrap(err, "UsersByCity")
+}
+
+func (m *MysqlStorage) Cities(ctx context.Context, limit int) ([]*model.City, error) {
+	var cities []*model.City
+	err := m.queryRead(ctx, m.citiesSt, func(rows *sql.Rows) error {
+		cities = make([]*model.City, 0)
+		for rows.Next() {
+			var city model.City
+			if err := rows.Scan(&city.Name, &city.Users); err != nil {
+				return err
+			}
+			cities = append(cities, &city)
+		}
+		return nil
+	}, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cities")
+	}
+	return cities, nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+func (m *MysqlStorage) prepareDeleteStatements() error {
+	var err error
+	if m.deleteUserTokensSt, err = prepare(m.db, "delete_user_tokens", `
+	delete from auth_tokens where userID=?
+	`); err != nil {
+		return err
+	}
+	if m.deleteUserFriendshipsSt, err = prepare(m.db, "delete_user_friendships", `
+	delete from friendships where userID=? or friendID=?
+	`); err != nil {
+		return err
+	}
+	if m.deleteUserPostsSt, err = prepare(m.db, "delete_user_posts", `
+	delete from posts where authorID=?
+	`); err != nil {
+		return err
+	}
+	if m.deleteUserSt, err = prepare(m.db, "delete_user", `
+	delete from users where id=?
+	`); err != nil {
+		return err
+	}
+	if m.insertTombstoneSt, err = prepare(m.db, "insert_tombstone", `
+	insert into deleted_usernames(username, released_at) values (?, ?)
+	on duplicate key update released_at=values(released_at)
+	`); err != nil {
+		return err
+	}
+	if m.isTombstonedSt, err = prepare(m.db, "is_tombstoned", `
+	select count(*) from deleted_usernames where username=? and released_at>?
+	`); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MysqlStorage) DeleteUser(ctx context.Context, userID uuid.UUID, releaseAt time.Time) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "DeleteUser")
+	}
+	defer tx.Rollback()
+
+	user, err := m.getUser(ctx, tx.Stmt(m.getUserSt), userID.String())
+	if err != nil {
+		return errors.Wrap(err, "DeleteUser")
+	}
+	if user == nil {
+		return nil
+	}
+	id := userID.String()
+	// the user is locked, so that a concurrent update doesn't move them to another city meanwhile
+	var cityKey string
+	if err := tx.Stmt(m.getUserCitySt).QueryRowContext(ctx, id).Scan(&cityKey); err != nil {
+		return errors.Wrap(err, "DeleteUser: city")
+	}
+	if _, err := tx.Stmt(m.deleteUserTokensSt).ExecContext(ctx, id); err != nil {
+		return errors.Wrap(err, "DeleteUser: tokens")
+	}
+	if _, err := tx.Stmt(m.deleteUserFriendshipsSt).ExecContext(ctx, id, id); err != nil {
+		return errors.Wrap(err, "DeleteUser: friendships")
+	}
+	if _, err := tx.Stmt(m.deleteUserInterestsSt).ExecContext(ctx, id); err != nil {
+		return errors.Wrap(err, "DeleteUser: interests")
+	}
+	if _, err := tx.Stmt(m.deleteUserPostsSt).ExecContext(ctx, id); err != nil {
+		return errors.Wrap(err, "DeleteUser: posts")
+	}
+	if _, err := tx.Stmt(m.deleteUserSt).ExecContext(ctx, id); err != nil {
+		return errors.Wrap(err, "DeleteUser: user")
+	}
+	if _, err := tx.Stmt(m.removeCityUserSt).ExecContext(ctx, cityKey); err != nil {
+		return errors.Wrap(err, "DeleteUser: city")
+	}
+	if _, err := tx.Stmt(m.insertTombstoneSt).ExecContext(ctx, user.Username, releaseAt.UTC()); err != nil {
+		return errors.Wrap(err, "DeleteUser: tombstone")
+	}
+	return errors.Wrap(tx.Commit(), "DeleteUser")
+}
+
+func (m *MysqlStorage) isTombstoned(ctx context.Context, username string) (bool, error) {
+	var count int
+	err := m.isTombstonedSt.QueryRowContext(ctx, username, time.Now().UTC()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
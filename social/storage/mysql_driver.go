@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"time"
+)
+
+// instrumentedDriver is the mysql driver which traces prepared statements
+// and observes their latency and errors in metrics
+const instrumentedDriver = "mysql-instrumented"
+
+func init() {
+	sql.Register(instrumentedDriver, mysqlInstrumented{})
+}
+
+// mysqlConn is the set of interfaces implemented by connections of the mysql driver
+type mysqlConn interface {
+	driver.Conn
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.Pinger
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.NamedValueChecker
+	driver.SessionResetter
+}
+
+// mysqlStmt is the set of interfaces implemented by statements of the mysql driver
+type mysqlStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+type mysqlInstrumented struct{}
+
+func (mysqlInstrumented) Open(dsn string) (driver.Conn, error) {
+	conn, err := mysql.MySQLDriver{}.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn.(mysqlConn)}, nil
+}
+
+// instrumentedConn wraps statements prepared on the connection, everything else is passed to the driver
+type instrumentedConn struct {
+	mysqlConn
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	st, err := c.mysqlConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{mysqlStmt: st.(mysqlStmt), name: statementName(query), query: query}, nil
+}
+
+type instrumentedStmt struct {
+	mysqlStmt
+	name  string
+	query string
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (res driver.Result, err error) {
+	ctx, span := s.startSpan(ctx)
+	defer endSpan(ctx, span, &err)
+	start := time.Now()
+	res, err = s.mysqlStmt.ExecContext(ctx, args)
+	observeStatement(s.name, start, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	ctx, span := s.startSpan(ctx)
+	defer endSpan(ctx, span, &err)
+	start := time.Now()
+	rows, err = s.mysqlStmt.QueryContext(ctx, args)
+	observeStatement(s.name, start, err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) startSpan(ctx context.Context) (context.Context, trace.Span) {
+	return startSpan(ctx, "mysql."+s.name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(standard.DBTypeKey.String("sql"), standard.DBStatementKey.String(s.query)))
+}
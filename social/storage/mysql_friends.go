@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	friendshipPending  = "pending"
+	friendshipAccepted = "accepted"
+)
+
+func (m *MysqlStorage) prepareFriendStatements() error {
+	var err error
+	if m.getFriendshipsSt, err = m.prepareRead("get_friendships", `
+	select userID, status from friendships where (userID=? and friendID=?) or (userID=? and friendID=?)
+	`); err != nil {
+		return err
+	}
+	// rows of both users are locked in the order of ids, there may be no friendship rows to lock yet
+	if m.lockFriendPairSt, err = prepare(m.db, "lock_friend_pair", `
+	select id from users where id in (?, ?) order by id for update
+	`); err != nil {
+		return err
+	}
+	if m.insertFriendRequestSt, err = prepare(m.db, "insert_friend_request", `
+	insert into friendships(userID, friendID, status) values (?, ?, 'pending')
+	`); err != nil {
+		return err
+	}
+	if m.acceptFriendRequestSt, err = prepare(m.db, "accept_friend_request", `
+	update friendships set status='accepted' where userID=? and friendID=? and status='pending'
+	`); err != nil {
+		return err
+	}
+	if m.insertAcceptedFriendSt, err = prepare(m.db, "insert_accepted_friend", `
+	insert into friendships(userID, friendID, status) values (?, ?, 'accepted')
+	on duplicate key update status='accepted'
+	`); err != nil {
+		return err
+	}
+	if m.deleteFriendRequestSt, err = prepare(m.db, "delete_friend_request", `
+	delete from friendships where userID=? and friendID=? and status='pending'
+	`); err != nil {
+		return err
+	}
+	if m.deleteFriendshipSt, err = prepare(m.db, "delete_friendship", `
+	delete from friendships where (userID=? and friendID=?) or (userID=? and friendID=?)
+	`); err != nil {
+		return err
+	}
+	if m.listFriendsSt, err = m.prepareRead("list_friends", `
+	select u.id, u.username, u.password, u.firstName, u.lastName, u.age, u.gender, u.city, u.created_at
+	from friendships f join users u on u.id=f.friendID
+	where f.userID=? and f.status='accepted' order by u.username
+	`); err != nil {
+		return err
+	}
+	if m.listPendingFriendsSt, err = m.prepareRead("list_pending_friends", `
+	select u.id, u.username, u.password, u.firstName, u.lastName, u.age, u.gender, u.city, u.created_at
+	from friendships f join users u on u.id=f.userID
+	where f.friendID=? and f.status='pending' order by f.createdAt desc, u.username
+	`); err != nil {
+		return err
+	}
+	// posts are pushed to followers' feeds, a replica might miss a follower whose feed was just rebuilt
+	if m.listFollowersSt, err = prepare(m.db, "list_followers", `
+	select userID from friendships where friendID=?
+	`); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MysqlStorage) GetFriendshipStatus(ctx context.Context, userID uuid.UUID, otherID uuid.UUID) (model.FriendshipStatus, error) {
+	var status model.FriendshipStatus
+	err := m.read(func(r *replica) (err error) {
+		status, err = m.friendshipStatus(ctx, m.replicaStmt(r, m.getFriendshipsSt), userID, otherID)
+		return err
+	})
+	return status, err
+}
+
+func (m *MysqlStorage) friendshipStatus(ctx context.Context, st *sql.Stmt, userID uuid.UUID, otherID uuid.UUID) (model.FriendshipStatus, error) {
+	rows, err := st.QueryContext(ctx, userID.String(), otherID.String(), otherID.String(), userID.String())
+	if err != nil {
+		return "", errors.Wrap(err, "GetFriendshipStatus")
+	}
+	defer rows.Close()
+
+	result := model.FriendshipNone
+	for rows.Next() {
+		var dbUserID, status string
+		if err := rows.Scan(&dbUserID, &status); err != nil {
+			return "", errors.Wrap(err, "GetFriendshipStatus")
+		}
+		switch {
+		case status == friendshipAccepted:
+			result = model.FriendshipAccepted
+		case dbUserID == userID.String():
+			result = model.FriendshipRequested
+		default:
+			result = model.FriendshipIncoming
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", errors.Wrap(err, "GetFriendshipStatus")
+	}
+	return result, nil
+}
+
+func (m *MysqlStorage) SendFriendRequest(ctx context.Context, from uuid.UUID, to uuid.UUID) error {
+	if uuid.Equal(from, to) {
+		return ErrSelfFriendship
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "SendFriendRequest")
+	}
+	defer tx.Rollback()
+
+	// requests sent to each other concurrently are serialized, so the second one sees the first
+	// and accepts it instead of inserting another pending row
+	rows, err := tx.Stmt(m.lockFriendPairSt).QueryContext(ctx, from.String(), to.String())
+	if err != nil {
+		return errors.Wrap(err, "SendFriendRequest: failed to lock users")
+	}
+	if err := rows.Close(); err != nil {
+		return errors.Wrap(err, "SendFriendRequest: failed to lock users")
+	}
+	status, err := m.friendshipStatus(ctx, tx.Stmt(m.getFriendshipsSt), from, to)
+	if err != nil {
+		return errors.Wrap(err, "SendFriendRequest")
+	}
+	switch status {
+	case model.FriendshipAccepted, model.FriendshipRequested:
+		return nil
+	case model.FriendshipIncoming:
+		// both users want to be friends, so just accepting the existing request
+		if err := m.acceptFriendRequest(ctx, tx, from, to); err != nil {
+			return errors.Wrap(err, "SendFriendRequest")
+		}
+	default:
+		if _, err := tx.Stmt(m.insertFriendRequestSt).ExecContext(ctx, from.String(), to.String()); err != nil {
+			return errors.Wrap(err, "SendFriendRequest")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "SendFriendRequest")
+}
+
+func (m *MysqlStorage) AcceptFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "AcceptFriendRequest")
+	}
+	defer tx.Rollback()
+
+	if err := m.acceptFriendRequest(ctx, tx, userID, requesterID); err != nil {
+		if err == ErrFriendRequestNotFound {
+			return err
+		}
+		return errors.Wrap(err, "AcceptFriendRequest")
+	}
+	return errors.Wrap(tx.Commit(), "AcceptFriendRequest")
+}
+
+func (m *MysqlStorage) acceptFriendRequest(ctx context.Context, tx *sql.Tx, userID uuid.UUID, requesterID uuid.UUID) error {
+	res, err := tx.Stmt(m.acceptFriendRequestSt).ExecContext(ctx, requesterID.String(), userID.String())
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrFriendRequestNotFound
+	}
+	_, err = tx.Stmt(m.insertAcceptedFriendSt).ExecContext(ctx, userID.String(), requesterID.String())
+	return err
+}
+
+func (m *MysqlStorage) DeclineFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) error {
+	res, err := m.deleteFriendRequestSt.ExecContext(ctx, requesterID.String(), userID.String())
+	if err != nil {
+		return errors.Wrap(err, "DeclineFriendRequest")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "DeclineFriendRequest")
+	}
+	if affected == 0 {
+		return ErrFriendRequestNotFound
+	}
+	return nil
+}
+
+func (m *MysqlStorage) RemoveFriend(ctx context.Context, userID uuid.UUID, friendID uuid.UUID) error {
+	_, err := m.deleteFriendshipSt.ExecContext(ctx, userID.String(), friendID.String(), friendID.String(), userID.String())
+	if err != nil {
+		return errors.Wrap(err, "RemoveFriend")
+	}
+	return nil
+}
+
+func (m *MysqlStorage) ListFriends(ctx context.Context, userID uuid.UUID) ([]*model.User, error) {
+	var users []*model.User
+	err := m.queryRead(ctx, m.listFriendsSt, func(rows *sql.Rows) (err error) {
+		users, err = m.scanUsers(rows)
+		return err
+	}, userID.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "ListFriends")
+	}
+	if err := m.fillInterests(ctx, users...); err != nil {
+		return nil, errors.Wrap(err, "ListFriends")
+	}
+	return users, nil
+}
+
+func (m *MysqlStorage) ListPendingRequests(ctx context.Context, userID uuid.UUID) ([]*model.User, error) {
+	var users []*model.User
+	err := m.queryRead(ctx, m.listPendingFriendsSt, func(rows *sql.Rows) (err error) {
+		users, err = m.scanUsers(rows)
+		return err
+	}, userID.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "ListPendingRequests")
+	}
+	if err := m.fillInterests(ctx, users...); err != nil {
+		return nil, errors.Wrap(err, "ListPendingRequests")
+	}
+	return users, nil
+}
+
+func (m *MysqlStorage) ListFollowerIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := m.listFollowersSt.QueryContext(ctx, userID.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "ListFollowerIDs")
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var idStr string
+		if err := rows.Scan(&idStr); err != nil {
+			return nil, errors.Wrap(err, "ListFollowerIDs")
+		}
+		id, err := uuid.FromString(idStr)
+		if err != nil {
+			return nil, errors.Wrap(err, "ListFollowerIDs: failed to parse user id")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "ListFollowerIDs")
+	}
+	return ids, nil
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"strings"
+)
+
+func (m *MysqlStorage) prepareInterestStatements() error {
+	var err error
+	if m.upsertInterestSt, err = prepare(m.db, "upsert_interest", `
+	insert into interests(tag) values (?) on duplicate key update tag=tag
+	`); err != nil {
+		return err
+	}
+	if m.findInterestSt, err = prepare(m.db, "find_interest", `
+	select id from interests where tag=?
+	`); err != nil {
+		return err
+	}
+	if m.insertUserInterestSt, err = prepare(m.db, "insert_user_interest", `
+	insert into user_interests(userID, interestID, position) values (?, ?, ?)
+	`); err != nil {
+		return err
+	}
+	if m.deleteUserInterestsSt, err = prepare(m.db, "delete_user_interests", `
+	delete from user_interests where userID=?
+	`); err != nil {
+		return err
+	}
+	if m.usersByInterestSt, err = m.prepareRead("users_by_interest", `
+	select u.id, u.username, u.password, u.firstName, u.lastName, u.age, u.gender, u.city, u.created_at
+	from interests i join user_interests ui on ui.interestID=i.id join users u on u.id=ui.userID
+	where i.tag=? and (u.created_at, u.id) > (?, ?) order by u.created_at, u.id limit ?
+	`); err != nil {
+		return err
+	}
+	if m.listInterestIDsSt, err = m.prepareRead("list_interest_ids", `
+	select interestID from user_interests where userID=? order by position limit ?
+	`); err != nil {
+		return err
+	}
+	return nil
+}
+
+// saveInterests replaces interests of the user, tags are expected to be normalized by model
+func (m *MysqlStorage) saveInterests(ctx context.Context, tx *sql.Tx, user *model.User) error {
+	if _, err := tx.Stmt(m.deleteUserInterestsSt).ExecContext(ctx, user.ID.String()); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(user.Interests))
+	for idx, tag := range user.Interests {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		if _, err := tx.Stmt(m.upsertInterestSt).ExecContext(ctx, tag); err != nil {
+			return err
+		}
+		var interestID int64
+		if err := tx.Stmt(m.findInterestSt).QueryRowContext(ctx, tag).Scan(&interestID); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(m.insertUserInterestSt).ExecContext(ctx, user.ID.String(), interestID, idx+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxInterestUsers limits users whose interests are read by a single query, lists of friends may be long
+const maxInterestUsers = 1000
+
+// fillInterests reads interests of all the users at once, nil users are skipped
+func (m *MysqlStorage) fillInterests(ctx context.Context, users ...*model.User) error {
+	byID := make(map[string][]*model.User, len(users))
+	ids := make([]interface{}, 0, len(users))
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		user.Interests = make([]string, 0)
+		id := user.ID.String()
+		if _, ok := byID[id]; !ok {
+			ids = append(ids, id)
+		}
+		byID[id] = append(byID[id], user)
+	}
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > maxInterestUsers {
+			chunk = chunk[:maxInterestUsers]
+		}
+		ids = ids[len(chunk):]
+		if err := m.readInterests(ctx, byID, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MysqlStorage) readInterests(ctx context.Context, byID map[string][]*model.User, ids []interface{}) error {
+	query := listUsersInterestsBatch + placeholders(1, len(ids)) + ` order by ui.userID, ui.position`
+	return m.read(func(r *replica) error {
+		rows, err := m.replicaDB(r).QueryContext(ctx, query, ids...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		// the read may be retried, so interests are collected before being set
+		interests := make(map[string][]string, len(ids))
+		for rows.Next() {
+			var userID, tag string
+			if err := rows.Scan(&userID, &tag); err != nil {
+				return err
+			}
+			interests[userID] = append(interests[userID], tag)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for userID, tags := range interests {
+			for _, user := range byID[userID] {
+				user.Interests = append(make([]string, 0, len(tags)), tags...)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MysqlStorage) UsersByInterest(ctx context.Context, tag string, cursor Cursor, limit int) ([]*model.User, Cursor, error) {
+	users, next, err := m.queryUsersPage(ctx, m.usersByInterestSt, cursor, limit, tag)
+	if err == ErrInvalidCursor {
+		return nil, "", err
+	}
+	return users, next, errors.Wrap(err, "UsersByInterest")
+}
+
+const (
+	// maxSimilarInterests limits interests of the user which similar users are looked up by, the first listed ones are taken
+	maxSimilarInterests = 20
+	// maxSimilarFanIn limits users taken per interest, so that popular interests don't make the query scan
+	// every user who has them. Users sharing several interests are still likely to be among them.
+	maxSimilarFanIn = 1000
+)
+
+// SimilarUsers counts shared interests among at most maxSimilarFanIn users of each interest,
+// one query per interest is unioned, as MySQL can't limit rows per group of a single join
+func (m *MysqlStorage) SimilarUsers(ctx context.Context, userID uuid.UUID, limit int) ([]*model.User, error) {
+	var interestIDs []int64
+	err := m.queryRead(ctx, m.listInterestIDsSt, func(rows *sql.Rows) error {
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			interestIDs = append(interestIDs, id)
+		}
+		return nil
+	}, userID.String(), maxSimilarInterests)
+	if err != nil {
+		return nil, errors.Wrap(err, "SimilarUsers")
+	}
+	if len(interestIDs) == 0 {
+		return []*model.User{}, nil
+	}
+
+	candidates := make([]string, 0, len(interestIDs))
+	args := make([]interface{}, 0, len(interestIDs)*3+1)
+	for _, id := range interestIDs {
+		candidates = append(candidates, similarUsersCandidates)
+		args = append(args, id, userID.String(), maxSimilarFanIn)
+	}
+	query := similarUsersBatch + strings.Join(candidates, " union all ") + similarUsersBatchEnd
+	args = append(args, limit)
+	var users []*model.User
+	err = m.read(func(r *replica) error {
+		rows, err := m.replicaDB(r).QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		users, err = m.scanUsers(rows)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "SimilarUsers")
+	}
+	if err := m.fillInterests(ctx, users...); err != nil {
+		return nil, errors.Wrap(err, "SimilarUsers")
+	}
+	return users, nil
+}
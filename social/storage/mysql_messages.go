@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+)
+
+type MysqlMessageStorage struct {
+	db    *sql.DB
+	stats *dbStats
+
+	insertMessageSt *sql.Stmt
+	upsertDialogSt  *sql.Stmt
+	listMessagesSt  *sql.Stmt
+	listDialogsSt   *sql.Stmt
+
+	deleteDialogMessagesSt *sql.Stmt
+	deleteDialogSt         *sql.Stmt
+}
+
+func NewMysqlMessageStorage(cfg *config.MySQL) (*MysqlMessageStorage, error) {
+	db, err := openDB(cfg, cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	storage := &MysqlMessageStorage{db: db, stats: newDBStats(map[string]*sql.DB{"messages": db})}
+	if err := storage.prepareStatements(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (m *MysqlMessageStorage) Close() error {
+	return m.db.Close()
+}
+
+func (m *MysqlMessageStorage) Describe(ch chan<- *prometheus.Desc) {
+	m.stats.Describe(ch)
+}
+
+func (m *MysqlMessageStorage) Collect(ch chan<- prometheus.Metric) {
+	m.stats.Collect(ch)
+}
+
+func (m *MysqlMessageStorage) prepareStatements() error {
+	var err error
+	if m.insertMessageSt, err = prepare(m.db, "insert_message", `
+	insert into messages(dialogID, id, authorID, recipientID, text, created_at) values (?, ?, ?, ?, ?, ?)
+	`); err != nil {
+		return err
+	}
+	if m.upsertDialogSt, err = prepare(m.db, "upsert_dialog", `
+	insert into dialogs(userID, otherID, otherUsername, dialogID, last_message_at) values (?, ?, ?, ?, ?)
+	on duplicate key update last_message_at=greatest(last_message_at, values(last_message_at))
+	`); err != nil {
+		return err
+	}
+	if m.listMessagesSt, err = prepare(m.db, "list_messages", `
+	select dialogID, id, authorID, recipientID, text, created_at from messages
+	where dialogID=? order by created_at desc, id desc limit ?
+	`); err != nil {
+		return err
+	}
+	if m.listDialogsSt, err = prepare(m.db, "list_dialogs", `
+	select dialogID, userID, otherID, otherUsername, last_message_at
+	from dialogs where userID=? order by last_message_at desc
+	`); err != nil {
+		return err
+	}
+	if m.deleteDialogMessagesSt, err = prepare(m.db, "delete_dialog_messages", `
+	delete from messages where dialogID=?
+	`); err != nil {
+		return err
+	}
+	if m.deleteDialogSt, err = prepare(m.db, "delete_dialog", `
+	delete from dialogs where userID=? and otherID=?
+	`); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MysqlMessageStorage) SendMessage(ctx context.Context, msg *model.Message, author, recipient string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "SendMessage")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(m.insertMessageSt).ExecContext(ctx, msg.DialogID.String(), msg.ID.String(),
+		msg.AuthorID.String(), msg.RecipientID.String(), msg.Text, msg.CreatedAt); err != nil {
+		return errors.Wrap(err, "SendMessage: failed to insert message")
+	}
+	upsertDialog := tx.Stmt(m.upsertDialogSt)
+	for _, d := range dialogsOf(msg, author, recipient) {
+		if _, err := upsertDialog.ExecContext(ctx, d.UserID.String(), d.OtherID.String(), d.Other,
+			d.ID.String(), d.LastMessageAt); err != nil {
+			return errors.Wrap(err, "SendMessage: failed to update dialog")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "SendMessage")
+}
+
+func (m *MysqlMessageStorage) ListMessages(ctx context.Context, dialogID uuid.UUID, limit int) ([]*model.Message, error) {
+	rows, err := m.listMessagesSt.QueryContext(ctx, dialogID.String(), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListMessages")
+	}
+	defer rows.Close()
+
+	messages := make([]*model.Message, 0)
+	for rows.Next() {
+		var msg model.Message
+		var dbDialogID, id, authorID, recipientID string
+		if err := rows.Scan(&dbDialogID, &id, &authorID, &recipientID, &msg.Text, &msg.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "ListMessages")
+		}
+		if err := parseUUIDs([]string{dbDialogID, id, authorID, recipientID},
+			&msg.DialogID, &msg.ID, &msg.AuthorID, &msg.RecipientID); err != nil {
+			return nil, errors.Wrap(err, "ListMessages")
+		}
+		messages = append(messages, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "ListMessages")
+	}
+	// reading latest messages, but showing them in chronological order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (m *MysqlMessageStorage) ListDialogs(ctx context.Context, userID uuid.UUID) ([]*model.Dialog, error) {
+	rows, err := m.listDialogsSt.QueryContext(ctx, userID.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "ListDialogs")
+	}
+	defer rows.Close()
+
+	dialogs := make([]*model.Dialog, 0)
+	for rows.Next() {
+		var d model.Dialog
+		var id, dbUserID, otherID string
+		if err := rows.Scan(&id, &dbUserID, &otherID, &d.Other, &d.LastMessageAt); err != nil {
+			return nil, errors.Wrap(err, "ListDialogs")
+		}
+		if err := parseUUIDs([]string{id, dbUserID, otherID}, &d.ID, &d.UserID, &d.OtherID); err != nil {
+			return nil, errors.Wrap(err, "ListDialogs")
+		}
+		dialogs = append(dialogs, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "ListDialogs")
+	}
+	return dialogs, nil
+}
+
+// DeleteUserDialogs deletes messages dialog by dialog, so that it keeps working once messages are sharded by dialog id
+func (m *MysqlMessageStorage) DeleteUserDialogs(ctx context.Context, userID uuid.UUID) error {
+	dialogs, err := m.ListDialogs(ctx, userID)
+	if err != nil {
+		return errors.Wrap(err, "DeleteUserDialogs")
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "DeleteUserDialogs")
+	}
+	defer tx.Rollback()
+
+	deleteMessages, deleteDialog := tx.Stmt(m.deleteDialogMessagesSt), tx.Stmt(m.deleteDialogSt)
+	for _, d := range dialogs {
+		if _, err := deleteMessages.ExecContext(ctx, d.ID.String()); err != nil {
+			return errors.Wrap(err, "DeleteUserDialogs: messages")
+		}
+		for _, pair := range [][2]uuid.UUID{{d.UserID, d.OtherID}, {d.OtherID, d.UserID}} {
+			if _, err := deleteDialog.ExecContext(ctx, pair[0].String(), pair[1].String()); err != nil {
+				return errors.Wrap(err, "DeleteUserDialogs: dialog")
+			}
+		}
+	}
+	return errors.Wrap(tx.Commit(), "DeleteUserDialogs")
+}
+
+// parseUUIDs parses every string into the destination with the same index
+func parseUUIDs(strs []string, dsts ...*uuid.UUID) error {
+	for idx, str := range strs {
+		parsed, err := uuid.FromString(str)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse uuid")
+		}
+		*dsts[idx] = parsed
+	}
+	return nil
+}
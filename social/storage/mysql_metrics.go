@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unnamedStatement labels queries which were not prepared by prepare
+const unnamedStatement = "unnamed"
+
+var (
+	statementDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "social",
+		Subsystem: "mysql",
+		Name:      "statement_duration_seconds",
+		Help:      "Latency of executing prepared statements, rows reading is not included.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"statement"})
+	statementErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "social",
+		Subsystem: "mysql",
+		Name:      "statement_errors_total",
+		Help:      "Number of failed executions of prepared statements.",
+	}, []string{"statement"})
+)
+
+// statementNames maps query text to the name given to prepare,
+// so the same statement prepared on replicas and in transactions has the same name
+var statementNames = struct {
+	sync.RWMutex
+	names map[string]string
+}{names: make(map[string]string)}
+
+func init() {
+	prometheus.MustRegister(statementDuration, statementErrors)
+}
+
+// prepare prepares the statement and names it in metrics and traces
+func prepare(db *sql.DB, name, query string) (*sql.Stmt, error) {
+	statementNames.Lock()
+	statementNames.names[query] = name
+	statementNames.Unlock()
+	return db.Prepare(query)
+}
+
+func statementName(query string) string {
+	statementNames.RLock()
+	defer statementNames.RUnlock()
+	if name, ok := statementNames.names[query]; ok {
+		return name
+	}
+	for _, st := range batchStatements {
+		if strings.HasPrefix(query, st.prefix) {
+			return st.name
+		}
+	}
+	return unnamedStatement
+}
+
+func observeStatement(name string, start time.Time, err error) {
+	statementDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		statementErrors.WithLabelValues(name).Inc()
+	}
+}
+
+// dbStats exports sql.DBStats of connection pools, pools are distinguished by the pool label
+type dbStats struct {
+	pools []*poolStats
+}
+
+type poolStats struct {
+	db    *sql.DB
+	descs poolDescs
+}
+
+type poolDescs struct {
+	maxOpen, open, inUse, idle                          *prometheus.Desc
+	waitCount, waitDuration, maxIdleClosed, maxLifetime *prometheus.Desc
+}
+
+func newDBStats(dbs map[string]*sql.DB) *dbStats {
+	stats := &dbStats{}
+	for pool, db := range dbs {
+		desc := func(name, help string) *prometheus.Desc {
+			return prometheus.NewDesc(prometheus.BuildFQName("social", "mysql_pool", name), help,
+				nil, prometheus.Labels{"pool": pool})
+		}
+		stats.pools = append(stats.pools, &poolStats{db: db, descs: poolDescs{
+			maxOpen:       desc("max_open_connections", "Maximum number of open connections, 0 is unlimited."),
+			open:          desc("open_connections", "Number of open connections, in use and idle."),
+			inUse:         desc("in_use_connections", "Number of connections in use."),
+			idle:          desc("idle_connections", "Number of idle connections."),
+			waitCount:     desc("wait_count_total", "Number of times a connection was waited for."),
+			waitDuration:  desc("wait_duration_seconds_total", "Total time spent waiting for a connection."),
+			maxIdleClosed: desc("max_idle_closed_total", "Number of connections closed due to max idle connections."),
+			maxLifetime:   desc("max_lifetime_closed_total", "Number of connections closed due to max lifetime."),
+		}})
+	}
+	return stats
+}
+
+func (s *dbStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, p := range s.pools {
+		d := p.descs
+		for _, desc := range []*prometheus.Desc{d.maxOpen, d.open, d.inUse, d.idle,
+			d.waitCount, d.waitDuration, d.maxIdleClosed, d.maxLifetime} {
+			ch <- desc
+		}
+	}
+}
+
+func (s *dbStats) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range s.pools {
+		stats, d := p.db.Stats(), p.descs
+		ch <- prometheus.MustNewConstMetric(d.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+		ch <- prometheus.MustNewConstMetric(d.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+		ch <- prometheus.MustNewConstMetric(d.inUse, prometheus.GaugeValue, float64(stats.InUse))
+		ch <- prometheus.MustNewConstMetric(d.idle, prometheus.GaugeValue, float64(stats.Idle))
+		ch <- prometheus.MustNewConstMetric(d.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+		ch <- prometheus.MustNewConstMetric(d.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+		ch <- prometheus.MustNewConstMetric(d.maxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+		ch <- prometheus.MustNewConstMetric(d.maxLifetime, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+	}
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+func (m *MysqlStorage) preparePostStatements() error {
+	var err error
+	if m.insertPostSt, err = prepare(m.db, "insert_post", `
+	insert into posts(id, authorID, text, created_at) values (?, ?, ?, ?)
+	`); err != nil {
+		return err
+	}
+	if m.listPostsByAuthorSt, err = m.prepareRead("list_posts_by_author", `
+	select p.id, p.authorID, u.username, p.text, p.created_at
+	from posts p join users u on u.id=p.authorID
+	where p.authorID=? order by p.created_at desc, p.id desc limit ?
+	`); err != nil {
+		return err
+	}
+	// feeds are rebuilt when they aren't cached, a replica might miss posts already pushed to cached feeds
+	if m.listFeedSt, err = prepare(m.db, "list_feed", `
+	select p.id, p.authorID, u.username, p.text, p.created_at
+	from friendships f join posts p on p.authorID=f.friendID join users u on u.id=p.authorID
+	where f.userID=? order by p.created_at desc, p.id desc limit ?
+	`); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MysqlStorage) CreatePost(ctx context.Context, post *model.Post) error {
+	_, err := m.insertPostSt.ExecContext(ctx, post.ID.String(), post.AuthorID.String(), post.Text, post.CreatedAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert post")
+	}
+	return nil
+}
+
+func (m *MysqlStorage) ListPostsByAuthor(ctx context.Context, authorID uuid.UUID, limit int) ([]*model.Post, error) {
+	var posts []*model.Post
+	err := m.queryRead(ctx, m.listPostsByAuthorSt, func(rows *sql.Rows) (err error) {
+		posts, err = scanPosts(rows)
+		return err
+	}, authorID.String(), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListPostsByAuthor")
+	}
+	return posts, nil
+}
+
+func (m *MysqlStorage) ListFeed(ctx context.Context, userID uuid.UUID, limit int) ([]*model.Post, error) {
+	rows, err := m.listFeedSt.QueryContext(ctx, userID.String(), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListFeed")
+	}
+	posts, err := scanPosts(rows)
+	return posts, errors.Wrap(err, "ListFeed")
+}
+
+func scanPosts(rows *sql.Rows) ([]*model.Post, error) {
+	defer rows.Close()
+	posts := make([]*model.Post, 0)
+	for rows.Next() {
+		var p model.Post
+		var id, authorID string
+		if err := rows.Scan(&id, &authorID, &p.Author, &p.Text, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		var err error
+		if p.ID, err = uuid.FromString(id); err != nil {
+			return nil, errors.Wrap(err, "failed to parse post id")
+		}
+		if p.AuthorID, err = uuid.FromString(authorID); err != nil {
+			return nil, errors.Wrap(err, "failed to parse author id")
+		}
+		posts = append(posts, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/chocosin/otus-hl/social/config"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaCheckInterval = time.Second * 5
+	replicaPingTimeout   = time.Second * 2
+)
+
+// replica serves read-only statements, it is ejected from rotation
+// after a connection failure until it responds to ping again
+type replica struct {
+	host    string
+	logger  zerolog.Logger
+	db      *sql.DB
+	healthy int32
+	// stmts maps statements prepared on the primary to the same statements prepared on the replica,
+	// it is nil until the replica is reachable
+	stmts map[*sql.Stmt]*sql.Stmt
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *replica) setHealthy(healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&r.healthy, value) != value {
+		r.logger.Info().Str("replica", r.host).Bool("healthy", healthy).Msg("mysql replica health changed")
+	}
+}
+
+// prepareRead prepares read-only statement on the primary and remembers it to be prepared on replicas
+func (m *MysqlStorage) prepareRead(name, query string) (*sql.Stmt, error) {
+	st, err := prepare(m.db, name, query)
+	if err != nil {
+		return nil, err
+	}
+	m.readQueries[st] = query
+	return st, nil
+}
+
+// connectReplicas doesn't fail if a replica is not reachable, it is just kept out of rotation
+func (m *MysqlStorage) connectReplicas(cfg *config.MySQL) error {
+	for _, host := range cfg.ReplicaHosts {
+		db, err := openDB(cfg, host)
+		if err != nil {
+			return err
+		}
+		r := &replica{host: host, db: db, logger: m.logger}
+		m.replicas = append(m.replicas, r)
+		m.checkReplica(r)
+	}
+	if len(m.replicas) > 0 {
+		go m.checkReplicas()
+	}
+	return nil
+}
+
+func (m *MysqlStorage) prepareReplica(r *replica) error {
+	stmts := make(map[*sql.Stmt]*sql.Stmt, len(m.readQueries))
+	for primarySt, query := range m.readQueries {
+		st, err := r.db.Prepare(query)
+		if err != nil {
+			for _, prepared := range stmts {
+				prepared.Close()
+			}
+			return err
+		}
+		stmts[primarySt] = st
+	}
+	r.stmts = stmts
+	return nil
+}
+
+// healthyReplica returns the next healthy replica, nil if there are none
+func (m *MysqlStorage) healthyReplica() *replica {
+	count := len(m.replicas)
+	for idx := 0; idx < count; idx++ {
+		r := m.replicas[int(atomic.AddUint32(&m.nextReplica, 1))%count]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// readStmt returns the statement prepared on the next healthy replica,
+// falls back to the primary if there are no healthy replicas
+func (m *MysqlStorage) readStmt(primarySt *sql.Stmt) (*sql.Stmt, *replica) {
+	r := m.healthyReplica()
+	return m.replicaStmt(r, primarySt), r
+}
+
+// read calls fn with the next healthy replica, or with nil to read from the primary if there are none.
+// If the replica fails, it is ejected and fn is retried once on the primary, so that the request
+// doesn't fail. fn should read all the rows, a replica may fail in the middle of iteration.
+func (m *MysqlStorage) read(fn func(r *replica) error) error {
+	r := m.healthyReplica()
+	err := fn(r)
+	if m.readFailed(r, err) {
+		err = fn(nil)
+	}
+	return err
+}
+
+// queryRead queries the read-only statement and passes its rows to scan, see read for retries
+func (m *MysqlStorage) queryRead(ctx context.Context, primarySt *sql.Stmt, scan func(rows *sql.Rows) error, args ...interface{}) error {
+	return m.read(func(r *replica) error {
+		rows, err := m.replicaStmt(r, primarySt).QueryContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if err := scan(rows); err != nil {
+			return err
+		}
+		return rows.Err()
+	})
+}
+
+// readFailed ejects the replica if the error means it is not reachable, returns whether it was ejected
+func (m *MysqlStorage) readFailed(r *replica, err error) bool {
+	err = errors.Cause(err)
+	// canceled request says nothing about the replica
+	if r == nil || err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if _, ok := err.(net.Error); ok || err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		r.logger.Warn().Err(err).Str("replica", r.host).Msg("mysql replica failed, reading from the primary")
+		r.setHealthy(false)
+		return true
+	}
+	return false
+}
+
+func (m *MysqlStorage) checkReplicas() {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			for _, r := range m.replicas {
+				m.checkReplica(r)
+			}
+		}
+	}
+}
+
+func (m *MysqlStorage) checkReplica(r *replica) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaPingTimeout)
+	err := r.db.PingContext(ctx)
+	cancel()
+	if err == nil && r.stmts == nil {
+		err = m.prepareReplica(r)
+	}
+	if err != nil && r.isHealthy() {
+		r.logger.Warn().Err(err).Str("replica", r.host).Msg("mysql replica check failed")
+	}
+	r.setHealthy(err == nil)
+}
+
+func (m *MysqlStorage) closeReplicas() error {
+	var firstErr error
+	for _, r := range m.replicas {
+		if err := r.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// replicaDB returns the database of the replica, or the primary one if replica is nil.
+// It is used for queries which can't be prepared, e.g. having a variable number of placeholders.
+func (m *MysqlStorage) replicaDB(r *replica) *sql.DB {
+	if r == nil {
+		return m.db
+	}
+	return r.db
+}
+
+// replicaStmt returns the statement prepared on the given replica, or the primary one if replica is nil
+func (m *MysqlStorage) replicaStmt(r *replica, primarySt *sql.Stmt) *sql.Stmt {
+	if r == nil {
+		return primarySt
+	}
+	return r.stmts[primarySt]
+}
@@ -1,139 +1,411 @@
 package storage
 
 import (
+	"context"
+	"database/sql/driver"
+	"github.com/chocosin/otus-hl/social/config"
 	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
 	"github.com/satori/go.uuid"
+	"io"
+	"net"
+	"os"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 )
 
 var testStorage *MysqlStorage
+var testMessageStorage *MysqlMessageStorage
+var testConfig *config.MySQL
 
 func init() {
-	testConfig := &MysqlConfig{
-		host:     "localhost",
-		username: "root",
-		password: "pass",
-		dbName:   "test",
-	}
+	testConfig = &config.Default().MySQL
+	testConfig.User = "root"
+	testConfig.Password = "pass"
+	testConfig.Database = "test"
+	testConfig.MigrationDir = os.Getenv("MIGRATION_DIR")
+}
 
-	CreateDatabase(testConfig, true)
-	Migrate(testConfig)
+// testMysql is set up once per run, the test database is recreated then
+var testMysql struct {
+	once sync.Once
+	err  error
+}
 
-	var err error
-	testStorage, err = NewMysqlStorage(testConfig)
-	if err != nil {
-		panic(err)
+// requireMysql sets up the test database on first use, tests are skipped if MySQL isn't configured
+// with MIGRATION_DIR, so that tests not needing it run without a database
+func requireMysql(t *testing.T) {
+	t.Helper()
+	if testConfig.MigrationDir == "" {
+		t.Skip("MIGRATION_DIR isn't set, skipping MySQL tests")
+	}
+	testMysql.once.Do(func() {
+		testMysql.err = setupMysql()
+	})
+	if testMysql.err != nil {
+		t.Fatalf("error setting up test database: %v", testMysql.err)
 	}
 }
 
-func randomUser() *model.User {
-	id := uuid.NewV1()
-	idStr := id.String()
-	passHash := model.HashPassword("password-" + idStr)
-	return &model.User{
-		ID:           id,
-		Username:     "username-" + idStr,
-		PasswordHash: passHash,
-		FirstName:    "firstname-" + idStr,
-		LastName:     "lastname-" + idStr,
-		Age:          33,
-		Interests:    []string{"cars", "cards", "news"},
-		Gender:       "male",
-		City:         "city" + idStr,
+func setupMysql() error {
+	for _, step := range []func(*config.MySQL) error{DropDatabase, CreateDatabase, Migrate} {
+		if err := step(testConfig); err != nil {
+			return err
+		}
 	}
+	var err error
+	if testStorage, err = NewMysqlStorage(testConfig, zerolog.Nop()); err != nil {
+		return err
+	}
+	testMessageStorage, err = NewMysqlMessageStorage(testConfig)
+	return err
 }
 
-func TestAddAndGet(t *testing.T) {
-	u := randomUser()
-	err := testStorage.InsertUser(u)
+func TestReadsAreRoutedToHealthyReplicas(t *testing.T) {
+	requireMysql(t)
+	ctx := context.Background()
+	cfg := *testConfig
+	// the same server is used as a replica, and another address which is not listened
+	cfg.ReplicaHosts = []string{"127.0.0.1", "127.0.0.2"}
+	replicated, err := NewMysqlStorage(&cfg, zerolog.Nop())
 	if err != nil {
+		t.Fatalf("error creating storage: %v", err)
+	}
+	defer replicated.Close()
+
+	healthy, unreachable := replicated.replicas[0], replicated.replicas[1]
+	if !healthy.isHealthy() || unreachable.isHealthy() {
+		t.Fatalf("wrong replicas health: %v, %v", healthy.isHealthy(), unreachable.isHealthy())
+	}
+	for idx := 0; idx < 4; idx++ {
+		if _, r := replicated.readStmt(replicated.findByUsernameSt); r != healthy {
+			t.Fatalf("read should have been routed to the healthy replica")
+		}
+	}
+
+	u := randomUser()
+	if err := replicated.InsertUser(ctx, u); err != nil {
 		t.Fatalf("error inserting user: %v", err)
 	}
-	dbUser, err := testStorage.FindUserByUsername(u.Username)
+	dbUser, err := replicated.FindUserByUsername(ctx, u.Username)
 	if err != nil {
 		t.Fatalf("error finding by username: %v", err)
 	}
 	if !reflect.DeepEqual(u, dbUser) {
 		t.Fatalf("wrong user returned, \nexpected:\t%+v\nactual:\t\t%+v\n", u, dbUser)
 	}
+
+	replicated.readFailed(healthy, driver.ErrBadConn)
+	if st, r := replicated.readStmt(replicated.findByUsernameSt); r != nil || st != replicated.findByUsernameSt {
+		t.Fatalf("read should have fallen back to the primary")
+	}
+	replicated.checkReplica(healthy)
+	if _, r := replicated.readStmt(replicated.findByUsernameSt); r != healthy {
+		t.Fatalf("replica should have been returned to rotation after successful check")
+	}
+}
+
+// replicaProxy forwards connections of a replica to the test server, closing it kills the replica
+type replicaProxy struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
 }
 
-func TestReturnsNilWhenNotExists(t *testing.T) {
-	u, err := testStorage.FindUserByUsername(uuid.NewV4().String())
+func newReplicaProxy(t *testing.T, host string) *replicaProxy {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(testConfig.Port)))
 	if err != nil {
-		t.Fatalf("error finding by username %v", err)
+		t.Skipf("can't listen as a replica: %v", err)
 	}
-	if u != nil {
-		t.Fatalf("expected to return nil, actual: %+v", u)
+	p := &replicaProxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", net.JoinHostPort(testConfig.Host, strconv.Itoa(testConfig.Port)))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			go io.Copy(conn, upstream)
+			go io.Copy(upstream, conn)
+		}
+	}()
+	return p
+}
+
+func (p *replicaProxy) Close() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
 	}
 }
 
-func TestGetUserByTokenAndThenDelete(t *testing.T) {
-	u := randomUser()
-	err := testStorage.InsertUser(u)
+func TestFailedReplicaReadIsRetriedOnPrimary(t *testing.T) {
+	requireMysql(t)
+	ctx := context.Background()
+	proxy := newReplicaProxy(t, "127.0.0.3")
+	defer proxy.Close()
+	cfg := *testConfig
+	cfg.ReplicaHosts = []string{"127.0.0.3"}
+	replicated, err := NewMysqlStorage(&cfg, zerolog.Nop())
 	if err != nil {
-		t.Fatalf("error inserting user: %v", err)
+		t.Fatalf("error creating storage: %v", err)
+	}
+	defer replicated.Close()
+	if !replicated.replicas[0].isHealthy() {
+		t.Fatal("replica should be healthy")
 	}
 
-	token := uuid.NewV1()
-	usr, err := testStorage.GetUserByToken(token)
+	u := randomUser()
+	if err := replicated.InsertUser(ctx, u); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	// the replica dies with connections open
+	proxy.Close()
+	users, _, err := replicated.SearchUsers(ctx, u.FirstName, u.LastName, "", 10)
 	if err != nil {
-		t.Fatalf("error getting user by token: %v", err)
+		t.Fatalf("read should have been retried on the primary: %v", err)
 	}
-	if usr != nil {
-		t.Fatalf("shouldn't have found user")
+	if len(users) != 1 || users[0].ID != u.ID {
+		t.Fatalf("expected the user to be found, got %+v", users)
 	}
+	if replicated.replicas[0].isHealthy() {
+		t.Fatal("failed replica should have been ejected")
+	}
+}
 
-	err = testStorage.InsertToken(token, u.ID)
-	if err != nil {
-		t.Fatalf("error inserting token: %v", err)
+func TestFailedStorageIsNotReturned(t *testing.T) {
+	requireMysql(t)
+	unreachable := *testConfig
+	unreachable.Host = "127.0.0.2"
+	// statements can't be prepared in a database without tables
+	empty := *testConfig
+	empty.Database = "test_empty"
+	if err := DropDatabase(&empty); err != nil {
+		t.Fatalf("error dropping database: %v", err)
+	}
+	if err := CreateDatabase(&empty); err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	for _, cfg := range []*config.MySQL{&unreachable, &empty} {
+		s, err := NewMysqlStorage(cfg, zerolog.Nop())
+		if err == nil || s != nil {
+			t.Fatalf("storage shouldn't be returned with %s@%s, got %v, %v", cfg.Database, cfg.Host, s, err)
+		}
+		messages, err := NewMysqlMessageStorage(cfg)
+		if err == nil || messages != nil {
+			t.Fatalf("message storage shouldn't be returned with %s@%s, got %v, %v", cfg.Database, cfg.Host, messages, err)
+		}
 	}
+}
+
+func TestCanceledContextAbortsQueries(t *testing.T) {
+	requireMysql(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-	dbUser, err := testStorage.GetUserByToken(token)
+	u := randomUser()
+	if err := testStorage.InsertUser(ctx, u); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected insert to be canceled, actual: %v", err)
+	}
+	if _, err := testStorage.FindUserByUsername(ctx, u.Username); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected find to be canceled, actual: %v", err)
+	}
+	dbUser, err := testStorage.FindUserByUsername(context.Background(), u.Username)
 	if err != nil {
-		t.Fatalf("error getting user by token: %v", err)
+		t.Fatalf("error finding by username: %v", err)
 	}
-	if !reflect.DeepEqual(dbUser, u) {
-		t.Fatalf("wrong user returned, \nexpected:\t%+v\nactual:\t\t%+v\n", u, dbUser)
+	if dbUser != nil {
+		t.Fatalf("user of canceled insert shouldn't be stored: %+v", dbUser)
 	}
+}
 
-	err = testStorage.DeleteToken(token)
-	if err != nil {
-		t.Fatalf("error deleting token: %v", err)
+func statementCount(t *testing.T, name string) uint64 {
+	var m dto.Metric
+	if err := statementDuration.WithLabelValues(name).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
 	}
-	usr, err = testStorage.GetUserByToken(token)
-	if err != nil {
-		t.Fatalf("error getting user by token: %v", err)
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestStatementMetrics(t *testing.T) {
+	requireMysql(t)
+	ctx := context.Background()
+	inserts, finds := statementCount(t, "insert_user"), statementCount(t, "find_by_username")
+	failedInserts := testutil.ToFloat64(statementErrors.WithLabelValues("insert_user"))
+
+	u := randomUser()
+	if err := testStorage.InsertUser(ctx, u); err != nil {
+		t.Fatalf("error inserting user: %v", err)
 	}
-	if usr != nil {
-		t.Fatalf("shouldn't have found user by deleted token")
+	if err := testStorage.InsertUser(ctx, u); err == nil {
+		t.Fatalf("expected duplicate user error")
+	}
+	if _, err := testStorage.FindUserByUsername(ctx, u.Username); err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+
+	// statements executed in transactions are counted under the same name
+	if count := statementCount(t, "insert_user") - inserts; count != 2 {
+		t.Errorf("expected 2 observed inserts, got %d", count)
+	}
+	if count := statementCount(t, "find_by_username") - finds; count != 1 {
+		t.Errorf("expected 1 observed find, got %d", count)
+	}
+	if failed := testutil.ToFloat64(statementErrors.WithLabelValues("insert_user")) - failedInserts; failed != 1 {
+		t.Errorf("expected 1 failed insert, got %v", failed)
 	}
 }
 
-func TestLastUsernames(t *testing.T) {
-	for idx := 0; idx < 5; idx++ {
+func TestInterestsOfPageAreReadAtOnce(t *testing.T) {
+	requireMysql(t)
+	ctx := context.Background()
+	prefix := "page" + uuid.NewV4().String()[:8]
+	expected := make(map[uuid.UUID][]string)
+	for idx := 0; idx < 3; idx++ {
 		u := randomUser()
-		err := testStorage.InsertUser(u)
-		if err != nil {
+		u.FirstName = prefix + strconv.Itoa(idx)
+		u.Interests = []string{"page", "user" + strconv.Itoa(idx)}
+		if err := testStorage.InsertUser(ctx, u); err != nil {
 			t.Fatalf("error inserting user: %v", err)
 		}
+		expected[u.ID] = u.Interests
 	}
-	expected := make([]string, 10)
-	for idx := 0; idx < 10; idx++ {
-		u := randomUser()
-		err := testStorage.InsertUser(u)
+	queries := statementCount(t, "list_users_interests_batch")
+
+	users, _, err := testStorage.SearchUsers(ctx, prefix, "", "", 10)
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("expected 3 users, got %d", len(users))
+	}
+	for _, u := range users {
+		if !reflect.DeepEqual(u.Interests, expected[u.ID]) {
+			t.Errorf("wrong interests of %s: %v", u.Username, u.Interests)
+		}
+	}
+	if count := statementCount(t, "list_users_interests_batch") - queries; count != 1 {
+		t.Fatalf("expected interests of the page to be read by 1 query, got %d", count)
+	}
+}
+
+func TestSimilarUsersAreLimitedPerInterest(t *testing.T) {
+	requireMysql(t)
+	ctx := context.Background()
+	tag := "popular-" + uuid.NewV4().String()[:8]
+	template := randomUser()
+	users := make([]*model.User, maxSimilarFanIn+2)
+	for idx := range users {
+		u := *template
+		u.ID = uuid.NewV1()
+		u.Username = "popular-" + u.ID.String()
+		u.Interests = []string{tag}
+		users[idx] = &u
+	}
+	if err := testStorage.InsertUsers(ctx, users); err != nil {
+		t.Fatalf("error inserting users: %v", err)
+	}
+	queries := statementCount(t, "similar_users_batch")
+
+	similar, err := testStorage.SimilarUsers(ctx, users[0].ID, maxSimilarFanIn*2)
+	if err != nil {
+		t.Fatalf("error listing similar users: %v", err)
+	}
+	if len(similar) != maxSimilarFanIn {
+		t.Fatalf("expected %d similar users of the interest, got %d", maxSimilarFanIn, len(similar))
+	}
+	if count := statementCount(t, "similar_users_batch") - queries; count != 1 {
+		t.Fatalf("expected similar users to be read by 1 query, got %d", count)
+	}
+}
+
+func TestInsertUsersInBatch(t *testing.T) {
+	requireMysql(t)
+	ctx := context.Background()
+	batches := statementCount(t, "insert_users_batch")
+
+	users := []*model.User{randomUser(), randomUser(), randomUser()}
+	users[1].Interests = []string{"news", "batch-" + users[1].ID.String()}
+	users[2].Interests = nil
+	if err := testStorage.InsertUsers(ctx, users); err != nil {
+		t.Fatalf("error inserting users: %v", err)
+	}
+	for _, u := range users {
+		dbUser, err := testStorage.FindUserByUsername(ctx, u.Username)
 		if err != nil {
-			t.Fatalf("error inserting user: %v", err)
+			t.Fatalf("error finding user: %v", err)
+		}
+		if u.Interests == nil {
+			u.Interests = []string{}
+		}
+		if !reflect.DeepEqual(u, dbUser) {
+			t.Errorf("wrong user, expected %+v, got %+v", u, dbUser)
+		}
+	}
+	if count := statementCount(t, "insert_users_batch") - batches; count != 1 {
+		t.Errorf("users should be inserted by a single statement, got %d", count)
+	}
+
+	// users of the batch are counted in their cities
+	for _, u := range users {
+		u.ID = uuid.NewV1()
+		u.Username = "city-" + u.ID.String()
+		u.City = users[0].City
+	}
+	if err := testStorage.InsertUsers(ctx, users); err != nil {
+		t.Fatalf("error inserting users: %v", err)
+	}
+	cities, err := testStorage.Cities(ctx, 1000)
+	if err != nil {
+		t.Fatalf("error listing cities: %v", err)
+	}
+	counted := false
+	for _, city := range cities {
+		if city.Name == users[0].City {
+			counted = city.Users == 4
 		}
-		expected[10-idx-1] = u.Username
 	}
+	if !counted {
+		t.Errorf("expected %s to have 4 users, got %+v", users[0].City, cities)
+	}
+	if err := testStorage.InsertUsers(ctx, make([]*model.User, MaxInsertBatch+1)); err == nil {
+		t.Errorf("expected error for too large batch")
+	}
+}
 
-	last, err := testStorage.LastUsernames()
+func TestPoolStatsAreCollected(t *testing.T) {
+	requireMysql(t)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(testStorage, testMessageStorage)
+	families, err := registry.Gather()
 	if err != nil {
-		t.Fatalf("failed getting last usernames")
+		t.Fatalf("error gathering metrics: %v", err)
+	}
+	pools := make(map[string]bool)
+	for _, family := range families {
+		if family.GetName() != "social_mysql_pool_open_connections" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			pools[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue() > 0
+		}
 	}
-	if !reflect.DeepEqual(last, expected) {
-		t.Fatalf("wrong usernames returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, last)
+	if !reflect.DeepEqual(pools, map[string]bool{"primary": true, "messages": true}) {
+		t.Fatalf("expected open connections of primary and messages pools, got %v", pools)
 	}
 }
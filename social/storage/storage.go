@@ -1,16 +1,76 @@
 package storage
 
 import (
+	"context"
 	"github.com/chocosin/otus-hl/social/model"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
+	"time"
 )
 
+var ErrFriendRequestNotFound = errors.New("friend request not found")
+var ErrSelfFriendship = errors.New("can't be friends with yourself")
+
+// Storage methods take the context of the request, so canceling it aborts database queries.
 type Storage interface {
-	LastUsernames() ([]string, error)
-	InsertUser(user *model.User) error
-	FindUserByUsername(username string) (*model.User, error)
+	// LastUsernames returns usernames of recently registered users, newest first.
+	// List methods return ErrInvalidCursor if the cursor is malformed.
+	LastUsernames(ctx context.Context, cursor Cursor, limit int) ([]string, Cursor, error)
+	InsertUser(ctx context.Context, user *model.User) error
+	// UpdateUser updates everything except username
+	UpdateUser(ctx context.Context, user *model.User) error
+	UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error
+	FindUserByUsername(ctx context.Context, username string) (*model.User, error)
+	// FindUserForLogin is FindUserByUsername which is consistent right after InsertUser and password changes,
+	// it is used to check credentials
+	FindUserForLogin(ctx context.Context, username string) (*model.User, error)
+	// IsUsernameTaken is consistent right after InsertUser, unlike FindUserByUsername which may read from replica.
+	// Usernames of deleted users are taken until released.
+	IsUsernameTaken(ctx context.Context, username string) (bool, error)
+	// DeleteUser deletes the user with all their tokens, friendships and posts at once,
+	// the username can't be registered again until releaseAt
+	DeleteUser(ctx context.Context, userID uuid.UUID, releaseAt time.Time) error
+	// SearchUsers returns users whose names start with the prefixes, in order of registration
+	SearchUsers(ctx context.Context, firstPrefix, lastPrefix string, cursor Cursor, limit int) ([]*model.User, Cursor, error)
+	// UsersByInterest returns users having the interest tag, in order of registration
+	UsersByInterest(ctx context.Context, tag string, cursor Cursor, limit int) ([]*model.User, Cursor, error)
+	// UsersByCity returns users of the city in order of registration, the city is compared by model.CityKey
+	UsersByCity(ctx context.Context, city string, cursor Cursor, limit int) ([]*model.User, Cursor, error)
+	// Cities returns cities with most users first
+	Cities(ctx context.Context, limit int) ([]*model.City, error)
+	// SimilarUsers returns users sharing interests with the user, the ones with most shared interests first
+	SimilarUsers(ctx context.Context, userID uuid.UUID, limit int) ([]*model.User, error)
+
+	InsertToken(ctx context.Context, session *model.Session) error
+	DeleteToken(ctx context.Context, id uuid.UUID) error
+	// GetUserByToken returns nil if token is not found or expired
+	GetUserByToken(ctx context.Context, token uuid.UUID) (*model.User, error)
+	// TouchToken prolongs the token if it hasn't been seen for minInterval, returns whether it was prolonged
+	TouchToken(ctx context.Context, token uuid.UUID, seenAt time.Time, expiresAt time.Time, minInterval time.Duration) (bool, error)
+	DeleteExpiredTokens(ctx context.Context, now time.Time) (int64, error)
+	// CountActiveTokens returns the number of sessions not expired by now
+	CountActiveTokens(ctx context.Context, now time.Time) (int64, error)
+	// ListTokens returns not expired sessions of the user, recently used first
+	ListTokens(ctx context.Context, userID uuid.UUID) ([]*model.Session, error)
+	// DeleteAllTokens deletes all sessions of the user except the given one
+	DeleteAllTokens(ctx context.Context, userID uuid.UUID, except uuid.UUID) error
+
+	SendFriendRequest(ctx context.Context, from uuid.UUID, to uuid.UUID) error
+	AcceptFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) error
+	DeclineFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) error
+	RemoveFriend(ctx context.Context, userID uuid.UUID, friendID uuid.UUID) error
+	ListFriends(ctx context.Context, userID uuid.UUID) ([]*model.User, error)
+	ListPendingRequests(ctx context.Context, userID uuid.UUID) ([]*model.User, error)
+	GetFriendshipStatus(ctx context.Context, userID uuid.UUID, otherID uuid.UUID) (model.FriendshipStatus, error)
+	// ListFollowerIDs returns users whose feed contains posts of the user:
+	// friends and the ones who have sent a friend request. It's read from the primary,
+	// so that posts are pushed to feeds of friends who have just been accepted
+	ListFollowerIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
 
-	InsertToken(token uuid.UUID, userId uuid.UUID) error
-	DeleteToken(id uuid.UUID) error
-	GetUserByToken(token uuid.UUID) (*model.User, error)
+	CreatePost(ctx context.Context, post *model.Post) error
+	// ListPostsByAuthor returns latest posts of the author, newest first
+	ListPostsByAuthor(ctx context.Context, authorID uuid.UUID, limit int) ([]*model.Post, error)
+	// ListFeed returns latest posts of friends and users the user has sent a friend request to,
+	// it's read from the primary as published posts are expected to be there
+	ListFeed(ctx context.Context, userID uuid.UUID, limit int) ([]*model.Post, error)
 }
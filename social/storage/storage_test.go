@@ -0,0 +1,38 @@
+package storage_test
+
+import (
+	"github.com/chocosin/otus-hl/social/storage"
+	"github.com/chocosin/otus-hl/social/storage/storagetest"
+	"testing"
+	"time"
+)
+
+func init() {
+	storage.SetRandomUser(storagetest.RandomUser)
+}
+
+func TestMysqlStorage(t *testing.T) {
+	s, messages := storage.MysqlTestStorages(t)
+	storagetest.Run(t, func() storage.Storage {
+		return s
+	})
+	storagetest.RunMessages(t, func() (storage.Storage, storage.MessageStorage) {
+		return s, messages
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func() storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+	storagetest.RunMessages(t, func() (storage.Storage, storage.MessageStorage) {
+		s := storage.NewMemoryStorage()
+		return s, storage.NewMemoryMessageStorage()
+	})
+}
+
+func TestCachedStorage(t *testing.T) {
+	storagetest.Run(t, func() storage.Storage {
+		return storage.NewCachedStorage(storage.NewMemoryStorage(), storage.NewLRUCache(1000), time.Minute)
+	})
+}
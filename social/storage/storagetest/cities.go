@@ -0,0 +1,104 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+func insertUserFromCity(t *testing.T, s storage.Storage, city string) *model.User {
+	ctx := context.Background()
+	u := RandomUser()
+	u.City = city
+	if err := s.InsertUser(ctx, u); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	return u
+}
+
+func testUsersByCity(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	city := "City " + uuid.NewV4().String()[:8]
+	expected := []*model.User{
+		insertUserFromCity(t, s, city),
+		insertUserFromCity(t, s, "  "+model.CityKey(city)+" "),
+		insertUserFromCity(t, s, model.NormalizeCity(city)),
+	}
+	insertUserFromCity(t, s, city+" other")
+
+	users, next, err := s.UsersByCity(ctx, city, "", 2)
+	if err != nil {
+		t.Fatalf("error listing users by city: %v", err)
+	}
+	checkUsers(t, users, expected[0], expected[1])
+	if next == "" {
+		t.Fatalf("expected next cursor")
+	}
+
+	users, next, err = s.UsersByCity(ctx, model.CityKey(city), next, 2)
+	if err != nil {
+		t.Fatalf("error listing users by city: %v", err)
+	}
+	checkUsers(t, users, expected[2])
+	if next != "" {
+		t.Fatalf("expected no next cursor on the last page, actual: %v", next)
+	}
+}
+
+func testCities(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	big := "Big " + uuid.NewV4().String()[:8]
+	small := "Small " + uuid.NewV4().String()[:8]
+	for idx := 0; idx < 3; idx++ {
+		insertUserFromCity(t, s, big)
+	}
+	leaving := insertUserFromCity(t, s, model.CityKey(big))
+	moving := insertUserFromCity(t, s, small)
+	insertUserFromCity(t, s, small)
+	checkCityUsers(t, s, big, 4, small, 2)
+
+	// users are counted in cities they move to and not counted after deletion
+	moving.City = model.CityKey(big)
+	if err := s.UpdateUser(ctx, moving); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	if err := s.DeleteUser(ctx, leaving.ID, time.Now()); err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+	checkCityUsers(t, s, big, 4, small, 1)
+
+	cities, err := s.Cities(ctx, 1)
+	if err != nil {
+		t.Fatalf("error listing cities: %v", err)
+	}
+	if len(cities) != 1 {
+		t.Fatalf("expected 1 city, actual: %+v", cities)
+	}
+}
+
+// checkCityUsers checks the number of users of both cities, the big one is expected to be listed first
+func checkCityUsers(t *testing.T, s storage.Storage, big string, bigUsers int, small string, smallUsers int) {
+	t.Helper()
+	cities, err := s.Cities(context.Background(), 1000)
+	if err != nil {
+		t.Fatalf("error listing cities: %v", err)
+	}
+	bigIdx, smallIdx := -1, -1
+	for idx, city := range cities {
+		switch model.CityKey(city.Name) {
+		case model.CityKey(big):
+			bigIdx = idx
+		case model.CityKey(small):
+			smallIdx = idx
+		}
+	}
+	if bigIdx < 0 || smallIdx < 0 {
+		t.Fatalf("cities are not found: %+v", cities)
+	}
+	if cities[bigIdx].Users != bigUsers || cities[smallIdx].Users != smallUsers || bigIdx > smallIdx {
+		t.Fatalf("wrong cities returned: %+v, %+v", cities[bigIdx], cities[smallIdx])
+	}
+}
@@ -0,0 +1,104 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"testing"
+)
+
+func checkFriendshipStatus(t *testing.T, s storage.Storage, user, other *model.User, expected model.FriendshipStatus) {
+	ctx := context.Background()
+	status, err := s.GetFriendshipStatus(ctx, user.ID, other.ID)
+	if err != nil {
+		t.Fatalf("error getting friendship status: %v", err)
+	}
+	if status != expected {
+		t.Fatalf("wrong friendship status, expected: %v, actual: %v", expected, status)
+	}
+}
+
+func testFriendRequestAcceptAndRemove(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u1 := insertRandomUser(t, s)
+	u2 := insertRandomUser(t, s)
+	checkFriendshipStatus(t, s, u1, u2, model.FriendshipNone)
+
+	if err := s.SendFriendRequest(ctx, u1.ID, u2.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	checkFriendshipStatus(t, s, u1, u2, model.FriendshipRequested)
+	checkFriendshipStatus(t, s, u2, u1, model.FriendshipIncoming)
+
+	pending, err := s.ListPendingRequests(ctx, u2.ID)
+	if err != nil {
+		t.Fatalf("error listing pending requests: %v", err)
+	}
+	checkUsers(t, pending, u1)
+
+	if err := s.AcceptFriendRequest(ctx, u2.ID, u1.ID); err != nil {
+		t.Fatalf("error accepting friend request: %v", err)
+	}
+	checkFriendshipStatus(t, s, u1, u2, model.FriendshipAccepted)
+	checkFriendshipStatus(t, s, u2, u1, model.FriendshipAccepted)
+	for _, pair := range [][2]*model.User{{u1, u2}, {u2, u1}} {
+		friends, err := s.ListFriends(ctx, pair[0].ID)
+		if err != nil {
+			t.Fatalf("error listing friends: %v", err)
+		}
+		checkUsers(t, friends, pair[1])
+	}
+	pending, err = s.ListPendingRequests(ctx, u2.ID)
+	if err != nil {
+		t.Fatalf("error listing pending requests: %v", err)
+	}
+	checkUsers(t, pending)
+
+	if err := s.RemoveFriend(ctx, u2.ID, u1.ID); err != nil {
+		t.Fatalf("error removing friend: %v", err)
+	}
+	checkFriendshipStatus(t, s, u1, u2, model.FriendshipNone)
+	friends, err := s.ListFriends(ctx, u1.ID)
+	if err != nil {
+		t.Fatalf("error listing friends: %v", err)
+	}
+	checkUsers(t, friends)
+}
+
+func testFriendRequestDecline(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u1 := insertRandomUser(t, s)
+	u2 := insertRandomUser(t, s)
+
+	if err := s.DeclineFriendRequest(ctx, u2.ID, u1.ID); err != storage.ErrFriendRequestNotFound {
+		t.Fatalf("expected ErrFriendRequestNotFound, actual: %v", err)
+	}
+	if err := s.SendFriendRequest(ctx, u1.ID, u2.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	if err := s.DeclineFriendRequest(ctx, u2.ID, u1.ID); err != nil {
+		t.Fatalf("error declining friend request: %v", err)
+	}
+	checkFriendshipStatus(t, s, u1, u2, model.FriendshipNone)
+	if err := s.AcceptFriendRequest(ctx, u2.ID, u1.ID); err != storage.ErrFriendRequestNotFound {
+		t.Fatalf("expected ErrFriendRequestNotFound, actual: %v", err)
+	}
+}
+
+func testMutualFriendRequestsMakeFriends(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u1 := insertRandomUser(t, s)
+	u2 := insertRandomUser(t, s)
+
+	if err := s.SendFriendRequest(ctx, u1.ID, u1.ID); err != storage.ErrSelfFriendship {
+		t.Fatalf("expected ErrSelfFriendship, actual: %v", err)
+	}
+	if err := s.SendFriendRequest(ctx, u1.ID, u2.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	if err := s.SendFriendRequest(ctx, u2.ID, u1.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	checkFriendshipStatus(t, s, u1, u2, model.FriendshipAccepted)
+	checkFriendshipStatus(t, s, u2, u1, model.FriendshipAccepted)
+}
@@ -0,0 +1,93 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"testing"
+)
+
+func insertUserWithInterests(t *testing.T, s storage.Storage, interests ...string) *model.User {
+	ctx := context.Background()
+	u := RandomUser()
+	u.Interests = interests
+	if err := s.InsertUser(ctx, u); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	return u
+}
+
+func testUsersByInterest(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	tag := "tag-" + uuid.NewV4().String()[:8]
+	other := "other-" + uuid.NewV4().String()[:8]
+	u1 := insertUserWithInterests(t, s, other, tag)
+	u2 := insertUserWithInterests(t, s, tag)
+	insertUserWithInterests(t, s, other)
+	u3 := insertUserWithInterests(t, s)
+
+	found, _, err := s.UsersByInterest(ctx, tag, "", 10)
+	if err != nil {
+		t.Fatalf("error listing users by interest: %v", err)
+	}
+	checkUsers(t, found, u1, u2)
+
+	found, next, err := s.UsersByInterest(ctx, tag, "", 1)
+	if err != nil {
+		t.Fatalf("error listing users by interest: %v", err)
+	}
+	checkUsers(t, found, u1)
+	found, _, err = s.UsersByInterest(ctx, tag, next, 1)
+	if err != nil {
+		t.Fatalf("error listing users by interest: %v", err)
+	}
+	checkUsers(t, found, u2)
+
+	// updating interests replaces them
+	u1.Interests = []string{other}
+	if err := s.UpdateUser(ctx, u1); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	found, _, err = s.UsersByInterest(ctx, tag, "", 10)
+	if err != nil {
+		t.Fatalf("error listing users by interest: %v", err)
+	}
+	checkUsers(t, found, u2)
+
+	// order of interests is kept, user without interests has empty ones
+	dbUser, err := s.FindUserByUsername(ctx, u1.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	checkUser(t, dbUser, u1)
+	dbUser, err = s.FindUserByUsername(ctx, u3.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	u3.Interests = []string{}
+	checkUser(t, dbUser, u3)
+}
+
+func testSimilarUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	prefix := "similar-" + uuid.NewV4().String()[:8] + "-"
+	a, b, c := prefix+"a", prefix+"b", prefix+"c"
+	me := insertUserWithInterests(t, s, a, b, c)
+	one := insertUserWithInterests(t, s, c, prefix+"d")
+	three := insertUserWithInterests(t, s, b, a, c)
+	two := insertUserWithInterests(t, s, a, b)
+	insertUserWithInterests(t, s, prefix+"d")
+
+	similar, err := s.SimilarUsers(ctx, me.ID, 10)
+	if err != nil {
+		t.Fatalf("error listing similar users: %v", err)
+	}
+	checkUsers(t, similar, three, two, one)
+
+	similar, err = s.SimilarUsers(ctx, me.ID, 1)
+	if err != nil {
+		t.Fatalf("error listing similar users: %v", err)
+	}
+	checkUsers(t, similar, three)
+}
@@ -0,0 +1,129 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"reflect"
+	"testing"
+)
+
+func sendMessage(t *testing.T, messages storage.MessageStorage, from, to *model.User, text string) *model.Message {
+	ctx := context.Background()
+	msg, err := model.NewMessage(from, to, text)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if err := messages.SendMessage(ctx, msg, from.Username, to.Username); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	return msg
+}
+
+func testDialogs(t *testing.T, s storage.Storage, messages storage.MessageStorage) {
+	ctx := context.Background()
+	u1 := insertRandomUser(t, s)
+	u2 := insertRandomUser(t, s)
+	u3 := insertRandomUser(t, s)
+	if !uuid.Equal(model.DialogID(u1.ID, u2.ID), model.DialogID(u2.ID, u1.ID)) {
+		t.Fatalf("dialog id should be the same for both users")
+	}
+
+	m1 := sendMessage(t, messages, u1, u2, "hi")
+	m2 := sendMessage(t, messages, u2, u1, "hello")
+	m3 := sendMessage(t, messages, u1, u2, "how are you?")
+	sendMessage(t, messages, u3, u1, "another dialog")
+
+	listed, err := messages.ListMessages(ctx, model.DialogID(u2.ID, u1.ID), 10)
+	if err != nil {
+		t.Fatalf("error listing messages: %v", err)
+	}
+	expected := []*model.Message{m1, m2, m3}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("wrong messages returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, listed)
+	}
+	listed, err = messages.ListMessages(ctx, m1.DialogID, 2)
+	if err != nil {
+		t.Fatalf("error listing messages: %v", err)
+	}
+	expected = []*model.Message{m2, m3}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("wrong messages returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, listed)
+	}
+
+	dialogs, err := messages.ListDialogs(ctx, u1.ID)
+	if err != nil {
+		t.Fatalf("error listing dialogs: %v", err)
+	}
+	if len(dialogs) != 2 || dialogs[0].Other != u3.Username || dialogs[1].Other != u2.Username {
+		t.Fatalf("wrong dialogs returned: %+v", dialogs)
+	}
+	if !uuid.Equal(dialogs[1].ID, m1.DialogID) || !dialogs[1].LastMessageAt.Equal(m3.CreatedAt) {
+		t.Fatalf("wrong dialog returned: %+v", dialogs[1])
+	}
+
+	// messages may be stored out of order, e.g. when sent concurrently, the dialog keeps the latest time
+	late, err := model.NewMessage(u2, u1, "late")
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	late.CreatedAt = m1.CreatedAt
+	if err := messages.SendMessage(ctx, late, u2.Username, u1.Username); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	dialogs, err = messages.ListDialogs(ctx, u2.ID)
+	if err != nil {
+		t.Fatalf("error listing dialogs: %v", err)
+	}
+	if len(dialogs) != 1 || dialogs[0].Other != u1.Username || !dialogs[0].LastMessageAt.Equal(m3.CreatedAt) {
+		t.Fatalf("wrong dialogs returned: %+v", dialogs)
+	}
+}
+
+func testDeleteUserDialogs(t *testing.T, s storage.Storage, messages storage.MessageStorage) {
+	ctx := context.Background()
+	deleted := insertRandomUser(t, s)
+	u1 := insertRandomUser(t, s)
+	u2 := insertRandomUser(t, s)
+	sendMessage(t, messages, deleted, u1, "hi")
+	sendMessage(t, messages, u1, deleted, "hello")
+	sendMessage(t, messages, u2, deleted, "hey")
+	kept := sendMessage(t, messages, u1, u2, "they are gone")
+
+	if err := messages.DeleteUserDialogs(ctx, deleted.ID); err != nil {
+		t.Fatalf("error deleting dialogs: %v", err)
+	}
+	for _, other := range []*model.User{u1, u2} {
+		listed, err := messages.ListMessages(ctx, model.DialogID(deleted.ID, other.ID), 10)
+		if err != nil {
+			t.Fatalf("error listing messages: %v", err)
+		}
+		if len(listed) != 0 {
+			t.Fatalf("messages should be deleted, got %+v", listed)
+		}
+	}
+	dialogs, err := messages.ListDialogs(ctx, deleted.ID)
+	if err != nil {
+		t.Fatalf("error listing dialogs: %v", err)
+	}
+	if len(dialogs) != 0 {
+		t.Fatalf("dialogs should be deleted, got %+v", dialogs)
+	}
+	for _, other := range []*model.User{u1, u2} {
+		dialogs, err := messages.ListDialogs(ctx, other.ID)
+		if err != nil {
+			t.Fatalf("error listing dialogs: %v", err)
+		}
+		if len(dialogs) != 1 || !uuid.Equal(dialogs[0].ID, kept.DialogID) {
+			t.Fatalf("only the dialog with each other should be left, got %+v", dialogs)
+		}
+	}
+	listed, err := messages.ListMessages(ctx, kept.DialogID, 10)
+	if err != nil {
+		t.Fatalf("error listing messages: %v", err)
+	}
+	if !reflect.DeepEqual(listed, []*model.Message{kept}) {
+		t.Fatalf("messages of other dialogs should be kept, got %+v", listed)
+	}
+}
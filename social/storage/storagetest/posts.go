@@ -0,0 +1,84 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func createPost(t *testing.T, s storage.Storage, author *model.User, text string, createdAt time.Time) *model.Post {
+	ctx := context.Background()
+	post, err := model.NewPost(author, text)
+	if err != nil {
+		t.Fatalf("error creating post: %v", err)
+	}
+	post.CreatedAt = createdAt
+	if err := s.CreatePost(ctx, post); err != nil {
+		t.Fatalf("error inserting post: %v", err)
+	}
+	return post
+}
+
+func checkPosts(t *testing.T, actual []*model.Post, expected ...*model.Post) {
+	if len(expected) == 0 {
+		expected = []*model.Post{}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("wrong posts returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, actual)
+	}
+}
+
+func testPostsAndFeed(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	reader := insertRandomUser(t, s)
+	friend := insertRandomUser(t, s)
+	followed := insertRandomUser(t, s)
+	stranger := insertRandomUser(t, s)
+
+	if err := s.SendFriendRequest(ctx, reader.ID, friend.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	if err := s.AcceptFriendRequest(ctx, friend.ID, reader.ID); err != nil {
+		t.Fatalf("error accepting friend request: %v", err)
+	}
+	// not accepted request is enough to follow the user
+	if err := s.SendFriendRequest(ctx, reader.ID, followed.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+
+	start := time.Now().UTC().Truncate(time.Second)
+	p1 := createPost(t, s, friend, "first", start)
+	p2 := createPost(t, s, followed, "second", start.Add(time.Second))
+	createPost(t, s, stranger, "stranger", start.Add(2*time.Second))
+	p3 := createPost(t, s, friend, "third", start.Add(3*time.Second))
+
+	posts, err := s.ListPostsByAuthor(ctx, friend.ID, 10)
+	if err != nil {
+		t.Fatalf("error listing posts: %v", err)
+	}
+	checkPosts(t, posts, p3, p1)
+
+	posts, err = s.ListFeed(ctx, reader.ID, 2)
+	if err != nil {
+		t.Fatalf("error listing feed: %v", err)
+	}
+	checkPosts(t, posts, p3, p2)
+
+	followers, err := s.ListFollowerIDs(ctx, followed.ID)
+	if err != nil {
+		t.Fatalf("error listing followers: %v", err)
+	}
+	if !reflect.DeepEqual(followers, []uuid.UUID{reader.ID}) {
+		t.Fatalf("wrong followers returned: %v", followers)
+	}
+	// followed user doesn't see posts of their followers
+	posts, err = s.ListFeed(ctx, followed.ID, 10)
+	if err != nil {
+		t.Fatalf("error listing feed: %v", err)
+	}
+	checkPosts(t, posts)
+}
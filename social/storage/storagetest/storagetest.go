@@ -0,0 +1,115 @@
+// Package storagetest is a conformance suite for storage.Storage implementations.
+// Every backend is expected to pass it, see storage_test.go for usage.
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testCase struct {
+	name string
+	test func(t *testing.T, s storage.Storage)
+}
+
+var storageCases = []testCase{
+	{"AddAndGet", testAddAndGet},
+	{"ReturnsNilWhenNotExists", testReturnsNilWhenNotExists},
+	{"IsUsernameTaken", testIsUsernameTaken},
+	{"UpdateUser", testUpdateUser},
+	{"UpdatePasswordHash", testUpdatePasswordHash},
+	{"DeleteUser", testDeleteUser},
+	{"LastUsernames", testLastUsernames},
+	{"LastUsernamesPages", testLastUsernamesPages},
+	{"InvalidCursor", testInvalidCursor},
+	{"SearchUsers", testSearchUsers},
+	{"UsersByInterest", testUsersByInterest},
+	{"SimilarUsers", testSimilarUsers},
+	{"UsersByCity", testUsersByCity},
+	{"Cities", testCities},
+	{"GetUserByTokenAndThenDelete", testGetUserByTokenAndThenDelete},
+	{"ExpiredTokens", testExpiredTokens},
+	{"CountActiveTokens", testCountActiveTokens},
+	{"TouchTokenProlongsExpiration", testTouchTokenProlongsExpiration},
+	{"ListAndDeleteAllTokens", testListAndDeleteAllTokens},
+	{"FriendRequestAcceptAndRemove", testFriendRequestAcceptAndRemove},
+	{"FriendRequestDecline", testFriendRequestDecline},
+	{"MutualFriendRequestsMakeFriends", testMutualFriendRequestsMakeFriends},
+	{"PostsAndFeed", testPostsAndFeed},
+}
+
+// Run runs the suite against storages created by newStorage, it is called once per test case.
+// Storage may be shared between test cases, tests don't rely on it being empty,
+// but they must not be run concurrently with anything else writing to it.
+func Run(t *testing.T, newStorage func() storage.Storage) {
+	for _, tc := range storageCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStorage())
+		})
+	}
+}
+
+// RunMessages runs the suite against message storage,
+// users of the messages are inserted into the paired storage.
+func RunMessages(t *testing.T, newStorages func() (storage.Storage, storage.MessageStorage)) {
+	t.Run("Dialogs", func(t *testing.T) {
+		s, messages := newStorages()
+		testDialogs(t, s, messages)
+	})
+	t.Run("DeleteUserDialogs", func(t *testing.T) {
+		s, messages := newStorages()
+		testDeleteUserDialogs(t, s, messages)
+	})
+}
+
+// RandomUser returns a user with unique username and names, it is not inserted into storage.
+func RandomUser() *model.User {
+	id := uuid.NewV1()
+	idStr := id.String()
+	passHash, err := model.HashPassword("password-" + idStr)
+	if err != nil {
+		panic(err)
+	}
+	return &model.User{
+		ID:           id,
+		Username:     "username-" + idStr,
+		PasswordHash: passHash,
+		FirstName:    "firstname-" + idStr,
+		LastName:     "lastname-" + idStr,
+		Age:          33,
+		Interests:    []string{"cars", "cards", "news"},
+		Gender:       "male",
+		City:         "city" + idStr,
+		CreatedAt:    time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+func insertRandomUser(t *testing.T, s storage.Storage) *model.User {
+	ctx := context.Background()
+	u := RandomUser()
+	if err := s.InsertUser(ctx, u); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	return u
+}
+
+func checkUser(t *testing.T, actual *model.User, expected *model.User) {
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("wrong user returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, actual)
+	}
+}
+
+func checkUsers(t *testing.T, actual []*model.User, expected ...*model.User) {
+	if len(expected) == 0 {
+		expected = []*model.User{}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("wrong users returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, actual)
+	}
+}
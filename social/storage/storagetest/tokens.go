@@ -0,0 +1,197 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testGetUserByTokenAndThenDelete(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+
+	session := model.NewSession(u.ID, "test-agent", "127.0.0.1", time.Hour)
+	token := session.Token
+	usr, err := s.GetUserByToken(ctx, token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if usr != nil {
+		t.Fatalf("shouldn't have found user")
+	}
+
+	err = s.InsertToken(ctx, session)
+	if err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+
+	dbUser, err := s.GetUserByToken(ctx, token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	checkUser(t, dbUser, u)
+
+	err = s.DeleteToken(ctx, token)
+	if err != nil {
+		t.Fatalf("error deleting token: %v", err)
+	}
+	usr, err = s.GetUserByToken(ctx, token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if usr != nil {
+		t.Fatalf("shouldn't have found user by deleted token")
+	}
+}
+
+func testExpiredTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	expired := model.NewSession(u.ID, "test-agent", "127.0.0.1", -time.Minute)
+	if err := s.InsertToken(ctx, expired); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+	usr, err := s.GetUserByToken(ctx, expired.Token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if usr != nil {
+		t.Fatalf("shouldn't have found user by expired token")
+	}
+
+	alive := model.NewSession(u.ID, "test-agent", "127.0.0.1", time.Hour)
+	if err := s.InsertToken(ctx, alive); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+	deleted, err := s.DeleteExpiredTokens(ctx, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("error deleting expired tokens: %v", err)
+	}
+	if deleted < 1 {
+		t.Fatalf("expected expired token to be deleted")
+	}
+	usr, err = s.GetUserByToken(ctx, alive.Token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if usr == nil {
+		t.Fatalf("alive token shouldn't have been deleted")
+	}
+}
+
+func testCountActiveTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	now := time.Now().UTC()
+	before, err := s.CountActiveTokens(ctx, now)
+	if err != nil {
+		t.Fatalf("error counting tokens: %v", err)
+	}
+	for _, ttl := range []time.Duration{-time.Minute, time.Hour, time.Hour} {
+		if err := s.InsertToken(ctx, model.NewSession(u.ID, "test-agent", "127.0.0.1", ttl)); err != nil {
+			t.Fatalf("error inserting token: %v", err)
+		}
+	}
+	after, err := s.CountActiveTokens(ctx, now)
+	if err != nil {
+		t.Fatalf("error counting tokens: %v", err)
+	}
+	if after-before != 2 {
+		t.Fatalf("expected 2 more active tokens, got %d", after-before)
+	}
+}
+
+func testTouchTokenProlongsExpiration(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	session := model.NewSession(u.ID, "test-agent", "127.0.0.1", time.Second)
+	if err := s.InsertToken(ctx, session); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+
+	// token has just been seen, so it isn't prolonged yet
+	touched, err := s.TouchToken(ctx, session.Token,
+		session.LastSeenAt, session.LastSeenAt.Add(time.Hour), time.Minute)
+	if err != nil {
+		t.Fatalf("error touching token: %v", err)
+	}
+	if touched {
+		t.Fatalf("token shouldn't have been prolonged")
+	}
+
+	later := session.LastSeenAt.Add(time.Hour)
+	touched, err = s.TouchToken(ctx, session.Token, later, later.Add(time.Hour), time.Minute)
+	if err != nil {
+		t.Fatalf("error touching token: %v", err)
+	}
+	if !touched {
+		t.Fatalf("token should have been prolonged")
+	}
+	deleted, err := s.DeleteExpiredTokens(ctx, later)
+	if err != nil {
+		t.Fatalf("error deleting expired tokens: %v", err)
+	}
+	usr, err := s.GetUserByToken(ctx, session.Token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if usr == nil {
+		t.Fatalf("prolonged token shouldn't have been deleted, deleted %d tokens", deleted)
+	}
+}
+
+func testListAndDeleteAllTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	other := insertRandomUser(t, s)
+	sessions := make([]*model.Session, 0, 3)
+	for idx := 0; idx < 3; idx++ {
+		session := model.NewSession(u.ID, "agent-"+strconv.Itoa(idx), "127.0.0.1", time.Hour)
+		// making the last session the most recently used one
+		session.LastSeenAt = session.LastSeenAt.Add(time.Duration(idx) * time.Second)
+		if err := s.InsertToken(ctx, session); err != nil {
+			t.Fatalf("error inserting token: %v", err)
+		}
+		sessions = append(sessions, session)
+	}
+	expired := model.NewSession(u.ID, "expired", "127.0.0.1", -time.Hour)
+	if err := s.InsertToken(ctx, expired); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+	otherSession := model.NewSession(other.ID, "other", "127.0.0.1", time.Hour)
+	if err := s.InsertToken(ctx, otherSession); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+
+	listed, err := s.ListTokens(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("error listing tokens: %v", err)
+	}
+	expected := []*model.Session{sessions[2], sessions[1], sessions[0]}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("wrong sessions returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, listed)
+	}
+
+	if err := s.DeleteAllTokens(ctx, u.ID, sessions[1].Token); err != nil {
+		t.Fatalf("error deleting all tokens: %v", err)
+	}
+	listed, err = s.ListTokens(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("error listing tokens: %v", err)
+	}
+	expected = []*model.Session{sessions[1]}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("wrong sessions returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, listed)
+	}
+	usr, err := s.GetUserByToken(ctx, otherSession.Token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if usr == nil {
+		t.Fatalf("sessions of other users shouldn't have been deleted")
+	}
+}
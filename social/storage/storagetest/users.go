@@ -0,0 +1,303 @@
+package storagetest
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	"github.com/chocosin/otus-hl/social/storage"
+	uuid "github.com/satori/go.uuid"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testAddAndGet(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := RandomUser()
+	err := s.InsertUser(ctx, u)
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	dbUser, err := s.FindUserByUsername(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	checkUser(t, dbUser, u)
+	dbUser, err = s.FindUserForLogin(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error finding user for login: %v", err)
+	}
+	checkUser(t, dbUser, u)
+}
+
+func testReturnsNilWhenNotExists(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u, err := s.FindUserByUsername(ctx, uuid.NewV4().String())
+	if err != nil {
+		t.Fatalf("error finding by username %v", err)
+	}
+	if u != nil {
+		t.Fatalf("expected to return nil, actual: %+v", u)
+	}
+	u, err = s.FindUserForLogin(ctx, uuid.NewV4().String())
+	if err != nil {
+		t.Fatalf("error finding user for login %v", err)
+	}
+	if u != nil {
+		t.Fatalf("expected to return nil, actual: %+v", u)
+	}
+	u, err = s.GetUserByToken(ctx, uuid.NewV4())
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if u != nil {
+		t.Fatalf("expected to return nil, actual: %+v", u)
+	}
+}
+
+func testIsUsernameTaken(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := RandomUser()
+	taken, err := s.IsUsernameTaken(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error checking username: %v", err)
+	}
+	if taken {
+		t.Fatalf("username shouldn't be taken before insert")
+	}
+	if err := s.InsertUser(ctx, u); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	taken, err = s.IsUsernameTaken(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error checking username: %v", err)
+	}
+	if !taken {
+		t.Fatalf("username should be taken right after insert")
+	}
+}
+
+func testUpdateUser(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	other := insertRandomUser(t, s)
+
+	updated := RandomUser()
+	updated.ID = u.ID
+	updated.Username = u.Username
+	updated.CreatedAt = u.CreatedAt
+	updated.Interests = []string{"music"}
+	if err := s.UpdateUser(ctx, updated); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	dbUser, err := s.FindUserByUsername(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	checkUser(t, dbUser, updated)
+
+	dbUser, err = s.FindUserByUsername(ctx, other.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	checkUser(t, dbUser, other)
+}
+
+func testDeleteUser(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	friend := insertRandomUser(t, s)
+	session := model.NewSession(u.ID, "test-agent", "127.0.0.1", time.Hour)
+	if err := s.InsertToken(ctx, session); err != nil {
+		t.Fatalf("error inserting token: %v", err)
+	}
+	if err := s.SendFriendRequest(ctx, friend.ID, u.ID); err != nil {
+		t.Fatalf("error sending friend request: %v", err)
+	}
+	if err := s.AcceptFriendRequest(ctx, u.ID, friend.ID); err != nil {
+		t.Fatalf("error accepting friend request: %v", err)
+	}
+	createPost(t, s, u, "soon deleted", time.Now().UTC().Truncate(time.Second))
+
+	if err := s.DeleteUser(ctx, u.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+	dbUser, err := s.FindUserByUsername(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	if dbUser != nil {
+		t.Fatalf("deleted user shouldn't be found")
+	}
+	dbUser, err = s.GetUserByToken(ctx, session.Token)
+	if err != nil {
+		t.Fatalf("error getting user by token: %v", err)
+	}
+	if dbUser != nil {
+		t.Fatalf("tokens of deleted user should be deleted")
+	}
+	friends, err := s.ListFriends(ctx, friend.ID)
+	if err != nil {
+		t.Fatalf("error listing friends: %v", err)
+	}
+	checkUsers(t, friends)
+	posts, err := s.ListPostsByAuthor(ctx, u.ID, 10)
+	if err != nil {
+		t.Fatalf("error listing posts: %v", err)
+	}
+	checkPosts(t, posts)
+
+	taken, err := s.IsUsernameTaken(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error checking username: %v", err)
+	}
+	if !taken {
+		t.Fatalf("username of deleted user should be taken until released")
+	}
+
+	released := insertRandomUser(t, s)
+	if err := s.DeleteUser(ctx, released.ID, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("error deleting user: %v", err)
+	}
+	taken, err = s.IsUsernameTaken(ctx, released.Username)
+	if err != nil {
+		t.Fatalf("error checking username: %v", err)
+	}
+	if taken {
+		t.Fatalf("released username shouldn't be taken")
+	}
+}
+
+func testUpdatePasswordHash(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	u := insertRandomUser(t, s)
+	hash, err := model.HashPassword("new-password")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	if err := s.UpdatePasswordHash(ctx, u.ID, hash); err != nil {
+		t.Fatalf("error updating password hash: %v", err)
+	}
+	dbUser, err := s.FindUserByUsername(ctx, u.Username)
+	if err != nil {
+		t.Fatalf("error finding by username: %v", err)
+	}
+	u.PasswordHash = hash
+	checkUser(t, dbUser, u)
+}
+
+func testLastUsernames(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for idx := 0; idx < 5; idx++ {
+		insertRandomUser(t, s)
+	}
+	expected := make([]string, 10)
+	for idx := 0; idx < 10; idx++ {
+		u := insertRandomUser(t, s)
+		expected[10-idx-1] = u.Username
+	}
+
+	last, next, err := s.LastUsernames(ctx, "", 10)
+	if err != nil {
+		t.Fatalf("failed getting last usernames")
+	}
+	if !reflect.DeepEqual(last, expected) {
+		t.Fatalf("wrong usernames returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected, last)
+	}
+	if next == "" {
+		t.Fatalf("expected next cursor")
+	}
+}
+
+func testLastUsernamesPages(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	expected := make([]string, 5)
+	for idx := 0; idx < 5; idx++ {
+		u := insertRandomUser(t, s)
+		expected[5-idx-1] = u.Username
+	}
+
+	first, next, err := s.LastUsernames(ctx, "", 3)
+	if err != nil {
+		t.Fatalf("failed getting last usernames: %v", err)
+	}
+	if !reflect.DeepEqual(first, expected[:3]) {
+		t.Fatalf("wrong usernames returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected[:3], first)
+	}
+	second, _, err := s.LastUsernames(ctx, next, 2)
+	if err != nil {
+		t.Fatalf("failed getting last usernames: %v", err)
+	}
+	if !reflect.DeepEqual(second, expected[3:]) {
+		t.Fatalf("wrong usernames returned, \nexpected:\t%+v\nactual:\t\t%+v\n", expected[3:], second)
+	}
+
+	// users inserted after the first page don't shift the next one
+	insertRandomUser(t, s)
+	again, _, err := s.LastUsernames(ctx, next, 2)
+	if err != nil {
+		t.Fatalf("failed getting last usernames: %v", err)
+	}
+	if !reflect.DeepEqual(again, second) {
+		t.Fatalf("wrong usernames returned, \nexpected:\t%+v\nactual:\t\t%+v\n", second, again)
+	}
+}
+
+func testInvalidCursor(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, cursor := range []storage.Cursor{"not base64!", "bm90IGEgY3Vyc29y"} {
+		if _, _, err := s.LastUsernames(ctx, cursor, 10); err != storage.ErrInvalidCursor {
+			t.Fatalf("expected invalid cursor error for %q, actual: %v", cursor, err)
+		}
+		if _, _, err := s.SearchUsers(ctx, "a", "b", cursor, 10); err != storage.ErrInvalidCursor {
+			t.Fatalf("expected invalid cursor error for %q, actual: %v", cursor, err)
+		}
+	}
+}
+
+func testSearchUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	prefix := "search" + uuid.NewV4().String()[:8]
+	expected := make([]*model.User, 0, 3)
+	for idx := 0; idx < 3; idx++ {
+		u := RandomUser()
+		u.FirstName = prefix + "-first-" + strconv.Itoa(idx)
+		u.LastName = prefix + "-last"
+		if err := s.InsertUser(ctx, u); err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		expected = append(expected, u)
+	}
+	// another user with the same first name, but different last name
+	other := RandomUser()
+	other.FirstName = prefix + "-first"
+	if err := s.InsertUser(ctx, other); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	found, next, err := s.SearchUsers(ctx, prefix, prefix+"-la", "", 10)
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+	checkUsers(t, found, expected...)
+	if next != "" {
+		t.Fatalf("expected no next cursor on the last page, actual: %v", next)
+	}
+
+	found, next, err = s.SearchUsers(ctx, prefix, prefix, "", 1)
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+	checkUsers(t, found, expected[0])
+	found, _, err = s.SearchUsers(ctx, prefix, prefix, next, 1)
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+	checkUsers(t, found, expected[1])
+
+	found, _, err = s.SearchUsers(ctx, prefix+"%", "", "", 10)
+	if err != nil {
+		t.Fatalf("error searching users: %v", err)
+	}
+	checkUsers(t, found)
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"github.com/chocosin/otus-hl/social/model"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"google.golang.org/grpc/codes"
+	"time"
+)
+
+const tracerName = "github.com/chocosin/otus-hl/social/storage"
+
+// tracedStorage starts a span for every call of the storage
+type tracedStorage struct {
+	storage Storage
+}
+
+// NewTracedStorage wraps the storage to trace its calls, see Unwrap to get the storage back
+func NewTracedStorage(s Storage) Storage {
+	return &tracedStorage{storage: s}
+}
+
+type tracedMessageStorage struct {
+	messages MessageStorage
+}
+
+func NewTracedMessageStorage(s MessageStorage) MessageStorage {
+	return &tracedMessageStorage{messages: s}
+}
+
+// wrapper is a decorator of a storage
+type wrapper interface {
+	unwrap() interface{}
+}
+
+func (t *tracedStorage) unwrap() interface{} {
+	return t.storage
+}
+
+func (t *tracedMessageStorage) unwrap() interface{} {
+	return t.messages
+}
+
+// Unwrap returns the storage under decorators, it is the one which may hold connections
+func Unwrap(s interface{}) interface{} {
+	for {
+		w, ok := s.(wrapper)
+		if !ok {
+			return s
+		}
+		s = w.unwrap()
+	}
+}
+
+func startSpan(ctx context.Context, name string, opts ...trace.StartOption) (context.Context, trace.Span) {
+	return global.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(ctx context.Context, span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(ctx, *err, trace.WithErrorStatus(codes.Internal))
+	}
+	span.End()
+}
+
+func (t *tracedStorage) LastUsernames(ctx context.Context, cursor Cursor, limit int) (res []string, next Cursor, err error) {
+	ctx, span := startSpan(ctx, "Storage.LastUsernames")
+	defer endSpan(ctx, span, &err)
+	return t.storage.LastUsernames(ctx, cursor, limit)
+}
+
+func (t *tracedStorage) InsertUser(ctx context.Context, user *model.User) (err error) {
+	ctx, span := startSpan(ctx, "Storage.InsertUser")
+	defer endSpan(ctx, span, &err)
+	return t.storage.InsertUser(ctx, user)
+}
+
+func (t *tracedStorage) UpdateUser(ctx context.Context, user *model.User) (err error) {
+	ctx, span := startSpan(ctx, "Storage.UpdateUser")
+	defer endSpan(ctx, span, &err)
+	return t.storage.UpdateUser(ctx, user)
+}
+
+func (t *tracedStorage) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) (err error) {
+	ctx, span := startSpan(ctx, "Storage.UpdatePasswordHash")
+	defer endSpan(ctx, span, &err)
+	return t.storage.UpdatePasswordHash(ctx, userID, passwordHash)
+}
+
+func (t *tracedStorage) FindUserByUsername(ctx context.Context, username string) (res *model.User, err error) {
+	ctx, span := startSpan(ctx, "Storage.FindUserByUsername")
+	defer endSpan(ctx, span, &err)
+	return t.storage.FindUserByUsername(ctx, username)
+}
+
+func (t *tracedStorage) FindUserForLogin(ctx context.Context, username string) (res *model.User, err error) {
+	ctx, span := startSpan(ctx, "Storage.FindUserForLogin")
+	defer endSpan(ctx, span, &err)
+	return t.storage.FindUserForLogin(ctx, username)
+}
+
+func (t *tracedStorage) IsUsernameTaken(ctx context.Context, username string) (res bool, err error) {
+	ctx, span := startSpan(ctx, "Storage.IsUsernameTaken")
+	defer endSpan(ctx, span, &err)
+	return t.storage.IsUsernameTaken(ctx, username)
+}
+
+func (t *tracedStorage) DeleteUser(ctx context.Context, userID uuid.UUID, releaseAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "Storage.DeleteUser")
+	defer endSpan(ctx, span, &err)
+	return t.storage.DeleteUser(ctx, userID, releaseAt)
+}
+
+func (t *tracedStorage) SearchUsers(ctx context.Context, firstPrefix, lastPrefix string, cursor Cursor, limit int) (res []*model.User, next Cursor, err error) {
+	ctx, span := startSpan(ctx, "Storage.SearchUsers")
+	defer endSpan(ctx, span, &err)
+	return t.storage.SearchUsers(ctx, firstPrefix, lastPrefix, cursor, limit)
+}
+
+func (t *tracedStorage) UsersByInterest(ctx context.Context, tag string, cursor Cursor, limit int) (res []*model.User, next Cursor, err error) {
+	ctx, span := startSpan(ctx, "Storage.UsersByInterest")
+	defer endSpan(ctx, span, &err)
+	return t.storage.UsersByInterest(ctx, tag, cursor, limit)
+}
+
+func (t *tracedStorage) UsersByCity(ctx context.Context, city string, cursor Cursor, limit int) (res []*model.User, next Cursor, err error) {
+	ctx, span := startSpan(ctx, "Storage.UsersByCity")
+	defer endSpan(ctx, span, &err)
+	return t.storage.UsersByCity(ctx, city, cursor, limit)
+}
+
+func (t *tracedStorage) Cities(ctx context.Context, limit int) (res []*model.City, err error) {
+	ctx, span := startSpan(ctx, "Storage.Cities")
+	defer endSpan(ctx, span, &err)
+	return t.storage.Cities(ctx, limit)
+}
+
+func (t *tracedStorage) SimilarUsers(ctx context.Context, userID uuid.UUID, limit int) (res []*model.User, err error) {
+	ctx, span := startSpan(ctx, "Storage.SimilarUsers")
+	defer endSpan(ctx, span, &err)
+	return t.storage.SimilarUsers(ctx, userID, limit)
+}
+
+func (t *tracedStorage) InsertToken(ctx context.Context, session *model.Session) (err error) {
+	ctx, span := startSpan(ctx, "Storage.InsertToken")
+	defer endSpan(ctx, span, &err)
+	return t.storage.InsertToken(ctx, session)
+}
+
+func (t *tracedStorage) DeleteToken(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "Storage.DeleteToken")
+	defer endSpan(ctx, span, &err)
+	return t.storage.DeleteToken(ctx, id)
+}
+
+func (t *tracedStorage) GetUserByToken(ctx context.Context, token uuid.UUID) (res *model.User, err error) {
+	ctx, span := startSpan(ctx, "Storage.GetUserByToken")
+	defer endSpan(ctx, span, &err)
+	return t.storage.GetUserByToken(ctx, token)
+}
+
+func (t *tracedStorage) TouchToken(ctx context.Context, token uuid.UUID, seenAt time.Time, expiresAt time.Time, minInterval time.Duration) (res bool, err error) {
+	ctx, span := startSpan(ctx, "Storage.TouchToken")
+	defer endSpan(ctx, span, &err)
+	return t.storage.TouchToken(ctx, token, seenAt, expiresAt, minInterval)
+}
+
+func (t *tracedStorage) DeleteExpiredTokens(ctx context.Context, now time.Time) (res int64, err error) {
+	ctx, span := startSpan(ctx, "Storage.DeleteExpiredTokens")
+	defer endSpan(ctx, span, &err)
+	return t.storage.DeleteExpiredTokens(ctx, now)
+}
+
+func (t *tracedStorage) CountActiveTokens(ctx context.Context, now time.Time) (res int64, err error) {
+	ctx, span := startSpan(ctx, "Storage.CountActiveTokens")
+	defer endSpan(ctx, span, &err)
+	return t.storage.CountActiveTokens(ctx, now)
+}
+
+func (t *tracedStorage) ListTokens(ctx context.Context, userID uuid.UUID) (res []*model.Session, err error) {
+	ctx, span := startSpan(ctx, "Storage.ListTokens")
+	defer endSpan(ctx, span, &err)
+	return t.storage.ListTokens(ctx, userID)
+}
+
+func (t *tracedStorage) DeleteAllTokens(ctx context.Context, userID uuid.UUID, except uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "Storage.DeleteAllTokens")
+	defer endSpan(ctx, span, &err)
+	return t.storage.DeleteAllTokens(ctx, userID, except)
+}
+
+func (t *tracedStorage) SendFriendRequest(ctx context.Context, from uuid.UUID, to uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "Storage.SendFriendRequest")
+	defer endSpan(ctx, span, &err)
+	return t.storage.SendFriendRequest(ctx, from, to)
+}
+
+func (t *tracedStorage) AcceptFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "Storage.AcceptFriendRequest")
+	defer endSpan(ctx, span, &err)
+	return t.storage.AcceptFriendRequest(ctx, userID, requesterID)
+}
+
+func (t *tracedStorage) DeclineFriendRequest(ctx context.Context, userID uuid.UUID, requesterID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "Storage.DeclineFriendRequest")
+	defer endSpan(ctx, span, &err)
+	return t.storage.DeclineFriendRequest(ctx, userID, requesterID)
+}
+
+func (t *tracedStorage) RemoveFriend(ctx context.Context, userID uuid.UUID, friendID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "Storage.RemoveFriend")
+	defer endSpan(ctx, span, &err)
+	return t.storage.RemoveFriend(ctx, userID, friendID)
+}
+
+func (t *tracedStorage) ListFriends(ctx context.Context, userID uuid.UUID) (res []*model.User, err error) {
+	ctx, span := startSpan(ctx, "Storage.ListFriends")
+	defer endSpan(ctx, span, &err)
+	return t.storage.ListFriends(ctx, userID)
+}
+
+func (t *tracedStorage) ListPendingRequests(ctx context.Context, userID uuid.UUID) (res []*model.User, err error) {
+	ctx, span := startSpan(ctx, "Storage.ListPendingRequests")
+	defer endSpan(ctx, span, &err)
+	return t.storage.ListPendingRequests(ctx, userID)
+}
+
+func (t *tracedStorage) GetFriendshipStatus(ctx context.Context, userID uuid.UUID, otherID uuid.UUID) (res model.FriendshipStatus, err error) {
+	ctx, span := startSpan(ctx, "Storage.GetFriendshipStatus")
+	defer endSpan(ctx, span, &err)
+	return t.storage.GetFriendshipStatus(ctx, userID, otherID)
+}
+
+func (t *tracedStorage) ListFollowerIDs(ctx context.Context, userID uuid.UUID) (res []uuid.UUID, err error) {
+	ctx, span := startSpan(ctx, "Storage.ListFollowerIDs")
+	defer endSpan(ctx, span, &err)
+	return t.storage.ListFollowerIDs(ctx, userID)
+}
+
+func (t *tracedStorage) CreatePost(ctx context.Context, post *model.Post) (err error) {
+	ctx, span := startSpan(ctx, "Storage.CreatePost")
+	defer endSpan(ctx, span, &err)
+	return t.storage.CreatePost(ctx, post)
+}
+
+func (t *tracedStorage) ListPostsByAuthor(ctx context.Context, authorID uuid.UUID, limit int) (res []*model.Post, err error) {
+	ctx, span := startSpan(ctx, "Storage.ListPostsByAuthor")
+	defer endSpan(ctx, span, &err)
+	return t.storage.ListPostsByAuthor(ctx, authorID, limit)
+}
+
+func (t *tracedStorage) ListFeed(ctx context.Context, userID uuid.UUID, limit int) (res []*model.Post, err error) {
+	ctx, span := startSpan(ctx, "Storage.ListFeed")
+	defer endSpan(ctx, span, &err)
+	return t.storage.ListFeed(ctx, userID, limit)
+}
+
+func (t *tracedMessageStorage) SendMessage(ctx context.Context, msg *model.Message, author, recipient string) (err error) {
+	ctx, span := startSpan(ctx, "MessageStorage.SendMessage")
+	defer endSpan(ctx, span, &err)
+	return t.messages.SendMessage(ctx, msg, author, recipient)
+}
+
+func (t *tracedMessageStorage) ListMessages(ctx context.Context, dialogID uuid.UUID, limit int) (res []*model.Message, err error) {
+	ctx, span := startSpan(ctx, "MessageStorage.ListMessages")
+	defer endSpan(ctx, span, &err)
+	return t.messages.ListMessages(ctx, dialogID, limit)
+}
+
+func (t *tracedMessageStorage) ListDialogs(ctx context.Context, userID uuid.UUID) (res []*model.Dialog, err error) {
+	ctx, span := startSpan(ctx, "MessageStorage.ListDialogs")
+	defer endSpan(ctx, span, &err)
+	return t.messages.ListDialogs(ctx, userID)
+}
+
+func (t *tracedMessageStorage) DeleteUserDialogs(ctx context.Context, userID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "MessageStorage.DeleteUserDialogs")
+	defer endSpan(ctx, span, &err)
+	return t.messages.DeleteUserDialogs(ctx, userID)
+}
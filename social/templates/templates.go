@@ -31,6 +31,36 @@ func NewSignupInfo(m url.Values) *SignupInfo {
 	}
 }
 
+// ProfileInfo is the profile editing form, passwords are filled only to change the password
+type ProfileInfo struct {
+	Err             string
+	FirstName       string
+	LastName        string
+	Age             string
+	Gender          string
+	Interests       string
+	City            string
+	CurrentPassword string
+	NewPassword     string
+}
+
+func NewProfileInfo(m url.Values) *ProfileInfo {
+	return &ProfileInfo{
+		FirstName:       m.Get("FirstName"),
+		LastName:        m.Get("LastName"),
+		Age:             m.Get("Age"),
+		Gender:          m.Get("Gender"),
+		Interests:       m.Get("Interests"),
+		City:            m.Get("City"),
+		CurrentPassword: m.Get("CurrentPassword"),
+		NewPassword:     m.Get("NewPassword"),
+	}
+}
+
+type DeleteInfo struct {
+	Err string
+}
+
 type Hint struct {
 	HintText string
 	IsError  bool
@@ -64,6 +94,120 @@ type UserInfo struct {
 	City      string
 
 	IsMe bool
+
+	ShowFriendship bool
+	Friendship     string
+
+	Posts []PostInfo
+	// Similar are users sharing most interests
+	Similar []SearchResult
+}
+
+type PostInfo struct {
+	Author    string
+	Text      string
+	CreatedAt string
+}
+
+type FeedInfo struct {
+	Err   string
+	Text  string
+	Posts []PostInfo
+	// Similar are users sharing most interests
+	Similar []SearchResult
+}
+
+type FriendsInfo struct {
+	Friends []string
+	Pending []string
+}
+
+type SearchResult struct {
+	Username  string
+	FirstName string
+	LastName  string
+}
+
+type SearchInfo struct {
+	First   string
+	Last    string
+	Results []SearchResult
+
+	// Cursor is the position after the previous page, empty on the first one
+	Cursor     string
+	HasNext    bool
+	NextCursor string
+}
+
+type InterestInfo struct {
+	Tag     string
+	Results []SearchResult
+
+	Cursor     string
+	HasNext    bool
+	NextCursor string
+}
+
+type LastUsernamesInfo struct {
+	Usernames []string
+
+	Cursor     string
+	HasNext    bool
+	NextCursor string
+}
+
+type CityItem struct {
+	Name  string
+	Users int
+}
+
+type CitiesInfo struct {
+	Cities []CityItem
+}
+
+type CityInfo struct {
+	Name    string
+	Results []SearchResult
+
+	Cursor     string
+	HasNext    bool
+	NextCursor string
+}
+
+type SessionInfo struct {
+	ID         string
+	UserAgent  string
+	IP         string
+	CreatedAt  string
+	LastSeenAt string
+	Current    bool
+}
+
+type SessionsInfo struct {
+	Sessions []SessionInfo
+}
+
+type DialogItem struct {
+	Username      string
+	LastMessageAt string
+}
+
+type DialogsInfo struct {
+	Dialogs []DialogItem
+}
+
+type MessageInfo struct {
+	Author    string
+	Text      string
+	CreatedAt string
+	Mine      bool
+}
+
+type DialogInfo struct {
+	With     string
+	Err      string
+	Text     string
+	Messages []MessageInfo
 }
 
 type Templates struct {
@@ -73,6 +217,17 @@ type Templates struct {
 	User          *template.Template
 	Index         *template.Template
 	LastUsernames *template.Template
+	Friends       *template.Template
+	Search        *template.Template
+	Sessions      *template.Template
+	Feed          *template.Template
+	Dialogs       *template.Template
+	Dialog        *template.Template
+	Profile       *template.Template
+	Delete        *template.Template
+	Interest      *template.Template
+	Cities        *template.Template
+	City          *template.Template
 }
 
 func NewTemplates(dir string) (*Templates, error) {
@@ -100,5 +255,49 @@ func NewTemplates(dir string) (*Templates, error) {
 	if err != nil {
 		return nil, err
 	}
+	templates.Friends, err = template.ParseFiles(path.Join(dir, "friends.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Search, err = template.ParseFiles(path.Join(dir, "search.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Sessions, err = template.ParseFiles(path.Join(dir, "sessions.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Feed, err = template.ParseFiles(path.Join(dir, "feed.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Dialogs, err = template.ParseFiles(path.Join(dir, "dialogs.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Dialog, err = template.ParseFiles(path.Join(dir, "dialog.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Profile, err = template.ParseFiles(path.Join(dir, "profile.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Delete, err = template.ParseFiles(path.Join(dir, "delete.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Interest, err = template.ParseFiles(path.Join(dir, "interest.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.Cities, err = template.ParseFiles(path.Join(dir, "cities.html"))
+	if err != nil {
+		return nil, err
+	}
+	templates.City, err = template.ParseFiles(path.Join(dir, "city.html"))
+	if err != nil {
+		return nil, err
+	}
 	return &templates, nil
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"google.golang.org/grpc/codes"
+	"net/http"
+)
+
+const tracerName = "github.com/chocosin/otus-hl/social"
+
+type loggerKey struct{}
+
+// trace starts a server span of the request, continuing the trace from traceparent header.
+// The span is named after the route pattern once the request is routed.
+// Logger with trace and span ids is put to the request context, see log.
+func (app *App) trace(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagation.ExtractHTTP(r.Context(), global.Propagators(), r.Header)
+		ctx, span := global.Tracer(tracerName).Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(standard.HTTPMethodKey.String(r.Method),
+				standard.HTTPTargetKey.String(r.URL.RequestURI())))
+		defer span.End()
+
+		logger := app.logger
+		if sc := span.SpanContext(); sc.IsValid() {
+			logger = logger.With().
+				Str("traceID", sc.TraceID.String()).
+				Str("spanID", sc.SpanID.String()).
+				Logger()
+		}
+		ctx = context.WithValue(ctx, loggerKey{}, &logger)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		h.ServeHTTP(ww, r.WithContext(ctx))
+
+		route, status := routePattern(r), responseStatus(ww)
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(standard.HTTPRouteKey.String(route), standard.HTTPStatusCodeKey.Int(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Internal, http.StatusText(status))
+		}
+	})
+}
+
+// log returns the logger of the request with trace ids, or the app logger outside of requests
+func (app *App) log(ctx context.Context) *zerolog.Logger {
+	return requestLogger(ctx, &app.logger)
+}
+
+func requestLogger(ctx context.Context, fallback *zerolog.Logger) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// routePattern is the pattern of the chi route which served the request, e.g. /user/{username}
+func routePattern(r *http.Request) string {
+	if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+// responseStatus returns the written status, handlers writing no header respond with 200
+func responseStatus(ww middleware.WrapResponseWriter) int {
+	if status := ww.Status(); status != 0 {
+		return status
+	}
+	return http.StatusOK
+}
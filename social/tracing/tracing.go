@@ -0,0 +1,70 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are started through the global tracer,
+// trace context is propagated in W3C traceparent header.
+package tracing
+
+import (
+	"fmt"
+	"github.com/chocosin/otus-hl/social/config"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const serviceName = "social"
+
+// Setup installs the global tracer provider with the configured exporter,
+// shutdown exports the remaining spans and stops the exporter.
+// With none exporter spans are not recorded, but incoming trace context is still propagated.
+func Setup(cfg *config.Tracing) (shutdown func(), err error) {
+	global.SetPropagators(propagation.New(
+		propagation.WithExtractors(trace.TraceContext{}),
+		propagation.WithInjectors(trace.TraceContext{}),
+	))
+
+	var processor sdktrace.SpanProcessor
+	stopExporter := func() error { return nil }
+	switch cfg.Exporter {
+	case config.TracingNone:
+		return func() {}, nil
+	case config.TracingStdout:
+		exporter, err := stdout.NewExporter(stdout.Options{})
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	case config.TracingOTLP:
+		// collector may be not reachable yet, exporter keeps reconnecting in background
+		exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(cfg.OTLPEndpoint))
+		if err != nil {
+			return nil, err
+		}
+		if processor, err = sdktrace.NewBatchSpanProcessor(exporter); err != nil {
+			exporter.Stop()
+			return nil, err
+		}
+		stopExporter = exporter.Stop
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(cfg.SampleRatio)}),
+		sdktrace.WithResource(resource.New(standard.ServiceNameKey.String(serviceName))),
+	)
+	if err != nil {
+		stopExporter()
+		return nil, err
+	}
+	provider.RegisterSpanProcessor(processor)
+	global.SetTraceProvider(provider)
+	return func() {
+		// unregistering shuts the processor down, batched spans are exported
+		provider.UnregisterSpanProcessor(processor)
+		stopExporter()
+	}, nil
+}